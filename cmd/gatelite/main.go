@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -13,15 +16,28 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/AlexKimmel/GateLite/internal/accesslog"
+	"github.com/AlexKimmel/GateLite/internal/adaptive"
+	"github.com/AlexKimmel/GateLite/internal/admin"
+	"github.com/AlexKimmel/GateLite/internal/audit"
 	"github.com/AlexKimmel/GateLite/internal/auth"
+	"github.com/AlexKimmel/GateLite/internal/capture"
 	"github.com/AlexKimmel/GateLite/internal/config"
+	"github.com/AlexKimmel/GateLite/internal/diag"
 	"github.com/AlexKimmel/GateLite/internal/gateway"
+	"github.com/AlexKimmel/GateLite/internal/health"
 	"github.com/AlexKimmel/GateLite/internal/obs"
 	"github.com/AlexKimmel/GateLite/internal/proxy"
+	"github.com/AlexKimmel/GateLite/internal/quota"
+	quotabolt "github.com/AlexKimmel/GateLite/internal/quota/bolt"
 	"github.com/AlexKimmel/GateLite/internal/ratelimit"
 	"github.com/AlexKimmel/GateLite/internal/ratelimit/memory"
+	redislimiter "github.com/AlexKimmel/GateLite/internal/ratelimit/redis"
+	"github.com/AlexKimmel/GateLite/internal/reqid"
 	"github.com/AlexKimmel/GateLite/internal/routing"
+	"github.com/AlexKimmel/GateLite/internal/upgrade"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -37,17 +53,84 @@ func main() {
 	logger := obs.SetupLogger(cfg.Observability.LogLevel)
 	logger.Info().Msg("Setup logger")
 
-	reg := prometheus.NewRegistry()
-	metrics := obs.NewMetrics(reg)
+	// Access log
+	accessLog := func(next http.Handler) http.Handler { return next }
+	if ac := cfg.Observability.AccessLog; ac.Enabled {
+		sample := make([]accesslog.SampleRule, 0, len(ac.Sample))
+		for _, s := range ac.Sample {
+			sample = append(sample, accesslog.SampleRule{Status: s.Status, Route: s.Route, Rate: s.Rate})
+		}
+		al, err := accesslog.New(accesslog.Options{
+			Format:         ac.Format,
+			Fields:         ac.Fields,
+			Output:         ac.Output,
+			MaxSizeMB:      ac.MaxSizeMB,
+			Rotate:         ac.Rotate,
+			MaxBackups:     ac.MaxBackups,
+			Sample:         sample,
+			TrustedProxies: ac.TrustedProxies,
+			RedactQuery:    cfg.Observability.Capture.RedactQuery,
+		})
+		if err != nil {
+			log.Fatalf("access log: %v", err)
+		}
+		defer func() { _ = al.Close() }()
+		accessLog = al.Middleware()
+	}
 
-	// Public endpoints
-	mux := http.NewServeMux()
+	// Listening sockets may be inherited from an upgrading parent or systemd
+	listeners, err := upgrade.New()
+	if err != nil {
+		log.Fatalf("inherited listeners: %v", err)
+	}
+
+	if tc := cfg.Observability.Tracing; tc.Enabled {
+		shutdownTracing, err := obs.SetupTracing(context.Background(), obs.TracingOptions{
+			Exporter:    tc.Exporter,
+			Endpoint:    tc.Endpoint,
+			Insecure:    tc.Insecure,
+			Sampler:     tc.Sampler,
+			SampleRatio: tc.SampleRatio,
+			ServiceName: tc.ServiceName,
+		})
+		if err != nil {
+			log.Fatalf("tracing: %v", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(ctx); err != nil {
+				logger.Warn().Err(err).Msg("flush traces")
+			}
+		}()
+	}
 
-	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte(`{"ok":true}`))
+	for name, b := range map[string][]float64{
+		"latency": cfg.Observability.Buckets.Latency,
+		"size":    cfg.Observability.Buckets.Size,
+	} {
+		for i := 1; i < len(b); i++ {
+			if b[i] <= b[i-1] {
+				log.Fatalf("observability.buckets.%s must be strictly increasing", name)
+			}
+		}
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	metrics := obs.NewMetrics(reg, obs.MetricsOptions{
+		LatencyBuckets: cfg.Observability.Buckets.Latency,
+		SizeBuckets:    cfg.Observability.Buckets.Size,
+		KeyMetrics:     cfg.Observability.KeyMetrics.Enabled,
+		MaxKeys:        cfg.Observability.KeyMetrics.MaxKeys,
+		AlwaysKeys:     cfg.Observability.KeyMetrics.Always,
 	})
 
+	// Ops, debug and admin endpoints (private admin listener)
+	mux := http.NewServeMux()
+
 	mux.HandleFunc("/version", func(w http.ResponseWriter, _ *http.Request) {
 		_, _ = w.Write([]byte("v.0.0.1"))
 	})
@@ -93,8 +176,10 @@ func main() {
 					"\n  prefix=" + strconv.Quote(rt.Prefix) +
 					"\n  prefix_len=" + strconv.Itoa(len(rt.Prefix)) +
 					"\n  methods_keys=" + keys(rt.Methods) +
-					"\n  limit_default_rpm=" + strconv.Itoa(rt.LimitDefaultRPM) +
-					"\n  limit_default_burst=" + strconv.Itoa(rt.LimitDefaultBurst) +
+					"\n  tags=[" + strings.Join(rt.Tags, ",") + "]" +
+					"\n  limit_default_rpm=" + strconv.Itoa(rt.LimitDefault.RPM) +
+					"\n  limit_default_burst=" + strconv.Itoa(rt.LimitDefault.Burst) +
+					"\n  limit_default_algorithm=" + string(rt.LimitDefault.Algorithm) +
 					"\n  limit_overrides_keys=" + keys(func() map[string]struct{} {
 					m := make(map[string]struct{})
 					for k := range rt.LimitOverrides {
@@ -121,31 +206,64 @@ func main() {
 		}
 	}
 	authStore := auth.NewStatic(cfg.Auth.Header, pairs)
+	for _, k := range cfg.Auth.Keys {
+		if k.ID != "" && len(k.Metadata) > 0 {
+			authStore.SetMetadata(k.ID, k.Metadata)
+		}
+	}
+
+	// Adaptive concurrency limits by route ID
+	adaptiveLimits := map[string]*adaptive.Limiter{}
+	var healthTargets []health.Target
 
 	// Build router from cfg.Routers
 	// rr := routing.New() moved upwards for debugging
 	for _, rc := range cfg.Routes {
 
-		rpm := rc.RateLimitPolicy.Default.RequestsPerMinute
-		burst := rc.RateLimitPolicy.Default.Burst
-		if rpm <= 0 {
-			rpm = cfg.Limits.Default.RequestsPerMinute
-		}
-		if burst <= 0 {
-			burst = cfg.Limits.Default.Burst
+		// route default; left at zero so the limiter can fall back to plans
+		// and the global default at request time
+		def := rc.RateLimitPolicy.Default
+		var routeDefault ratelimit.Policy
+		if def.RPM() > 0 {
+			routeDefault = policyFrom(def)
 		}
 
-		ov := map[string]struct{ RPM, Burst int }{}
+		// overrides inherit missing fields from the route, then global default
+		base := routeDefault
+		if base.RPM <= 0 {
+			base = policyFrom(cfg.Limits.Default)
+		}
+		ov := map[string]ratelimit.Policy{}
 		for keyID, p := range rc.RateLimitPolicy.Overrides {
-			orpm := p.RequestsPerMinute
-			oburst := p.Burst
-			if orpm <= 0 {
-				orpm = rpm
+			if p.RequestsPerMinute <= 0 && p.RequestsPerSecond <= 0 {
+				p.RequestsPerMinute = base.RPM
+			}
+			if p.Burst <= 0 {
+				p.Burst = base.Burst
 			}
-			if oburst <= 0 {
-				oburst = burst
+			if p.Algorithm == "" {
+				p.Algorithm = string(base.Algorithm)
 			}
-			ov[keyID] = struct{ RPM, Burst int }{RPM: orpm, Burst: oburst}
+			if p.Mode == "" && base.Shadow {
+				p.Mode = "shadow"
+			}
+			ov[keyID] = policyFrom(p)
+		}
+
+		// key_by, algorithms and modes were validated by config.Load
+		keyBy, _ := ratelimit.ParseKeyBy(rc.RateLimitPolicy.KeyBy)
+		var limits []routing.Limit
+		for i, lc := range rc.RateLimitPolicy.Limits {
+			kb, _ := ratelimit.ParseKeyBy(lc.KeyBy)
+			id := lc.ID
+			if id == "" {
+				id = strconv.Itoa(i)
+			}
+			// default burst: one second of traffic for rps limits, one minute otherwise
+			if lc.Burst <= 0 {
+				lc.Burst = lc.RequestsPerSecond
+			}
+			limits = append(limits, routing.Limit{ID: id, KeyBy: kb, Policy: policyFrom(lc.RateLimitPolicy)})
 		}
 
 		u, err := url.Parse(rc.Upstream.URL)
@@ -161,89 +279,477 @@ func main() {
 		if timeout <= 0 {
 			timeout = 3 * time.Second
 		}
+		costMethods := map[string]int{}
+		for m, c := range rc.Cost.Methods {
+			costMethods[strings.ToUpper(m)] = c
+		}
+
+		if ac := rc.Adaptive; ac.Enabled {
+			routeID := rc.ID
+			adaptiveLimits[routeID] = adaptive.New(adaptive.Config{
+				MinLimit:         ac.MinLimit,
+				MaxLimit:         ac.MaxLimit,
+				InitialLimit:     ac.InitialLimit,
+				LatencyThreshold: time.Duration(ac.LatencyThresholdMS) * time.Millisecond,
+				Backoff:          ac.Backoff,
+				OnChange: func(limit int) {
+					metrics.AdaptiveLimit.WithLabelValues(routeID).Set(float64(limit))
+				},
+			})
+		}
+
+		ht := health.Target{RouteID: rc.ID, Critical: rc.Upstream.Critical}
+		if hp := rc.Upstream.HealthPath; hp != "" {
+			ht.URL = strings.TrimSuffix(u.String(), "/") + "/" + strings.TrimPrefix(hp, "/")
+		} else if rc.Upstream.Critical {
+			log.Fatalf("route %s: critical upstream needs a health_path", rc.ID)
+		}
+		healthTargets = append(healthTargets, ht)
+
 		prefix := strings.TrimSpace(rc.Match.PathPrefix)
 		prefix = strings.TrimSuffix(prefix, "/")
 		rr.Add(&routing.Route{
 			ID:      rc.ID,
+			Tags:    rc.Tags,
 			Methods: methods,
 			Prefix:  prefix,
 			UpUrl:   u,
 			Timeout: timeout,
 
-			LimitDefaultRPM:   rpm,
-			LimitDefaultBurst: burst,
-			LimitOverrides:    ov,
+			LimitDefault:   routeDefault,
+			LimitOverrides: ov,
+			LimitKeyBy:     keyBy,
+			Limits:         limits,
+
+			MaxInFlight:         rc.Concurrency.MaxInFlight,
+			MaxInFlightPerKey:   rc.Concurrency.MaxPerKey,
+			MaxInFlightUpstream: rc.Upstream.MaxInFlight,
+			QueueSize:           rc.Concurrency.QueueSize,
+			QueueTimeout:        time.Duration(rc.Concurrency.QueueTimeoutMS) * time.Millisecond,
+
+			Cost: routing.Cost{
+				Default:        rc.Cost.Default,
+				Methods:        costMethods,
+				Header:         rc.Cost.Header,
+				Query:          rc.Cost.Query,
+				Max:            rc.Cost.Max,
+				ResponseHeader: rc.Cost.ResponseHeader,
+			},
 		})
 	}
 
 	// Rate limiter + policy
-	memLimiter := memory.New()
-	policy := ratelimit.Policy{
-		RPM:   cfg.Limits.Default.RequestsPerMinute,
-		Burst: cfg.Limits.Default.Burst,
+	var (
+		limiter        ratelimit.Limiter
+		limiterBuckets func() int // in-memory limiter only
+	)
+	switch cfg.Limits.Backend.Type {
+	case "memory":
+		mc := cfg.Limits.Backend.Memory
+		ml := memory.New(memory.Options{
+			Shards:          mc.Shards,
+			MaxKeys:         mc.MaxKeys,
+			JanitorInterval: time.Duration(mc.JanitorIntervalMS) * time.Millisecond,
+			OnEvict:         func(reason string) { metrics.LimiterEvictions.WithLabelValues(reason).Inc() },
+		})
+		metrics.TrackLimiterBuckets(ml.Len)
+		limiter, limiterBuckets = ml, ml.Len
+	case "redis":
+		rc := cfg.Limits.Backend.Redis
+		rl := redislimiter.New(redislimiter.Options{
+			Addr:         rc.Addr,
+			Cluster:      rc.Cluster,
+			Username:     rc.Username,
+			Password:     rc.Password,
+			DB:           rc.DB,
+			PoolSize:     rc.PoolSize,
+			MinIdleConns: rc.MinIdleConns,
+			DialTimeout:  time.Duration(rc.DialTimeoutMS) * time.Millisecond,
+			Timeout:      time.Duration(rc.TimeoutMS) * time.Millisecond,
+			KeyPrefix:    rc.KeyPrefix,
+		})
+		pctx, pcancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if err := rl.Ping(pctx); err != nil {
+			logger.Warn().Err(err).Str("addr", rc.Addr).Msg("redis limiter not reachable at startup")
+		}
+		pcancel()
+		limiter = rl
+	default:
+		log.Fatalf("unknown limits.backend.type %q", cfg.Limits.Backend.Type)
+	}
+	defer func() { _ = limiter.Close() }()
+	policies := gateway.Policies{
+		Default:  policyFrom(cfg.Limits.Default),
+		Global:   policyFrom(cfg.Limits.Global),
+		Groups:   map[string]ratelimit.Policy{},
+		FailOpen: cfg.Limits.Backend.FailureMode == "open",
+		Headers:  gateway.HeaderFormat(cfg.Limits.Headers),
+
+		DebugHeaders: cfg.Limits.DebugHeaders,
+	}
+	switch policies.Headers {
+	case "", gateway.HeadersLegacy, gateway.HeadersIETF, gateway.HeadersBoth:
+	default:
+		log.Fatalf("unknown limits.headers %q (want legacy, ietf or both)", cfg.Limits.Headers)
+	}
+	for tag, g := range cfg.Limits.Groups {
+		policies.Groups[tag] = policyFrom(g)
+	}
+	policies.Plans = map[string]gateway.Plan{}
+	for name, pc := range cfg.Plans {
+		pl := gateway.Plan{Default: policyFrom(pc.Default), Routes: map[string]ratelimit.Policy{}}
+		for routeID, rp := range pc.Routes {
+			pl.Routes[routeID] = policyFrom(rp)
+		}
+		policies.Plans[name] = pl
+	}
+
+	// Liveness and readiness (/health is kept as a liveness alias)
+	checker := health.New(health.Options{
+		Interval: time.Duration(cfg.Health.IntervalMS) * time.Millisecond,
+		Timeout:  time.Duration(cfg.Health.TimeoutMS) * time.Millisecond,
+		Failures: cfg.Health.Failures,
+	}, healthTargets)
+	mux.HandleFunc("/livez", checker.Livez)
+	mux.HandleFunc("/health", checker.Livez)
+	mux.HandleFunc("/readyz", checker.Readyz)
+
+	// Admin API
+	// Debug capture, toggled through the admin API
+	cc := cfg.Observability.Capture
+	redact := cc.RedactHeaders
+	if len(redact) == 0 {
+		redact = capture.DefaultRedactHeaders
+	}
+	var captureOut io.Writer = os.Stdout
+	switch cc.Output {
+	case "", "stdout":
+	case "stderr":
+		captureOut = os.Stderr
+	default:
+		f, err := os.OpenFile(cc.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatalf("open capture output: %v", err)
+		}
+		defer func() { _ = f.Close() }()
+		captureOut = f
+	}
+	capt := capture.New(capture.Options{
+		Out:           captureOut,
+		MaxBody:       cc.MaxBodyBytes,
+		RedactHeaders: append([]string{cfg.Auth.Header}, redact...),
+		RedactQuery:   cc.RedactQuery,
+		RedactJSON:    cc.RedactJSON,
+	})
+
+	auditLog, err := audit.Open(cfg.Admin.AuditLog)
+	if err != nil {
+		log.Fatalf("open audit log: %v", err)
+	}
+	defer func() { _ = auditLog.Close() }()
+
+	mux.Handle("/admin/", admin.Handler(admin.Options{
+		Limiter:  limiter,
+		Policies: policies,
+		Routes:   rr.Routes(),
+		Metadata: authStore.Metadata,
+		Capture:  capt,
+		Audit:    auditLog,
+	}))
+
+	// Quotas (persisted so restarts don't reset usage)
+	var quotas []quota.Quota
+	for _, qc := range cfg.Limits.Quotas {
+		period, _ := quota.ParsePeriod(qc.Period) // validated by config.Load
+		q := quota.Quota{
+			ID:        qc.ID,
+			Limit:     qc.Limit,
+			Period:    period,
+			PerRoute:  qc.Scope == "key_route",
+			Routes:    map[string]struct{}{},
+			Overrides: qc.Overrides,
+		}
+		for _, id := range qc.Routes {
+			q.Routes[id] = struct{}{}
+		}
+		quotas = append(quotas, q)
 	}
-	// Skip list for auth/ratelimit/router-matching
-	skip := map[string]struct{}{
-		"/health":       {},
-		"/version":      {},
-		"/debug/match":  {},
-		"/debug/router": {},
-		metricsPath:     {},
+	var (
+		quotaStore quota.Store
+		boltStore  *quotabolt.Store
+	)
+	if len(quotas) > 0 {
+		qs, err := quotabolt.Open(cfg.Limits.QuotaStore)
+		if err != nil {
+			log.Fatalf("open quota store: %v", err)
+		}
+		defer func() { _ = qs.Close() }()
+		quotaStore, boltStore = qs, qs
 	}
 
 	// Reverse proxy final handler + middleware stack
 	tr := proxy.NewHTTPTransport()
-	finalProxy := proxy.Handler(tr)
+	upstreamConns := proxy.CountConns(tr)
+	diag.Register(mux, diag.Options{
+		Transports:     map[string]*proxy.ConnCount{"upstream": upstreamConns},
+		LimiterBuckets: limiterBuckets,
+	})
+	finalProxy := proxy.Handler(tr, metrics.UpstreamBegin,
+		metrics.ObserveUpstream,
+		accesslog.ObserveUpstream,
+		// feed upstream latency into adaptive limits; client cancellations
+		// say nothing about upstream health
+		func(_ *http.Request, rt *routing.Route, res proxy.Result) {
+			if l := adaptiveLimits[rt.ID]; l != nil && !errors.Is(res.Err, context.Canceled) {
+				l.Observe(res.Latency, res.Err != nil || res.Status >= 500, time.Now())
+			}
+		},
+	)
 
+	drain := &gateway.Drain{}
 	gatewayStack := gateway.Chain(
 		finalProxy,
-		obs.Logger(logger),
+		drain.Middleware(),
+		obs.Tracing(),
+		reqid.Middleware(cfg.Server.RequestIDHeader),
+		accessLog,
+		obs.Logger(logger, !cfg.Observability.AccessLog.Enabled),
 		gateway.BodyLimit(int(cfg.Server.MaxBody())),
-		gateway.RouteMatcher(rr, skip),
-		metrics.Middleware(skip),
-		authStore.Middleware(skip),
+		gateway.RouteMatcher(rr),
+		metrics.Middleware(),
+		authStore.Middleware(),
+		accesslog.Annotate(),
+		capt.Middleware(),
+		metrics.KeyMiddleware(),
 		gateway.RateLimit(
-			memLimiter,
-			policy,
-			skip,
-			func(routeID string) { metrics.RateLimited.WithLabelValues(routeID).Inc() },
+			limiter,
+			policies,
+			func(routeID, keyID string) {
+				metrics.RateLimited.WithLabelValues(routeID).Inc()
+				metrics.ObserveKeyLimited(routeID, keyID)
+			},
+			func(routeID, keyID, limit string) {
+				metrics.ShadowLimited.WithLabelValues(routeID, metrics.KeyLabel(keyID), limit).Inc()
+			},
 			func(routeID string) { metrics.LimiterErrors.WithLabelValues(routeID).Inc() },
 		),
+		gateway.Concurrency(
+			func(routeID, scope string) { metrics.ConcurrencyRejected.WithLabelValues(routeID, scope).Inc() },
+			func(routeID string, d int) { metrics.InFlight.WithLabelValues(routeID).Add(float64(d)) },
+			func(routeID string, d int) { metrics.Queued.WithLabelValues(routeID).Add(float64(d)) },
+		),
+		gateway.Adaptive(
+			adaptiveLimits,
+			func(routeID string) { metrics.AdaptiveShed.WithLabelValues(routeID).Inc() },
+		),
+		// quota last so requests shed by concurrency or adaptive limits are
+		// not charged against it
+		gateway.Quota(
+			quotaStore,
+			quotas,
+			func(routeID string) { metrics.QuotaExceeded.WithLabelValues(routeID).Inc() },
+			func(routeID string) { metrics.QuotaErrors.WithLabelValues(routeID).Inc() },
+		),
 	)
 
-	mux.Handle("/", gatewayStack)
-
-	// Server
+	// Servers
 
+	// cancelling the base context closes upgraded (e.g. WebSocket)
+	// connections, which Shutdown does not track
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+	publicHandler := gatewayStack
+	if cfg.Server.PublicProbes {
+		publicHandler = withProbes(gatewayStack, checker)
+	}
 	srv := &http.Server{
 		Addr:              cfg.Server.Addr,
-		Handler:           mux,
+		Handler:           publicHandler,
 		ReadHeaderTimeout: 5 * time.Second,
 		WriteTimeout:      cfg.Server.WriteTimeout(),
 		IdleTimeout:       cfg.Server.IdleTimeout(),
 		ReadTimeout:       cfg.Server.ReadTimeout(),
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+
+	// the admin API can reset limits and dump memory: without a token it is
+	// only reachable locally
+	if cfg.Admin.Token == "" && cfg.Admin.Socket == "" && !isLoopback(cfg.Admin.Addr) {
+		log.Fatalf("admin.token is required when the admin listener (%s) is not on loopback or a unix socket", cfg.Admin.Addr)
+	}
+	var adminHandler http.Handler = mux
+	if cfg.Admin.Token != "" {
+		// probes stay open so orchestrators need no credentials
+		adminHandler = admin.RequireToken(cfg.Admin.Token, mux, "/livez", "/health", "/readyz")
+	}
+	adminSrv := &http.Server{
+		Handler:           adminHandler,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       cfg.Server.IdleTimeout(),
+	}
+	ln, err := listeners.Listen("public", "tcp", cfg.Server.Addr)
+	if err != nil {
+		log.Fatalf("listen: %v", err)
+	}
+	adminLn, err := adminListener(listeners, cfg.Admin)
+	if err != nil {
+		log.Fatalf("admin listener: %v", err)
 	}
 
 	// start
 	go func() {
-		log.Printf("listening on %s", srv.Addr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("listening on %s", ln.Addr())
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("server error: %v", err)
 		}
 	}()
+	go func() {
+		log.Printf("admin listening on %s", adminLn.Addr())
+		if err := adminSrv.Serve(adminLn); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("admin server error: %v", err)
+		}
+	}()
+
+	// ready once the first upstream probes are in
+	probeCtx, stopProbes := context.WithCancel(context.Background())
+	defer stopProbes()
+	checker.Start(probeCtx)
+	checker.SetReady()
+	if err := upgrade.Ready(); err != nil {
+		logger.Error().Err(err).Msg("notify parent of readiness")
+	}
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
-	<-stop
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	upgradeSig := make(chan os.Signal, 1)
+	signal.Notify(upgradeSig, syscall.SIGUSR2)
+
+	// wait for a stop signal or a successful upgrade
+	upgraded := false
+wait:
+	for {
+		select {
+		case <-stop:
+			break wait
+		case <-upgradeSig:
+			logger.Info().Msg("upgrading: starting new process")
+			err := listeners.Upgrade(cfg.Server.UpgradeTimeout(), func() func() {
+				// bbolt locks its file; the new process has to open it
+				if boltStore == nil {
+					return func() {}
+				}
+				if err := boltStore.Release(); err != nil {
+					logger.Error().Err(err).Msg("release quota store")
+				}
+				return func() {
+					if err := boltStore.Reacquire(); err != nil {
+						logger.Error().Err(err).Msg("reopen quota store")
+					}
+				}
+			})
+			if err != nil {
+				logger.Error().Err(err).Msg("upgrade failed, still serving")
+				continue
+			}
+			upgraded = true
+			logger.Info().Msg("new process ready, draining")
+			break wait
+		}
+	}
+
+	// drain: a second signal skips whatever waiting is left
+	forceCtx, force := context.WithCancel(context.Background())
+	defer force()
+	go func() {
+		<-stop
+		logger.Warn().Msg("second signal, forcing shutdown")
+		force()
+	}()
+
+	// after an upgrade the new process already accepts on the same sockets,
+	// so there is no load balancer to wait for, and /readyz must keep
+	// answering from the new process only
+	if upgraded {
+		actx, acancel := context.WithTimeout(context.Background(), time.Second)
+		_ = adminSrv.Shutdown(actx)
+		acancel()
+	} else {
+		logger.Info().Dur("pre_stop_delay", cfg.Server.PreStopDelay()).Msg("not ready, draining")
+		drain.PreStop(forceCtx, cfg.Server.PreStopDelay(), checker.SetDraining)
+	}
 
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("graceful shutdown failed: %v", err)
+	logger.Info().Dur("deadline", cfg.Server.DrainTimeout()).Msg("stopping accepting, waiting for in-flight requests")
+	st := drain.Shutdown(forceCtx, srv, cfg.Server.DrainTimeout(), cancelBase)
+	logger.Info().
+		Int64("in_flight", st.InFlight).
+		Int64("completed", st.Completed).
+		Int64("aborted", st.Aborted).
+		Bool("forced", st.Forced).
+		Msg("drain finished")
+
+	actx, acancel := context.WithTimeout(context.Background(), time.Second)
+	defer acancel()
+	if err := adminSrv.Shutdown(actx); err != nil {
+		log.Printf("admin shutdown failed: %v", err)
 	}
 	log.Printf("bye")
 }
 
+// withProbes answers /livez and /readyz ahead of the gateway, outside the
+// drain accounting so probes keep working while it waits.
+func withProbes(next http.Handler, c *health.Checker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/livez":
+			c.Livez(w, r)
+		case "/readyz":
+			c.Readyz(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// adminListener listens on the admin unix socket if configured, else on
+// the admin TCP address.
+func adminListener(ls *upgrade.Listeners, c config.Admin) (net.Listener, error) {
+	if c.Socket == "" {
+		return ls.Listen("admin", "tcp", c.Addr)
+	}
+	ln, err := ls.Listen("admin", "unix", c.Socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(c.Socket, 0o660); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// policyFrom converts a config policy validated by config.Load, defaulting
+// burst to the per-minute rate.
+func policyFrom(p config.RateLimitPolicy) ratelimit.Policy {
+	alg, _ := ratelimit.ParseAlgorithm(p.Algorithm)
+	burst := p.Burst
+	if burst <= 0 {
+		burst = p.RPM()
+	}
+	return ratelimit.Policy{RPM: p.RPM(), Burst: burst, Algorithm: alg, Shadow: p.Mode == "shadow"}
+}
+
 // debug helper
 func toJSONSlice(xs []string) string {
 	if len(xs) == 0 {
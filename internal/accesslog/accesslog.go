@@ -0,0 +1,330 @@
+// Package accesslog writes one line per request to a dedicated sink,
+// separate from the application log.
+package accesslog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/auth"
+	"github.com/AlexKimmel/GateLite/internal/capture"
+	"github.com/AlexKimmel/GateLite/internal/proxy"
+	"github.com/AlexKimmel/GateLite/internal/reqid"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+// Record collects what the layers below the access log learn about a
+// request. It travels in the request context; see Annotate and
+// ObserveUpstream.
+type Record struct {
+	RouteID string
+	KeyID   string
+
+	Upstream        string // upstream host; empty if the request never left the gateway
+	UpstreamStatus  int
+	UpstreamLatency time.Duration
+}
+
+type ctxKey struct{}
+
+// From returns the request's access record, or nil outside Middleware.
+func From(ctx context.Context) *Record {
+	rec, _ := ctx.Value(ctxKey{}).(*Record)
+	return rec
+}
+
+// Annotate copies the matched route and API key, when present, into the
+// access record. Place it after the layers that set them.
+func Annotate() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rec := From(r.Context()); rec != nil {
+				if rt, ok := routing.RouteFrom(r); ok && rt != nil {
+					rec.RouteID = rt.ID
+				}
+				if id, ok := auth.KeyIDFrom(r.Context()); ok {
+					rec.KeyID = id
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ObserveUpstream is a proxy.Observer recording the upstream exchange.
+func ObserveUpstream(r *http.Request, rt *routing.Route, res proxy.Result) {
+	if rec := From(r.Context()); rec != nil {
+		rec.Upstream = rt.UpUrl.Host
+		rec.UpstreamStatus = res.Status
+		rec.UpstreamLatency = res.Latency
+	}
+}
+
+// SampleRule logs a fraction of the requests it matches. Status is an
+// exact code ("404") or a class ("5xx"); Route is a route ID. Empty fields
+// match everything.
+type SampleRule struct {
+	Status string
+	Route  string
+	Rate   float64 // 0..1
+}
+
+func (s SampleRule) match(status int, route string) bool {
+	if s.Route != "" && s.Route != route {
+		return false
+	}
+	switch {
+	case s.Status == "":
+		return true
+	case len(s.Status) == 3 && strings.HasSuffix(s.Status, "xx"):
+		return s.Status[0] == byte('0'+status/100)
+	default:
+		return s.Status == fmt.Sprint(status)
+	}
+}
+
+type Options struct {
+	Format string   // "json" (default), "logfmt" or "combined"
+	Fields []string // json/logfmt fields; empty selects DefaultFields
+
+	// Output is "stdout" (default), "stderr" or a file path. Files rotate
+	// once they exceed MaxSizeMB and/or when Rotate ("hourly", "daily")
+	// rolls over; MaxBackups rotated files are kept (0 keeps all).
+	Output     string
+	MaxSizeMB  int
+	Rotate     string
+	MaxBackups int
+
+	// Rules are tried in order, the first match decides; requests no rule
+	// matches are always logged.
+	Sample []SampleRule
+
+	// X-Forwarded-For is honoured for client_ip only when the peer is in
+	// one of these CIDRs.
+	TrustedProxies []string
+
+	// RedactQuery are query parameter names whose values are logged as
+	// capture.Redacted; default capture.DefaultRedactQuery.
+	RedactQuery []string
+}
+
+// DefaultFields is the field selection when Options.Fields is empty.
+var DefaultFields = []string{
+	"time", "request_id", "client_ip", "method", "path", "status", "duration_ms",
+	"bytes_in", "bytes_out", "route", "key", "upstream", "upstream_ms",
+}
+
+type Logger struct {
+	format  string
+	fields  []string
+	sample  []SampleRule
+	trusted []*net.IPNet
+	query   capture.QueryRedactor
+
+	out    io.Writer
+	closer io.Closer
+}
+
+func New(o Options) (*Logger, error) {
+	l := &Logger{format: o.Format, fields: o.Fields, sample: o.Sample}
+	if len(o.RedactQuery) == 0 {
+		o.RedactQuery = capture.DefaultRedactQuery
+	}
+	l.query = capture.NewQueryRedactor(o.RedactQuery)
+	switch l.format {
+	case "":
+		l.format = "json"
+	case "json", "logfmt", "combined":
+	default:
+		return nil, fmt.Errorf("unknown format %q", o.Format)
+	}
+	if len(l.fields) == 0 {
+		l.fields = DefaultFields
+	}
+	for _, f := range l.fields {
+		if _, ok := fields[f]; !ok {
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+	}
+	for _, s := range l.sample {
+		if s.Rate < 0 || s.Rate > 1 {
+			return nil, fmt.Errorf("sample rate %v out of range 0..1", s.Rate)
+		}
+	}
+	for _, c := range o.TrustedProxies {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy: %w", err)
+		}
+		l.trusted = append(l.trusted, n)
+	}
+
+	switch o.Output {
+	case "", "stdout":
+		l.out = &lockedWriter{w: os.Stdout}
+	case "stderr":
+		l.out = &lockedWriter{w: os.Stderr}
+	default:
+		f, err := openRotating(o.Output, o.MaxSizeMB, o.Rotate, o.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.out, l.closer = f, f
+	}
+	return l, nil
+}
+
+// Close closes the output file, if any.
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// Middleware logs every request that passes the sampling rules. It needs
+// the request ID, so it runs after reqid.Middleware.
+func (l *Logger) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &Record{}
+			e := &entry{r: r, rec: rec, start: time.Now()}
+			rw := &responseWriter{ResponseWriter: w}
+			if r.Body != nil {
+				body := &countingBody{ReadCloser: r.Body}
+				r.Body = body
+				e.in = body
+			}
+
+			next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), ctxKey{}, rec)))
+
+			e.status = rw.status
+			if e.status == 0 {
+				e.status = http.StatusOK
+			}
+			e.out = rw.bytes
+			e.dur = time.Since(e.start)
+			e.clientIP = l.clientIP(r)
+			e.reqID, _ = reqid.From(r.Context())
+			e.query = l.query.Redact(r.URL.RawQuery)
+
+			if !l.sampled(e.status, rec.RouteID) {
+				return
+			}
+			_, _ = l.out.Write(l.line(e))
+		})
+	}
+}
+
+func (l *Logger) sampled(status int, route string) bool {
+	for _, s := range l.sample {
+		if s.match(status, route) {
+			return s.Rate >= 1 || rand.Float64() < s.Rate
+		}
+	}
+	return true
+}
+
+// clientIP is the peer address, or with a trusted peer the right-most
+// X-Forwarded-For hop that is not itself a trusted proxy.
+func (l *Logger) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !l.isTrusted(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !l.isTrusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (l *Logger) isTrusted(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// entry is one finished request.
+type entry struct {
+	r        *http.Request
+	rec      *Record
+	start    time.Time
+	dur      time.Duration
+	status   int
+	in       *countingBody
+	out      int64
+	clientIP string
+	reqID    string
+	query    string // redacted raw query
+}
+
+func (e *entry) bytesIn() int64 {
+	if e.in == nil {
+		return 0
+	}
+	return e.in.n.Load()
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush/Hijack on the original.
+func (w *responseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// countingBody counts bytes_in. Reads come from the proxy transport's
+// goroutine and may race the log line being written.
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,233 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AlexKimmel/GateLite/internal/auth"
+	"github.com/AlexKimmel/GateLite/internal/reqid"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+// newLogger returns a logger writing to the returned buffer.
+func newLogger(t *testing.T, o Options) (*Logger, *bytes.Buffer) {
+	t.Helper()
+	l, err := New(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	l.out = &buf
+	return l, &buf
+}
+
+// handler serves requests behind the request ID and access log layers,
+// on route with API key k1, answering code with "hello".
+func handler(l *Logger, route string, code int) http.Handler {
+	h := Annotate()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = routing.WithRoute(r, &routing.Route{ID: route})
+		h.ServeHTTP(w, r.WithContext(auth.WithKeyID(r.Context(), "k1")))
+	})
+	return reqid.Middleware("")(l.Middleware()(inner))
+}
+
+func get(h http.Handler, target string) {
+	r := httptest.NewRequest("GET", target, nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set(reqid.DefaultHeader, "req-1")
+	r.Header.Set("User-Agent", "curl/8")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestFormats(t *testing.T) {
+	fields := []string{"request_id", "client_ip", "method", "path", "query", "status", "bytes_out", "route", "key", "upstream"}
+	for _, tc := range []struct {
+		format string
+		check  func(t *testing.T, line string)
+	}{
+		{"json", func(t *testing.T, line string) {
+			var got map[string]any
+			if err := json.Unmarshal([]byte(line), &got); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]any{
+				"request_id": "req-1", "client_ip": "192.0.2.1", "method": "GET", "path": "/v1/items",
+				"query": "api_key=%5BREDACTED%5D&page=2", "status": 201.0, "bytes_out": 5.0,
+				"route": "echo", "key": "k1",
+			}
+			if len(got) != len(want) {
+				t.Fatalf("fields %v, want %v", got, want)
+			}
+			for k, v := range want {
+				if got[k] != v {
+					t.Fatalf("%s = %v, want %v", k, got[k], v)
+				}
+			}
+		}},
+		{"logfmt", func(t *testing.T, line string) {
+			want := `request_id=req-1 client_ip=192.0.2.1 method=GET path=/v1/items query="api_key=%5BREDACTED%5D&page=2" status=201 bytes_out=5 route=echo key=k1` + "\n"
+			if line != want {
+				t.Fatalf("got  %q\nwant %q", line, want)
+			}
+		}},
+		{"combined", func(t *testing.T, line string) {
+			prefix, rest, ok := strings.Cut(line, "] ")
+			if !ok || !strings.HasPrefix(prefix, "192.0.2.1 - k1 [") {
+				t.Fatalf("line %q, want client, key and time first", line)
+			}
+			want := `"GET /v1/items?api_key=%5BREDACTED%5D&page=2 HTTP/1.1" 201 5 "-" "curl/8"` + "\n"
+			if rest != want {
+				t.Fatalf("got  %q\nwant %q", rest, want)
+			}
+		}},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			l, buf := newLogger(t, Options{Format: tc.format, Fields: fields})
+			get(handler(l, "echo", http.StatusCreated), "/v1/items?api_key=s3cret&page=2")
+			if strings.Contains(buf.String(), "s3cret") {
+				t.Fatalf("secret logged: %s", buf)
+			}
+			tc.check(t, buf.String())
+		})
+	}
+}
+
+func TestRedactQuery(t *testing.T) {
+	for _, tc := range []struct {
+		redact      []string
+		query, want string
+	}{
+		{nil, "API_KEY=a&Token=b&x=1", "API_KEY=%5BREDACTED%5D&Token=%5BREDACTED%5D&x=1"},
+		{nil, "api%5Fkey=a", "api_key=%5BREDACTED%5D"},
+		{nil, "password&x=1", "password=%5BREDACTED%5D&x=1"},
+		{nil, "x=1&y=2", "x=1&y=2"},
+		{nil, "", ""},
+		// a custom list replaces the default
+		{[]string{"page"}, "api_key=a&page=2", "api_key=a&page=%5BREDACTED%5D"},
+	} {
+		l, buf := newLogger(t, Options{Fields: []string{"query"}, RedactQuery: tc.redact})
+		target := "/x"
+		if tc.query != "" {
+			target += "?" + tc.query
+		}
+		get(handler(l, "echo", http.StatusOK), target)
+		want := "{}\n"
+		if tc.want != "" {
+			want = `{"query":"` + tc.want + `"}` + "\n"
+		}
+		if buf.String() != want {
+			t.Errorf("%v %q: logged %s, want %s", tc.redact, tc.query, buf, want)
+		}
+	}
+}
+
+func TestSampling(t *testing.T) {
+	l, buf := newLogger(t, Options{Fields: []string{"status", "route"}, Sample: []SampleRule{
+		{Status: "5xx", Rate: 1},
+		{Route: "health", Rate: 0},
+		{Status: "200", Rate: 0},
+	}})
+	for _, tc := range []struct {
+		route  string
+		status int
+		logged bool
+	}{
+		{"health", 503, true}, // the first matching rule decides
+		{"health", 404, false},
+		{"echo", 200, false},
+		{"echo", 201, true}, // no rule matches
+		{"echo", 404, true},
+	} {
+		buf.Reset()
+		get(handler(l, tc.route, tc.status), "/x")
+		if logged := buf.Len() > 0; logged != tc.logged {
+			t.Errorf("%s %d: logged %v, want %v", tc.route, tc.status, logged, tc.logged)
+		}
+	}
+
+	// a fractional rate logs about that share
+	l, buf = newLogger(t, Options{Fields: []string{"status"}, Sample: []SampleRule{{Status: "2xx", Rate: 0.25}}})
+	h := handler(l, "echo", http.StatusOK)
+	for range 2000 {
+		get(h, "/x")
+	}
+	if n := strings.Count(buf.String(), "\n"); n < 400 || n > 600 {
+		t.Fatalf("logged %d of 2000 at rate 0.25", n)
+	}
+}
+
+func TestSampleRuleMatch(t *testing.T) {
+	for _, tc := range []struct {
+		rule   SampleRule
+		status int
+		route  string
+		want   bool
+	}{
+		{SampleRule{}, 200, "echo", true},
+		{SampleRule{Status: "404"}, 404, "echo", true},
+		{SampleRule{Status: "404"}, 403, "echo", false},
+		{SampleRule{Status: "4xx"}, 499, "echo", true},
+		{SampleRule{Status: "4xx"}, 500, "echo", false},
+		{SampleRule{Route: "echo"}, 500, "echo", true},
+		{SampleRule{Route: "echo"}, 500, "other", false},
+		{SampleRule{Status: "5xx", Route: "echo"}, 502, "other", false},
+	} {
+		if got := tc.rule.match(tc.status, tc.route); got != tc.want {
+			t.Errorf("%+v.match(%d, %q) = %v, want %v", tc.rule, tc.status, tc.route, got, tc.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	l, _ := newLogger(t, Options{TrustedProxies: []string{"10.0.0.0/8", "2001:db8::/32"}})
+	for _, tc := range []struct {
+		peer string
+		xff  []string
+		want string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		// an untrusted peer cannot claim another address
+		{"192.0.2.1:1234", []string{"203.0.113.7"}, "192.0.2.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		// the right-most hop that is not a trusted proxy, not the spoofable first
+		{"10.0.0.1:1234", []string{"6.6.6.6, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"10.0.0.1:1234", []string{"6.6.6.6", "203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:1234", []string{" , "}, "10.0.0.1"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"[2001:db8::1]:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"[2001:db9::1]:1234", []string{"203.0.113.7"}, "2001:db9::1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.peer
+		for _, v := range tc.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := l.clientIP(r); got != tc.want {
+			t.Errorf("%s %q: client %q, want %q", tc.peer, tc.xff, got, tc.want)
+		}
+	}
+}
+
+func TestNewValidation(t *testing.T) {
+	for _, o := range []Options{
+		{Format: "xml"},
+		{Fields: []string{"status", "nope"}},
+		{Sample: []SampleRule{{Rate: 1.5}}},
+		{Sample: []SampleRule{{Rate: -0.1}}},
+		{TrustedProxies: []string{"10.0.0.1"}},
+		{Output: t.TempDir() + "/access.log", Rotate: "weekly"},
+	} {
+		if _, err := New(o); err == nil {
+			t.Errorf("New(%+v) succeeded", o)
+		}
+	}
+}
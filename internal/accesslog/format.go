@@ -0,0 +1,156 @@
+package accesslog
+
+import (
+	"bytes"
+	"crypto/tls"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// value is a field's rendering: a string, or a number when num is set.
+type value struct {
+	s   string
+	n   float64
+	num bool
+}
+
+func str(s string) value       { return value{s: s} }
+func num(n float64) value      { return value{n: n, num: true} }
+func ms(d time.Duration) value { return num(float64(d.Microseconds()) / 1000) }
+
+// fields maps field names to their value for an entry. An empty string
+// value means "not available" and is left out.
+var fields = map[string]func(e *entry) value{
+	"time":        func(e *entry) value { return str(e.start.Format(time.RFC3339Nano)) },
+	"request_id":  func(e *entry) value { return str(e.reqID) },
+	"client_ip":   func(e *entry) value { return str(e.clientIP) },
+	"remote_addr": func(e *entry) value { return str(e.r.RemoteAddr) },
+	"method":      func(e *entry) value { return str(e.r.Method) },
+	"host":        func(e *entry) value { return str(e.r.Host) },
+	"path":        func(e *entry) value { return str(e.r.URL.Path) },
+	"query":       func(e *entry) value { return str(e.query) },
+	"proto":       func(e *entry) value { return str(e.r.Proto) },
+	"status":      func(e *entry) value { return num(float64(e.status)) },
+	"duration_ms": func(e *entry) value { return ms(e.dur) },
+	"bytes_in":    func(e *entry) value { return num(float64(e.bytesIn())) },
+	"bytes_out":   func(e *entry) value { return num(float64(e.out)) },
+	"route":       func(e *entry) value { return str(e.rec.RouteID) },
+	"key":         func(e *entry) value { return str(e.rec.KeyID) },
+	"upstream":    func(e *entry) value { return str(e.rec.Upstream) },
+	"upstream_status": func(e *entry) value {
+		if e.rec.UpstreamStatus == 0 {
+			return str("")
+		}
+		return num(float64(e.rec.UpstreamStatus))
+	},
+	"upstream_ms": func(e *entry) value {
+		if e.rec.Upstream == "" {
+			return str("")
+		}
+		return ms(e.rec.UpstreamLatency)
+	},
+	"user_agent": func(e *entry) value { return str(e.r.UserAgent()) },
+	"referer":    func(e *entry) value { return str(e.r.Referer()) },
+	"tls_version": func(e *entry) value {
+		if e.r.TLS == nil {
+			return str("")
+		}
+		return str(tls.VersionName(e.r.TLS.Version))
+	},
+	"tls_cipher": func(e *entry) value {
+		if e.r.TLS == nil {
+			return str("")
+		}
+		return str(tls.CipherSuiteName(e.r.TLS.CipherSuite))
+	},
+	"tls_server_name": func(e *entry) value {
+		if e.r.TLS == nil {
+			return str("")
+		}
+		return str(e.r.TLS.ServerName)
+	},
+}
+
+func (l *Logger) line(e *entry) []byte {
+	switch l.format {
+	case "logfmt":
+		return l.logfmt(e)
+	case "combined":
+		return combined(e)
+	}
+	return l.json(e)
+}
+
+func (l *Logger) json(e *entry) []byte {
+	var buf bytes.Buffer
+	zl := zerolog.New(&buf)
+	ev := zl.Log()
+	for _, f := range l.fields {
+		v := fields[f](e)
+		switch {
+		case v.num:
+			ev.Float64(f, v.n)
+		case v.s != "":
+			ev.Str(f, v.s)
+		}
+	}
+	ev.Send()
+	return buf.Bytes()
+}
+
+func (l *Logger) logfmt(e *entry) []byte {
+	var b []byte
+	for _, f := range l.fields {
+		v := fields[f](e)
+		if !v.num && v.s == "" {
+			continue
+		}
+		if len(b) > 0 {
+			b = append(b, ' ')
+		}
+		b = append(b, f...)
+		b = append(b, '=')
+		if v.num {
+			b = strconv.AppendFloat(b, v.n, 'f', -1, 64)
+		} else if strings.ContainsAny(v.s, " \"=\\") || !strconv.CanBackquote(v.s) {
+			b = strconv.AppendQuote(b, v.s)
+		} else {
+			b = append(b, v.s...)
+		}
+	}
+	return append(b, '\n')
+}
+
+// combined renders the Apache Combined Log Format, with the API key ID in
+// the user field. The field selection does not apply.
+func combined(e *entry) []byte {
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	size := "-"
+	if e.out > 0 {
+		size = strconv.FormatInt(e.out, 10)
+	}
+	var b strings.Builder
+	b.WriteString(dash(e.clientIP))
+	b.WriteString(" - ")
+	b.WriteString(dash(e.rec.KeyID))
+	b.WriteString(" [")
+	b.WriteString(e.start.Format("02/Jan/2006:15:04:05 -0700"))
+	b.WriteString("] ")
+	u := *e.r.URL
+	u.RawQuery = e.query
+	b.WriteString(strconv.Quote(e.r.Method + " " + u.RequestURI() + " " + e.r.Proto))
+	b.WriteString(" " + strconv.Itoa(e.status) + " " + size + " ")
+	b.WriteString(strconv.Quote(dash(e.r.Referer())))
+	b.WriteString(" ")
+	b.WriteString(strconv.Quote(dash(e.r.UserAgent())))
+	b.WriteString("\n")
+	return []byte(b.String())
+}
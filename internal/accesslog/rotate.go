@@ -0,0 +1,148 @@
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// rotatingFile is an append-only file that is renamed to
+// "<path>.<timestamp>" when it grows past maxSize or its period ends.
+type rotatingFile struct {
+	path    string
+	maxSize int64         // 0 disables size rotation
+	period  time.Duration // 0 disables time rotation
+	backups int           // 0 keeps all
+
+	mu     sync.Mutex
+	f      *os.File // nil after a failed reopen; the next write retries
+	closed bool
+	size   int64
+	opened time.Time // start of the period the file belongs to
+}
+
+func openRotating(path string, maxSizeMB int, rotate string, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: int64(maxSizeMB) << 20, backups: backups}
+	switch rotate {
+	case "":
+	case "hourly":
+		r.period = time.Hour
+	case "daily":
+		r.period = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("unknown rotation %q", rotate)
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f, r.size = f, st.Size()
+	// an existing file belongs to the period it was last written in
+	r.opened = time.Now()
+	if r.size > 0 {
+		r.opened = st.ModTime()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	now := time.Now()
+	full := r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize
+	expired := r.period > 0 && !now.Truncate(r.period).Equal(r.opened.Truncate(r.period))
+	var rotateErr error
+	if full || expired {
+		if rotateErr = r.rotate(now); r.f == nil {
+			return 0, rotateErr
+		}
+	}
+	// a failed rotation keeps appending to the current file and is retried
+	// on the next write
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate moves the file aside and opens a new one at path. If the rename
+// fails, path is reopened as is; r.f is nil only if reopening fails too.
+func (r *rotatingFile) rotate(now time.Time) error {
+	_ = r.f.Close()
+	r.f = nil
+	renameErr := os.Rename(r.path, r.path+"."+now.UTC().Format("20060102T150405.000"))
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	r.opened = now
+	r.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond the backup limit. The
+// timestamp suffix sorts chronologically.
+func (r *rotatingFile) prune() {
+	if r.backups <= 0 {
+		return
+	}
+	old, _ := filepath.Glob(r.path + ".*")
+	if len(old) <= r.backups {
+		return
+	}
+	sort.Strings(old)
+	for _, p := range old[:len(old)-r.backups] {
+		_ = os.Remove(p)
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
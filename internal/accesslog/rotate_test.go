@@ -0,0 +1,139 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func rotated(t *testing.T, path string) []string {
+	t.Helper()
+	old, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(old)
+	return old
+}
+
+func read(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func write(t *testing.T, r *rotatingFile, line string) {
+	t.Helper()
+	if _, err := r.Write([]byte(line)); err != nil {
+		t.Fatal(err)
+	}
+	// rotated names have millisecond resolution
+	time.Sleep(2 * time.Millisecond)
+}
+
+func TestRotateSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotating(path, 0, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	r.maxSize = 10
+
+	write(t, r, "aaaaaaaa\n") // 9 bytes
+	write(t, r, "b\n")        // would make 11: rotates first
+	write(t, r, "c\n")
+	// a line larger than the limit still goes to a fresh file, whole
+	write(t, r, strings.Repeat("d", 20)+"\n")
+
+	old := rotated(t, path)
+	if len(old) != 2 {
+		t.Fatalf("rotated files %v, want 2", old)
+	}
+	if read(t, old[0]) != "aaaaaaaa\n" || read(t, old[1]) != "b\nc\n" {
+		t.Fatalf("rotated %q and %q", read(t, old[0]), read(t, old[1]))
+	}
+	if got := read(t, path); got != strings.Repeat("d", 20)+"\n" {
+		t.Fatalf("current file %q", got)
+	}
+}
+
+func TestRotatePeriod(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotating(path, 0, "hourly", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+
+	write(t, r, "now\n")
+	write(t, r, "same hour\n")
+	if old := rotated(t, path); len(old) != 0 {
+		t.Fatalf("rotated within the hour: %v", old)
+	}
+
+	r.opened = r.opened.Add(-time.Hour)
+	write(t, r, "next hour\n")
+	old := rotated(t, path)
+	if len(old) != 1 || read(t, old[0]) != "now\nsame hour\n" || read(t, path) != "next hour\n" {
+		t.Fatalf("rotated %v, current %q", old, read(t, path))
+	}
+}
+
+func TestRotateReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// an existing file belongs to the period it was last written in
+	if err := os.WriteFile(path, []byte("yesterday\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(path, yesterday, yesterday); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRotating(path, 0, "daily", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	write(t, r, "today\n")
+	if old := rotated(t, path); len(old) != 1 || read(t, old[0]) != "yesterday\n" {
+		t.Fatalf("rotated %v, want yesterday's file", old)
+	}
+}
+
+func TestRotatePrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotating(path, 0, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	r.maxSize = 2
+
+	for _, l := range []string{"1\n", "2\n", "3\n", "4\n", "5\n"} {
+		write(t, r, l)
+	}
+	old := rotated(t, path)
+	if len(old) != 2 || read(t, old[0]) != "3\n" || read(t, old[1]) != "4\n" || read(t, path) != "5\n" {
+		t.Fatalf("kept %v, want the newest 2 backups", old)
+	}
+}
+
+func TestRotateClosed(t *testing.T) {
+	r, err := openRotating(filepath.Join(t.TempDir(), "access.log"), 0, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte("x\n")); err != os.ErrClosed {
+		t.Fatalf("write after close: %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,99 @@
+package adaptive
+
+import (
+	"sync"
+	"time"
+)
+
+type Config struct {
+	MinLimit         int
+	MaxLimit         int
+	InitialLimit     int           // default 20, kept within [MinLimit, MaxLimit]
+	LatencyThreshold time.Duration // samples slower than this count as congestion
+	Backoff          float64       // multiplicative decrease, e.g. 0.9
+	OnChange         func(limit int)
+}
+
+// Limiter is an AIMD concurrency limit: it grows by about one slot per
+// limit's worth of fast responses while the limit is in use, and shrinks by
+// Backoff on slow or failed ones (at most once per LatencyThreshold, so one
+// burst of slow responses counts as a single congestion signal).
+type Limiter struct {
+	mu       sync.Mutex
+	cfg      Config
+	limit    float64
+	inFlight int
+	lastDrop time.Time
+}
+
+func New(cfg Config) *Limiter {
+	if cfg.MinLimit <= 0 {
+		cfg.MinLimit = 1
+	}
+	if cfg.MaxLimit < cfg.MinLimit {
+		cfg.MaxLimit = max(cfg.MinLimit, 1000)
+	}
+	// starting at MinLimit would shed most traffic until the limit has
+	// grown, which takes many round trips
+	if cfg.InitialLimit <= 0 {
+		cfg.InitialLimit = 20
+	}
+	cfg.InitialLimit = min(max(cfg.InitialLimit, cfg.MinLimit), cfg.MaxLimit)
+	if cfg.LatencyThreshold <= 0 {
+		cfg.LatencyThreshold = time.Second
+	}
+	if cfg.Backoff <= 0 || cfg.Backoff >= 1 {
+		cfg.Backoff = 0.9
+	}
+	l := &Limiter{cfg: cfg, limit: float64(cfg.InitialLimit)}
+	if cfg.OnChange != nil {
+		cfg.OnChange(cfg.InitialLimit)
+	}
+	return l
+}
+
+// Limit returns the current allowed in-flight count.
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// TryAcquire takes a slot if the current limit allows it.
+func (l *Limiter) TryAcquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight >= int(l.limit) {
+		return false
+	}
+	l.inFlight++
+	return true
+}
+
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	l.inFlight--
+	l.mu.Unlock()
+}
+
+// Observe feeds one upstream sample into the limit.
+func (l *Limiter) Observe(latency time.Duration, failed bool, now time.Time) {
+	l.mu.Lock()
+	before := int(l.limit)
+	switch {
+	case failed || latency > l.cfg.LatencyThreshold:
+		if now.Sub(l.lastDrop) >= l.cfg.LatencyThreshold {
+			l.limit = max(l.limit*l.cfg.Backoff, float64(l.cfg.MinLimit))
+			l.lastDrop = now
+		}
+	case float64(l.inFlight) >= l.limit/2:
+		// only grow while the limit is actually being used
+		l.limit = min(l.limit+1/l.limit, float64(l.cfg.MaxLimit))
+	}
+	after := int(l.limit)
+	l.mu.Unlock()
+
+	if after != before && l.cfg.OnChange != nil {
+		l.cfg.OnChange(after)
+	}
+}
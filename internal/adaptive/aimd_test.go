@@ -0,0 +1,135 @@
+package adaptive
+
+import (
+	"testing"
+	"time"
+)
+
+// hold takes n slots, failing the test if the limit refuses one.
+func hold(t *testing.T, l *Limiter, n int) {
+	t.Helper()
+	for i := range n {
+		if !l.TryAcquire() {
+			t.Fatalf("slot %d of %d refused at limit %d", i+1, n, l.Limit())
+		}
+	}
+}
+
+func TestInitialLimit(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  Config
+		want int
+	}{
+		{Config{}, 20},
+		{Config{InitialLimit: 5}, 5},
+		{Config{MinLimit: 30, MaxLimit: 100}, 30},
+		{Config{MinLimit: 1, MaxLimit: 10}, 10},
+		{Config{MinLimit: 1, MaxLimit: 100, InitialLimit: 500}, 100},
+	} {
+		var reported int
+		tc.cfg.OnChange = func(n int) { reported = n }
+		if got := New(tc.cfg).Limit(); got != tc.want || reported != tc.want {
+			t.Errorf("%+v: limit %d (reported %d), want %d", tc.cfg, got, reported, tc.want)
+		}
+	}
+}
+
+func TestTryAcquire(t *testing.T) {
+	l := New(Config{InitialLimit: 2})
+	hold(t, l, 2)
+	if l.TryAcquire() {
+		t.Fatal("acquired past the limit")
+	}
+	l.Release()
+	if !l.TryAcquire() {
+		t.Fatal("slot not freed by Release")
+	}
+}
+
+func TestAdditiveIncrease(t *testing.T) {
+	var changes []int
+	l := New(Config{InitialLimit: 10, MaxLimit: 12, OnChange: func(n int) { changes = append(changes, n) }})
+	now := time.Now()
+
+	// an idle limit does not grow
+	for range 100 {
+		l.Observe(time.Millisecond, false, now)
+	}
+	if n := l.Limit(); n != 10 {
+		t.Fatalf("idle limit grew to %d", n)
+	}
+
+	// in use, it grows by about one per limit's worth of fast samples (each
+	// adds 1/limit, and the limit grows as they come in)
+	hold(t, l, 6)
+	for range 9 {
+		l.Observe(time.Millisecond, false, now)
+	}
+	if n := l.Limit(); n != 10 {
+		t.Fatalf("limit %d after 9 fast samples at 10, want 10", n)
+	}
+	for range 2 {
+		l.Observe(time.Millisecond, false, now)
+	}
+	if n := l.Limit(); n != 11 {
+		t.Fatalf("limit %d after 11 fast samples at 10, want 11", n)
+	}
+	for range 100 {
+		l.Observe(time.Millisecond, false, now)
+	}
+	if n := l.Limit(); n != 12 {
+		t.Fatalf("limit %d, want it capped at MaxLimit 12", n)
+	}
+	if len(changes) != 3 || changes[1] != 11 || changes[2] != 12 {
+		t.Fatalf("OnChange calls %v, want [10 11 12]", changes)
+	}
+}
+
+func TestMultiplicativeDecrease(t *testing.T) {
+	for name, sample := range map[string]struct {
+		latency time.Duration
+		failed  bool
+	}{
+		"latency": {2 * time.Second, false},
+		"error":   {time.Millisecond, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l := New(Config{InitialLimit: 100, MinLimit: 10, LatencyThreshold: time.Second, Backoff: 0.5})
+			now := time.Now()
+
+			l.Observe(sample.latency, sample.failed, now)
+			if n := l.Limit(); n != 50 {
+				t.Fatalf("limit %d after one congestion signal, want 50", n)
+			}
+			// a burst within the threshold counts once
+			for range 10 {
+				l.Observe(sample.latency, sample.failed, now.Add(500*time.Millisecond))
+			}
+			if n := l.Limit(); n != 50 {
+				t.Fatalf("limit %d after a burst, want 50", n)
+			}
+			for i := range 10 {
+				l.Observe(sample.latency, sample.failed, now.Add(time.Duration(i+1)*time.Second))
+			}
+			if n := l.Limit(); n != 10 {
+				t.Fatalf("limit %d, want it floored at MinLimit 10", n)
+			}
+		})
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	l := New(Config{InitialLimit: 10, LatencyThreshold: time.Second, Backoff: 0.5})
+	now := time.Now()
+	l.Observe(0, true, now)
+	if n := l.Limit(); n != 5 {
+		t.Fatalf("limit %d, want 5", n)
+	}
+	hold(t, l, 5)
+	for range 6 {
+		l.Observe(time.Millisecond, false, now)
+	}
+	if n := l.Limit(); n != 6 {
+		t.Fatalf("limit %d after 6 fast samples at 5, want 6", n)
+	}
+}
@@ -0,0 +1,522 @@
+package admin
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/audit"
+	"github.com/AlexKimmel/GateLite/internal/capture"
+	"github.com/AlexKimmel/GateLite/internal/gateway"
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+type Options struct {
+	Limiter  ratelimit.Limiter
+	Policies gateway.Policies
+	Routes   []*routing.Route
+	Metadata func(keyID string) map[string]string // key metadata, for plans
+	Capture  *capture.Capture
+	Audit    *audit.Log // changes are recorded here when set
+}
+
+// Handler serves the admin API under /admin/:
+//
+//	GET    /admin/ratelimit/buckets?match=<glob>   list limiter keys
+//	DELETE /admin/ratelimit/buckets/{bucket}       reset one limiter key
+//	GET    /admin/ratelimit/keys/{id}?route=<id>   a key's buckets per route
+//	DELETE /admin/ratelimit/keys/{id}?route=<id>   reset a key's buckets
+//	POST   /admin/ratelimit/keys/{id}/bonus        grant a temporary bonus
+//	GET    /admin/capture                          list active debug captures
+//	POST   /admin/capture                          start capturing a route and/or key
+//	DELETE /admin/capture?route=<id>&key=<id>      stop a capture
+//	GET    /admin/audit?action=&source=&actor=&target=&since=&until=&limit=
+//	                                               query the audit trail
+//
+// Every change is appended to the audit trail before the response is sent.
+// Key endpoints cover limits keyed by the API key only; use the bucket
+// endpoints for limits keyed by IP, headers and the like.
+func Handler(o Options) http.Handler {
+	a := &api{Options: o}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/ratelimit/buckets", a.listBuckets)
+	mux.HandleFunc("DELETE /admin/ratelimit/buckets/{bucket...}", a.resetBucket)
+	mux.HandleFunc("GET /admin/ratelimit/keys/{id}", a.inspectKey)
+	mux.HandleFunc("DELETE /admin/ratelimit/keys/{id}", a.resetKey)
+	mux.HandleFunc("POST /admin/ratelimit/keys/{id}/bonus", a.grantBonus)
+	if o.Capture != nil {
+		mux.HandleFunc("GET /admin/capture", a.listCaptures)
+		mux.HandleFunc("POST /admin/capture", a.startCapture)
+		mux.HandleFunc("DELETE /admin/capture", a.stopCapture)
+	}
+	if o.Audit != nil {
+		mux.HandleFunc("GET /admin/audit", a.queryAudit)
+	}
+	return mux
+}
+
+type api struct {
+	Options
+}
+
+type ctxKey struct{}
+
+// RequireToken rejects requests without "Authorization: Bearer <token>",
+// except for the public paths, e.g. health probes. Accepted requests carry
+// the token's principal for the audit trail.
+func RequireToken(token string, next http.Handler, public ...string) http.Handler {
+	want := []byte("Bearer " + token)
+	who := principal(token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(public, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Provide the admin token as a bearer token")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, who)))
+	})
+}
+
+func (a *api) listBuckets(w http.ResponseWriter, r *http.Request) {
+	match := r.URL.Query().Get("match")
+	if match == "" {
+		match = "*"
+	}
+	keys, err := a.Limiter.Keys(r.Context(), match)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "rate_limiter_error", err.Error())
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"buckets": keys})
+}
+
+func (a *api) resetBucket(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("bucket")
+	before, ok := a.auditBucket(w, r, key)
+	if !ok {
+		return
+	}
+	if err := a.Limiter.Reset(r.Context(), key); err != nil {
+		writeError(w, http.StatusInternalServerError, "rate_limiter_error", err.Error())
+		return
+	}
+	after, ok := a.auditBucket(w, r, key)
+	if !ok || !a.record(w, r, "ratelimit.bucket.reset", key, before, after) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"reset": []string{key}})
+}
+
+type bucketState struct {
+	Name         string `json:"name"`
+	Bucket       string `json:"bucket"`
+	Algorithm    string `json:"algorithm"`
+	Shadow       bool   `json:"shadow,omitempty"`
+	Limit        int    `json:"limit"`
+	Burst        int    `json:"burst"`
+	Remaining    int    `json:"remaining"`
+	Bonus        int    `json:"bonus"`
+	ResetUnixSec int64  `json:"reset"`
+	RetryAfterMS int64  `json:"retry_after_ms,omitempty"`
+}
+
+type routeState struct {
+	Route   string        `json:"route"`
+	Buckets []bucketState `json:"buckets"`
+}
+
+func (a *api) inspectKey(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	routes, ok := a.routesFor(w, r)
+	if !ok {
+		return
+	}
+
+	out, err := a.keyState(r.Context(), id, routes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "rate_limiter_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"key_id": id, "plan": a.plan(id), "routes": out})
+}
+
+// keyState inspects the key's buckets on routes.
+func (a *api) keyState(ctx context.Context, id string, routes []*routing.Route) ([]routeState, error) {
+	now := time.Now()
+	out := make([]routeState, 0, len(routes))
+	for _, rt := range routes {
+		rs := routeState{Route: rt.ID, Buckets: []bucketState{}}
+		for _, b := range a.Policies.Buckets(rt, id, a.plan(id)) {
+			st, err := a.bucketState(ctx, b, now)
+			if err != nil {
+				return nil, err
+			}
+			rs.Buckets = append(rs.Buckets, st)
+		}
+		out = append(out, rs)
+	}
+	return out, nil
+}
+
+func (a *api) bucketState(ctx context.Context, b gateway.Bucket, now time.Time) (bucketState, error) {
+	d, err := a.Limiter.Inspect(ctx, b.Key, b.Policy, now)
+	if err != nil {
+		return bucketState{}, err
+	}
+	alg := b.Policy.Algorithm
+	if alg == "" {
+		alg = ratelimit.TokenBucket
+	}
+	return bucketState{
+		Name:         b.Name,
+		Bucket:       b.Key,
+		Algorithm:    string(alg),
+		Shadow:       b.Policy.Shadow,
+		Limit:        d.Limit,
+		Burst:        b.Policy.Burst,
+		Remaining:    d.Remaining,
+		Bonus:        d.Bonus,
+		ResetUnixSec: d.ResetUnixSec,
+		RetryAfterMS: d.RetryAfter.Milliseconds(),
+	}, nil
+}
+
+func (a *api) resetKey(w http.ResponseWriter, r *http.Request) {
+	keys, ok := a.bucketsFor(w, r)
+	if !ok {
+		return
+	}
+	before, ok := a.auditState(w, r)
+	if !ok {
+		return
+	}
+	for _, k := range keys {
+		if err := a.Limiter.Reset(r.Context(), k); err != nil {
+			writeError(w, http.StatusInternalServerError, "rate_limiter_error", err.Error())
+			return
+		}
+	}
+	after, ok := a.auditState(w, r)
+	if !ok || !a.record(w, r, "ratelimit.key.reset", r.PathValue("id"), before, after) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"reset": keys})
+}
+
+type bonusRequest struct {
+	Amount     int    `json:"amount"`
+	TTLSeconds int    `json:"ttl_seconds"`
+	Route      string `json:"route"` // empty grants on every route
+}
+
+func (a *api) grantBonus(w http.ResponseWriter, r *http.Request) {
+	var req bonusRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid JSON body")
+		return
+	}
+	if req.Amount <= 0 || req.TTLSeconds <= 0 {
+		writeError(w, http.StatusBadRequest, "bad_request", "amount and ttl_seconds must be positive")
+		return
+	}
+	if req.Route != "" {
+		q := r.URL.Query()
+		q.Set("route", req.Route)
+		r.URL.RawQuery = q.Encode()
+	}
+	keys, ok := a.bucketsFor(w, r)
+	if !ok {
+		return
+	}
+
+	before, ok := a.auditState(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	for _, k := range keys {
+		if err := a.Limiter.Grant(r.Context(), k, req.Amount, ttl, now); err != nil {
+			writeError(w, http.StatusInternalServerError, "rate_limiter_error", err.Error())
+			return
+		}
+	}
+	after, ok := a.auditState(w, r)
+	if !ok || !a.record(w, r, "ratelimit.key.bonus", r.PathValue("id"), before, after) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"granted":    keys,
+		"amount":     req.Amount,
+		"expires_at": now.Add(ttl).UTC().Format(time.RFC3339),
+	})
+}
+
+// maxCaptureTTL bounds how long a capture may run; it logs bodies.
+const maxCaptureTTL = time.Hour
+
+func (a *api) listCaptures(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"captures": a.Capture.Active(time.Now())})
+}
+
+type captureRequest struct {
+	capture.Target
+	TTLSeconds int `json:"ttl_seconds"` // default 300, at most an hour
+}
+
+func (a *api) startCapture(w http.ResponseWriter, r *http.Request) {
+	var req captureRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid JSON body")
+		return
+	}
+	if req.Route == "" && req.Key == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "route or key is required")
+		return
+	}
+	if req.Route != "" && !a.hasRoute(req.Route) {
+		writeError(w, http.StatusNotFound, "unknown_route", "no route with id "+req.Route)
+		return
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	switch {
+	case req.TTLSeconds < 0 || ttl > maxCaptureTTL:
+		writeError(w, http.StatusBadRequest, "bad_request", "ttl_seconds must be between 1 and 3600")
+		return
+	case ttl == 0:
+		ttl = 5 * time.Minute
+	}
+	before := a.captureFor(req.Target)
+	t := a.Capture.Enable(req.Target, ttl, time.Now())
+	if !a.record(w, r, "capture.start", captureTarget(req.Target), before, t) {
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+func (a *api) stopCapture(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	t := capture.Target{Route: q.Get("route"), Key: q.Get("key")}
+	before := a.captureFor(t)
+	if !a.Capture.Disable(t) {
+		writeError(w, http.StatusNotFound, "not_found", "no active capture for this route and key")
+		return
+	}
+	if !a.record(w, r, "capture.stop", captureTarget(t), before, nil) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"stopped": t})
+}
+
+// captureFor returns the active toggle for t, if any.
+func (a *api) captureFor(t capture.Target) any {
+	for _, c := range a.Capture.Active(time.Now()) {
+		if c.Target == t {
+			return c
+		}
+	}
+	return nil
+}
+
+// captureTarget renders t for the audit trail, e.g. "route=echo key=demo".
+func captureTarget(t capture.Target) string {
+	var parts []string
+	if t.Route != "" {
+		parts = append(parts, "route="+t.Route)
+	}
+	if t.Key != "" {
+		parts = append(parts, "key="+t.Key)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (a *api) queryAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := audit.Filter{
+		Source: audit.Source(q.Get("source")),
+		Actor:  q.Get("actor"),
+		Action: q.Get("action"),
+		Target: q.Get("target"),
+	}
+	for name, dst := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "bad_request", name+" must be an RFC 3339 time")
+				return
+			}
+			*dst = t
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "bad_request", "limit must be a positive integer")
+			return
+		}
+		f.Limit = n
+	}
+	entries, err := a.Audit.Query(f)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "audit_error", err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []audit.Entry{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries})
+}
+
+// auditState snapshots the path key's buckets for the audit trail; nil
+// without an audit log.
+func (a *api) auditState(w http.ResponseWriter, r *http.Request) (any, bool) {
+	if a.Audit == nil {
+		return nil, true
+	}
+	routes, ok := a.routesFor(w, r)
+	if !ok {
+		return nil, false
+	}
+	st, err := a.keyState(r.Context(), r.PathValue("id"), routes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "rate_limiter_error", err.Error())
+		return nil, false
+	}
+	return st, true
+}
+
+// auditBucket returns a raw limiter key's state for the audit trail, or
+// nil when no configured limit builds such a key.
+func (a *api) auditBucket(w http.ResponseWriter, r *http.Request, key string) (any, bool) {
+	if a.Audit == nil {
+		return nil, true
+	}
+	b, ok := a.Policies.Bucket(a.Routes, key, a.plan)
+	if !ok {
+		return nil, true
+	}
+	st, err := a.bucketState(r.Context(), b, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "rate_limiter_error", err.Error())
+		return nil, false
+	}
+	return st, true
+}
+
+// record appends a change to the audit trail. A change that cannot be
+// audited is reported as an error, even though it has been applied.
+func (a *api) record(w http.ResponseWriter, r *http.Request, action, target string, before, after any) bool {
+	if a.Audit == nil {
+		return true
+	}
+	err := a.Audit.Record(audit.Entry{
+		Source: audit.SourceAdmin,
+		Actor:  actor(r),
+		Action: action,
+		Target: target,
+		Before: before,
+		After:  after,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "audit_error", "change applied but not audited: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// principal names a token without revealing it: "token:" and the first
+// 8 hex digits of its SHA-256, enough to tell rotated tokens apart.
+func principal(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:4])
+}
+
+// actor identifies the admin client: the token's principal, when
+// RequireToken let the request in, and the peer address.
+func actor(r *http.Request) string {
+	addr := r.RemoteAddr
+	if addr == "" || addr == "@" {
+		addr = "unix"
+	}
+	if who, ok := r.Context().Value(ctxKey{}).(string); ok {
+		return who + " from " + addr
+	}
+	return addr
+}
+
+func (a *api) hasRoute(id string) bool {
+	for _, rt := range a.Routes {
+		if rt.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// routesFor returns the route named by ?route=, or every route.
+func (a *api) routesFor(w http.ResponseWriter, r *http.Request) ([]*routing.Route, bool) {
+	id := strings.TrimSpace(r.URL.Query().Get("route"))
+	if id == "" {
+		return a.Routes, true
+	}
+	for _, rt := range a.Routes {
+		if rt.ID == id {
+			return []*routing.Route{rt}, true
+		}
+	}
+	writeError(w, http.StatusNotFound, "unknown_route", "no route with id "+id)
+	return nil, false
+}
+
+// bucketsFor returns the distinct limiter keys of the key in the path on the
+// selected routes; global and group buckets are shared across routes.
+func (a *api) bucketsFor(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	id := r.PathValue("id")
+	routes, ok := a.routesFor(w, r)
+	if !ok {
+		return nil, false
+	}
+	seen := map[string]struct{}{}
+	keys := []string{}
+	for _, rt := range routes {
+		for _, b := range a.Policies.Buckets(rt, id, a.plan(id)) {
+			if _, dup := seen[b.Key]; !dup {
+				seen[b.Key] = struct{}{}
+				keys = append(keys, b.Key)
+			}
+		}
+	}
+	return keys, true
+}
+
+func (a *api) plan(keyID string) string {
+	if a.Metadata == nil {
+		return ""
+	}
+	return a.Metadata(keyID)["plan"]
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, errCode, msg string) {
+	writeJSON(w, code, map[string]any{"error": map[string]string{"code": errCode, "message": msg}})
+}
@@ -0,0 +1,384 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/audit"
+	"github.com/AlexKimmel/GateLite/internal/capture"
+	"github.com/AlexKimmel/GateLite/internal/gateway"
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+	"github.com/AlexKimmel/GateLite/internal/ratelimit/memory"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+var (
+	routePolicy  = ratelimit.Policy{RPM: 60, Burst: 5}
+	globalPolicy = ratelimit.Policy{RPM: 600, Burst: 10}
+)
+
+type fixture struct {
+	t     *testing.T
+	h     http.Handler
+	lim   *memory.Limiter
+	audit *audit.Log
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	lim := memory.New(memory.Options{JanitorInterval: -1})
+	t.Cleanup(func() { _ = lim.Close() })
+	log, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = log.Close() })
+
+	h := Handler(Options{
+		Limiter:  lim,
+		Policies: gateway.Policies{Default: routePolicy, Global: globalPolicy},
+		Routes: []*routing.Route{
+			{ID: "echo", LimitDefault: routePolicy},
+			{ID: "other"},
+		},
+		Capture: capture.New(capture.Options{Out: io.Discard}),
+		Audit:   log,
+	})
+	return &fixture{t: t, h: h, lim: lim, audit: log}
+}
+
+// do serves a request and decodes the JSON response into out, if set.
+func (f *fixture) do(method, target, body string, out any) *httptest.ResponseRecorder {
+	f.t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.1:4321"
+	rec := httptest.NewRecorder()
+	f.h.ServeHTTP(rec, r)
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			f.t.Fatalf("%s %s: %v in %s", method, target, err, rec.Body)
+		}
+	}
+	return rec
+}
+
+// expectError checks for an error response with code and errCode.
+func (f *fixture) expectError(method, target, body string, code int, errCode string) {
+	f.t.Helper()
+	var resp struct {
+		Error struct{ Code string } `json:"error"`
+	}
+	rec := f.do(method, target, body, &resp)
+	if rec.Code != code || resp.Error.Code != errCode {
+		f.t.Fatalf("%s %s: %d %s, want %d %s", method, target, rec.Code, resp.Error.Code, code, errCode)
+	}
+}
+
+func (f *fixture) drain(key string, p ratelimit.Policy) {
+	f.t.Helper()
+	for range ratelimit.Capacity(p) {
+		if _, err := f.lim.Allow(context.Background(), key, p, 1, time.Now()); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+}
+
+func (f *fixture) remaining(key string, p ratelimit.Policy) int {
+	f.t.Helper()
+	d, err := f.lim.Inspect(context.Background(), key, p, time.Now())
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return d.Remaining
+}
+
+// entries returns the audit trail, oldest first.
+func (f *fixture) entries() []audit.Entry {
+	f.t.Helper()
+	es, err := f.audit.Query(audit.Filter{})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	for i, j := 0, len(es)-1; i < j; i, j = i+1, j-1 {
+		es[i], es[j] = es[j], es[i]
+	}
+	return es
+}
+
+// lastEntry expects the newest audit entry to be action on target.
+func (f *fixture) lastEntry(action, target string) audit.Entry {
+	f.t.Helper()
+	es := f.entries()
+	if len(es) == 0 {
+		f.t.Fatalf("no audit entry, want %s", action)
+	}
+	e := es[len(es)-1]
+	if e.Action != action || e.Target != target || e.Source != audit.SourceAdmin || e.Actor == "" {
+		f.t.Fatalf("audit entry %+v, want %s on %s by an actor", e, action, target)
+	}
+	return e
+}
+
+func TestListBuckets(t *testing.T) {
+	f := newFixture(t)
+	var resp struct{ Buckets []string }
+	if rec := f.do("GET", "/admin/ratelimit/buckets", "", &resp); rec.Code != http.StatusOK || resp.Buckets == nil || len(resp.Buckets) != 0 {
+		t.Fatalf("empty limiter: %d %s, want 200 with []", rec.Code, rec.Body)
+	}
+
+	f.drain("echo:a", routePolicy)
+	f.drain("echo:b/c", routePolicy)
+	f.drain("global:a", globalPolicy)
+	f.do("GET", "/admin/ratelimit/buckets?match=echo:*", "", &resp)
+	if got := strings.Join(resp.Buckets, " "); got != "echo:a echo:b/c" {
+		t.Fatalf("buckets %q, want echo:a echo:b/c", got)
+	}
+}
+
+func TestInspectKey(t *testing.T) {
+	f := newFixture(t)
+	f.drain("echo:k", routePolicy)
+
+	var resp struct {
+		KeyID  string `json:"key_id"`
+		Routes []routeState
+	}
+	if rec := f.do("GET", "/admin/ratelimit/keys/k?route=echo", "", &resp); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if resp.KeyID != "k" || len(resp.Routes) != 1 || len(resp.Routes[0].Buckets) != 2 {
+		t.Fatalf("response %+v, want echo's route and global buckets", resp)
+	}
+	for _, b := range resp.Routes[0].Buckets {
+		want := map[string]int{"echo:k": 0, "global:k": 10}[b.Bucket]
+		if b.Remaining != want {
+			t.Fatalf("bucket %s: remaining %d, want %d", b.Bucket, b.Remaining, want)
+		}
+	}
+
+	f.do("GET", "/admin/ratelimit/keys/k", "", &resp)
+	if len(resp.Routes) != 2 {
+		t.Fatalf("%d routes without ?route=, want 2", len(resp.Routes))
+	}
+	f.expectError("GET", "/admin/ratelimit/keys/k?route=nope", "", http.StatusNotFound, "unknown_route")
+}
+
+func TestResetKey(t *testing.T) {
+	f := newFixture(t)
+	f.drain("echo:k", routePolicy)
+	f.drain("global:k", globalPolicy)
+	f.drain("echo:other", routePolicy)
+
+	var resp struct{ Reset []string }
+	if rec := f.do("DELETE", "/admin/ratelimit/keys/k?route=echo", "", &resp); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got := strings.Join(resp.Reset, " "); got != "echo:k global:k" {
+		t.Fatalf("reset %q, want echo:k global:k", got)
+	}
+	if n := f.remaining("echo:k", routePolicy); n != 5 {
+		t.Fatalf("echo:k has %d left after reset, want 5", n)
+	}
+	if n := f.remaining("echo:other", routePolicy); n != 0 {
+		t.Fatalf("another key was reset too")
+	}
+
+	e := f.lastEntry("ratelimit.key.reset", "k")
+	if !strings.Contains(jsonOf(t, e.Before), `"remaining":0`) || strings.Contains(jsonOf(t, e.After), `"remaining":0`) {
+		t.Fatalf("audit before %s / after %s, want drained then full", jsonOf(t, e.Before), jsonOf(t, e.After))
+	}
+
+	f.expectError("DELETE", "/admin/ratelimit/keys/k?route=nope", "", http.StatusNotFound, "unknown_route")
+	if n := len(f.entries()); n != 1 {
+		t.Fatalf("%d audit entries, want only the reset", n)
+	}
+}
+
+func TestResetBucket(t *testing.T) {
+	f := newFixture(t)
+	f.drain("echo:k", routePolicy)
+
+	var resp struct{ Reset []string }
+	if rec := f.do("DELETE", "/admin/ratelimit/buckets/echo:k", "", &resp); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if n := f.remaining("echo:k", routePolicy); n != 5 {
+		t.Fatalf("echo:k has %d left after reset, want 5", n)
+	}
+	e := f.lastEntry("ratelimit.bucket.reset", "echo:k")
+	if !strings.Contains(jsonOf(t, e.Before), `"remaining":0`) || !strings.Contains(jsonOf(t, e.After), `"remaining":5`) {
+		t.Fatalf("audit before %s / after %s, want 0 then 5 remaining", jsonOf(t, e.Before), jsonOf(t, e.After))
+	}
+
+	// a key no limit builds is still reset, with no state to record
+	if rec := f.do("DELETE", "/admin/ratelimit/buckets/ip:203.0.113.9/x", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if e := f.lastEntry("ratelimit.bucket.reset", "ip:203.0.113.9/x"); e.Before != nil || e.After != nil {
+		t.Fatalf("audit entry %+v, want no state", e)
+	}
+}
+
+func TestGrantBonus(t *testing.T) {
+	f := newFixture(t)
+	for body, want := range map[string]string{
+		`{`:                              "bad_request",
+		`{"amount":0,"ttl_seconds":60}`:  "bad_request",
+		`{"amount":5,"ttl_seconds":0}`:   "bad_request",
+		`{"amount":-1,"ttl_seconds":60}`: "bad_request",
+		`{"amount":5,"ttl_seconds":60,"route":"nope"}`: "unknown_route",
+	} {
+		code := http.StatusBadRequest
+		if want == "unknown_route" {
+			code = http.StatusNotFound
+		}
+		f.expectError("POST", "/admin/ratelimit/keys/k/bonus", body, code, want)
+	}
+	if n := len(f.entries()); n != 0 {
+		t.Fatalf("%d audit entries for rejected grants", n)
+	}
+
+	var resp struct {
+		Granted []string
+		Amount  int
+	}
+	rec := f.do("POST", "/admin/ratelimit/keys/k/bonus", `{"amount":3,"ttl_seconds":60,"route":"echo"}`, &resp)
+	if rec.Code != http.StatusOK || resp.Amount != 3 || strings.Join(resp.Granted, " ") != "echo:k global:k" {
+		t.Fatalf("%d %s, want 3 granted on echo:k and global:k", rec.Code, rec.Body)
+	}
+	d, err := f.lim.Inspect(context.Background(), "echo:k", routePolicy, time.Now())
+	if err != nil || d.Bonus != 3 {
+		t.Fatalf("echo:k: %+v, %v; want a bonus of 3", d, err)
+	}
+	e := f.lastEntry("ratelimit.key.bonus", "k")
+	if !strings.Contains(jsonOf(t, e.Before), `"bonus":0`) || !strings.Contains(jsonOf(t, e.After), `"bonus":3`) {
+		t.Fatalf("audit before %s / after %s, want bonus 0 then 3", jsonOf(t, e.Before), jsonOf(t, e.After))
+	}
+}
+
+func TestCapture(t *testing.T) {
+	f := newFixture(t)
+	for body, want := range map[string]struct {
+		code    int
+		errCode string
+	}{
+		`{`:                                   {http.StatusBadRequest, "bad_request"},
+		`{"ttl_seconds":60}`:                  {http.StatusBadRequest, "bad_request"},
+		`{"route":"nope"}`:                    {http.StatusNotFound, "unknown_route"},
+		`{"route":"echo","ttl_seconds":-1}`:   {http.StatusBadRequest, "bad_request"},
+		`{"route":"echo","ttl_seconds":3601}`: {http.StatusBadRequest, "bad_request"},
+	} {
+		f.expectError("POST", "/admin/capture", body, want.code, want.errCode)
+	}
+
+	// the TTL defaults to 5 minutes and is capped at an hour
+	for body, want := range map[string]time.Duration{
+		`{"route":"echo"}`:               5 * time.Minute,
+		`{"key":"k","ttl_seconds":3600}`: time.Hour,
+	} {
+		var tg capture.Toggle
+		start := time.Now()
+		if rec := f.do("POST", "/admin/capture", body, &tg); rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", body, rec.Code, rec.Body)
+		}
+		if ttl := tg.Until.Sub(start); ttl < want-time.Second || ttl > want+time.Second {
+			t.Fatalf("%s: expires in %v, want %v", body, ttl, want)
+		}
+	}
+	if e := f.lastEntry("capture.start", "key=k"); e.Before != nil || e.After == nil {
+		t.Fatalf("audit entry %+v, want only an after state", e)
+	}
+
+	var list struct{ Captures []capture.Toggle }
+	f.do("GET", "/admin/capture", "", &list)
+	if len(list.Captures) != 2 {
+		t.Fatalf("%d active captures, want 2", len(list.Captures))
+	}
+
+	if rec := f.do("DELETE", "/admin/capture?route=echo", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("stop: status %d: %s", rec.Code, rec.Body)
+	}
+	if e := f.lastEntry("capture.stop", "route=echo"); e.Before == nil || e.After != nil {
+		t.Fatalf("audit entry %+v, want only a before state", e)
+	}
+	f.expectError("DELETE", "/admin/capture?route=echo", "", http.StatusNotFound, "not_found")
+	if n := len(f.entries()); n != 3 {
+		t.Fatalf("%d audit entries, want 3", n)
+	}
+}
+
+func TestQueryAuditValidation(t *testing.T) {
+	f := newFixture(t)
+	for _, q := range []string{"since=yesterday", "until=2030-01-01", "limit=0", "limit=x"} {
+		f.expectError("GET", "/admin/audit?"+q, "", http.StatusBadRequest, "bad_request")
+	}
+	var resp struct{ Entries []audit.Entry }
+	if rec := f.do("GET", "/admin/audit?limit=5", "", &resp); rec.Code != http.StatusOK || resp.Entries == nil {
+		t.Fatalf("%d %s, want 200 with []", rec.Code, rec.Body)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	h := RequireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), "/livez")
+
+	for _, tc := range []struct {
+		path, auth string
+		want       int
+	}{
+		{"/admin/capture", "", http.StatusUnauthorized},
+		{"/admin/capture", "Bearer wrong", http.StatusUnauthorized},
+		{"/admin/capture", "secret", http.StatusUnauthorized},
+		{"/admin/capture", "Bearer secret", http.StatusNoContent},
+		{"/livez", "", http.StatusNoContent},
+		{"/livez/x", "", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tc.want {
+			t.Errorf("%s with %q: status %d, want %d", tc.path, tc.auth, rec.Code, tc.want)
+		}
+	}
+}
+
+func jsonOf(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestAuditActor(t *testing.T) {
+	f := newFixture(t)
+	f.do("DELETE", "/admin/ratelimit/buckets/echo:a", "", nil)
+	if e := f.lastEntry("ratelimit.bucket.reset", "echo:a"); e.Actor != "192.0.2.1:4321" {
+		t.Fatalf("actor %q without a token, want the peer address", e.Actor)
+	}
+
+	f.h = RequireToken("secret", f.h)
+	r := httptest.NewRequest("DELETE", "/admin/ratelimit/buckets/echo:b", nil)
+	r.RemoteAddr = "@"
+	r.Header.Set("Authorization", "Bearer secret")
+	f.h.ServeHTTP(httptest.NewRecorder(), r)
+	e := f.lastEntry("ratelimit.bucket.reset", "echo:b")
+	if want := principal("secret") + " from unix"; e.Actor != want {
+		t.Fatalf("actor %q, want %q", e.Actor, want)
+	}
+	if strings.Contains(e.Actor, "secret") || principal("secret") == principal("other") {
+		t.Fatalf("principal %q does not hide or tell tokens apart", principal("secret"))
+	}
+}
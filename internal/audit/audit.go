@@ -0,0 +1,126 @@
+// Package audit keeps an append-only JSON lines trail of runtime changes.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Source says how a change was triggered.
+type Source string
+
+const SourceAdmin Source = "admin_api"
+
+// Entry is one change. Before and After hold the affected state; either is
+// omitted when the state did not exist.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Source Source    `json:"source"`
+	Actor  string    `json:"actor,omitempty"` // who, e.g. the admin client address
+	Action string    `json:"action"`          // e.g. "ratelimit.reset"
+	Target string    `json:"target,omitempty"`
+	Before any       `json:"before,omitempty"`
+	After  any       `json:"after,omitempty"`
+}
+
+// Filter selects entries; zero fields match everything.
+type Filter struct {
+	Source Source
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int // newest first; default 100
+}
+
+func (f Filter) match(e Entry) bool {
+	return (f.Source == "" || e.Source == f.Source) &&
+		(f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Target == "" || e.Target == f.Target) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+type Log struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{path: path, f: f}, nil
+}
+
+// Record appends e, stamping the time if unset, and syncs it to disk.
+func (l *Log) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Query scans the trail for entries matching f, newest first.
+func (l *Log) Query(f Filter) ([]Entry, error) {
+	if f.Limit <= 0 {
+		f.Limit = 100
+	}
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	var out []Entry
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64<<10), 4<<20)
+	for sc.Scan() {
+		var e Entry
+		if json.Unmarshal(sc.Bytes(), &e) != nil || !f.match(e) {
+			continue
+		}
+		out = append(out, e)
+		// keep only the newest Limit
+		if len(out) > 2*f.Limit {
+			out = append(out[:0], out[len(out)-f.Limit:]...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) > f.Limit {
+		out = out[len(out)-f.Limit:]
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
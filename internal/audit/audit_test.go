@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openLog(t *testing.T) *Log {
+	t.Helper()
+	l, err := Open(filepath.Join(t.TempDir(), "sub", "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+var t0 = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// fill records n entries a minute apart, targets "t0".."t<n-1>", with
+// every third one by bob.
+func fill(t *testing.T, l *Log, n int) {
+	t.Helper()
+	for i := range n {
+		actor := "alice"
+		if i%3 == 0 {
+			actor = "bob"
+		}
+		e := Entry{
+			Time:   t0.Add(time.Duration(i) * time.Minute),
+			Source: SourceAdmin,
+			Actor:  actor,
+			Action: "ratelimit.key.reset",
+			Target: fmt.Sprintf("t%d", i),
+		}
+		if err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func targets(es []Entry) string {
+	var s string
+	for i, e := range es {
+		if i > 0 {
+			s += " "
+		}
+		s += e.Target
+	}
+	return s
+}
+
+func TestQuery(t *testing.T) {
+	l := openLog(t)
+	fill(t, l, 10)
+
+	for _, tc := range []struct {
+		name string
+		f    Filter
+		want string
+	}{
+		{"newest first", Filter{}, "t9 t8 t7 t6 t5 t4 t3 t2 t1 t0"},
+		{"limit", Filter{Limit: 3}, "t9 t8 t7"},
+		{"actor", Filter{Actor: "bob"}, "t9 t6 t3 t0"},
+		{"actor and limit", Filter{Actor: "bob", Limit: 2}, "t9 t6"},
+		{"target", Filter{Target: "t4"}, "t4"},
+		{"action", Filter{Action: "capture.start"}, ""},
+		{"source", Filter{Source: "config"}, ""},
+		// Since is inclusive, Until exclusive
+		{"since", Filter{Since: t0.Add(7 * time.Minute)}, "t9 t8 t7"},
+		{"until", Filter{Until: t0.Add(2 * time.Minute)}, "t1 t0"},
+		{"since and until", Filter{Since: t0.Add(4 * time.Minute), Until: t0.Add(6 * time.Minute)}, "t5 t4"},
+		{"since and until and limit", Filter{Since: t0.Add(2 * time.Minute), Until: t0.Add(8 * time.Minute), Limit: 2}, "t7 t6"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			es, err := l.Query(tc.f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := targets(es); got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestQueryTrim crosses the rolling trim at 2*Limit several times, with a
+// count that leaves the buffer neither empty nor full at the end.
+func TestQueryTrim(t *testing.T) {
+	l := openLog(t)
+	fill(t, l, 23)
+
+	for limit, want := range map[int]string{
+		1:   "t22",
+		4:   "t22 t21 t20 t19",
+		5:   "t22 t21 t20 t19 t18",
+		11:  "t22 t21 t20 t19 t18 t17 t16 t15 t14 t13 t12",
+		100: "t22 t21 t20 t19 t18 t17 t16 t15 t14 t13 t12 t11 t10 t9 t8 t7 t6 t5 t4 t3 t2 t1 t0",
+	} {
+		es, err := l.Query(Filter{Limit: limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := targets(es); got != want {
+			t.Fatalf("limit %d: %q, want %q", limit, got, want)
+		}
+	}
+
+	// the trim also holds when only some entries match
+	es, err := l.Query(Filter{Actor: "bob", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := targets(es); got != "t21 t18" {
+		t.Fatalf("bob, limit 2: %q, want t21 t18", got)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	l := openLog(t)
+	before := time.Now().UTC()
+	if err := l.Record(Entry{Source: SourceAdmin, Action: "capture.stop", Before: map[string]int{"n": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	es, err := l.Query(Filter{})
+	if err != nil || len(es) != 1 {
+		t.Fatalf("%v, %v; want one entry", es, err)
+	}
+	if e := es[0]; e.Time.Before(before) || e.After != nil || e.Before == nil {
+		t.Fatalf("entry %+v, want a stamped time and only a before state", e)
+	}
+
+	// lines that do not parse, e.g. a torn write, are skipped
+	b, _ := os.ReadFile(l.path)
+	if err := os.WriteFile(l.path, append([]byte("{\"time\":\n"), b...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if es, err := l.Query(Filter{}); err != nil || len(es) != 1 {
+		t.Fatalf("%v, %v; want the one good entry", es, err)
+	}
+}
@@ -4,16 +4,28 @@ import (
 	"context"
 	"net/http"
 	"strings"
+
+	"github.com/AlexKimmel/GateLite/internal/reqid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/AlexKimmel/GateLite/internal/auth")
+
 type ctxKey int
 
-const keyID ctxKey = 0
+const (
+	keyID ctxKey = iota
+	keyMeta
+)
 
 // Store is a static in-memory key store: secret -> keyID
 type Store struct {
 	header   string
 	bySecret map[string]string
+	metaByID map[string]map[string]string
 }
 
 // NewStatic creates a new static key store.
@@ -24,7 +36,18 @@ func NewStatic(header string, pairs map[string]string) *Store {
 	if h == "" {
 		h = "X-API-Key"
 	}
-	return &Store{header: h, bySecret: pairs}
+	return &Store{header: h, bySecret: pairs, metaByID: map[string]map[string]string{}}
+}
+
+// SetMetadata attaches metadata (e.g. plan, owner) to a key ID.
+// It must be called before the store starts serving requests.
+func (s *Store) SetMetadata(id string, md map[string]string) {
+	s.metaByID[id] = md
+}
+
+// Metadata returns the metadata attached to a key ID.
+func (s *Store) Metadata(id string) map[string]string {
+	return s.metaByID[id]
 }
 
 func (s *Store) keyIDFor(secret string) (string, bool) {
@@ -47,36 +70,54 @@ func KeyIDFrom(ctx context.Context) (string, bool) {
 	return id, ok
 }
 
+// WithMetadata injects the key metadata into context.
+func WithMetadata(ctx context.Context, md map[string]string) context.Context {
+	return context.WithValue(ctx, keyMeta, md)
+}
+
+// MetadataFrom extracts the key metadata from context (if present).
+func MetadataFrom(ctx context.Context) (map[string]string, bool) {
+	md, ok := ctx.Value(keyMeta).(map[string]string)
+	return md, ok
+}
+
 // Middleware validates the API key and writes JSON errors on failure.
-// It skips authentication for any path in skipPaths.
-func (s *Store) Middleware(skipPaths map[string]struct{}) func(http.Handler) http.Handler {
+func (s *Store) Middleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		hname := s.header
 
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if _, ok := skipPaths[r.URL.Path]; ok {
-				next.ServeHTTP(w, r)
-				return
-			}
-
+			_, span := tracer.Start(r.Context(), "auth")
 			secret := strings.TrimSpace(r.Header.Get(hname))
 			if secret == "" {
-				writeJSON(w, http.StatusUnauthorized, "missing_api_key", "Provide API key in "+hname)
+				span.SetStatus(codes.Error, "missing_api_key")
+				span.End()
+				writeJSON(w, r, http.StatusUnauthorized, "missing_api_key", "Provide API key in "+hname)
 				return
 			}
 			id, ok := s.keyIDFor(secret)
 			if !ok {
-				writeJSON(w, http.StatusUnauthorized, "invalid_api_key", "API key not recognized")
+				span.SetStatus(codes.Error, "invalid_api_key")
+				span.End()
+				writeJSON(w, r, http.StatusUnauthorized, "invalid_api_key", "API key not recognized")
 				return
 			}
+			span.SetAttributes(attribute.String("gatelite.key.id", id))
+			span.End()
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("gatelite.key.id", id))
+
 			ctx := WithKeyID(r.Context(), id)
+			if md, ok := s.metaByID[id]; ok {
+				ctx = WithMetadata(ctx, md)
+			}
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-func writeJSON(w http.ResponseWriter, code int, errCode, msg string) {
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, errCode, msg string) {
+	id, _ := reqid.From(r.Context())
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	_, _ = w.Write([]byte(`{"error":{"code":"` + errCode + `","message":"` + msg + `"}}`))
+	_, _ = w.Write([]byte(`{"error":{"code":"` + errCode + `","message":"` + msg + `","request_id":"` + id + `"}}`))
 }
@@ -0,0 +1,379 @@
+// Package capture logs full request/response exchanges for selected routes
+// or API keys while a time-limited toggle is active.
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/auth"
+	"github.com/AlexKimmel/GateLite/internal/reqid"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+	"github.com/rs/zerolog"
+)
+
+// Redacted replaces redacted header values, query values and JSON fields.
+const Redacted = "[REDACTED]"
+
+// DefaultRedactHeaders are redacted when Options.RedactHeaders is empty.
+var DefaultRedactHeaders = []string{"Authorization", "X-API-Key", "Cookie", "Set-Cookie"}
+
+// DefaultRedactQuery are redacted when Options.RedactQuery is empty.
+var DefaultRedactQuery = []string{"api_key", "apikey", "key", "token", "access_token", "password", "secret"}
+
+type Options struct {
+	// Out receives one JSON line per capture, regardless of the application
+	// log level; default stdout.
+	Out           io.Writer
+	MaxBody       int      // body bytes kept per direction, default 4096
+	RedactHeaders []string // case-insensitive names
+	RedactQuery   []string // case-insensitive query parameter names
+	// RedactJSON are dot paths into JSON bodies, e.g. "user.password".
+	// "*" matches any field; arrays are descended into transparently.
+	RedactJSON []string
+}
+
+// Target selects requests by route ID and/or API key ID; an empty field
+// matches any value.
+type Target struct {
+	Route string `json:"route,omitempty"`
+	Key   string `json:"key,omitempty"`
+}
+
+// Toggle is an active capture.
+type Toggle struct {
+	Target
+	Until time.Time `json:"expires_at"`
+}
+
+type Capture struct {
+	log     zerolog.Logger
+	maxBody int
+	headers map[string]struct{}
+	query   QueryRedactor
+	paths   [][]string
+
+	mu      sync.RWMutex
+	toggles map[Target]time.Time
+}
+
+func New(o Options) *Capture {
+	if o.MaxBody <= 0 {
+		o.MaxBody = 4096
+	}
+	if len(o.RedactHeaders) == 0 {
+		o.RedactHeaders = DefaultRedactHeaders
+	}
+	if len(o.RedactQuery) == 0 {
+		o.RedactQuery = DefaultRedactQuery
+	}
+	if o.Out == nil {
+		o.Out = os.Stdout
+	}
+	c := &Capture{
+		log:     zerolog.New(o.Out).With().Timestamp().Logger(),
+		maxBody: o.MaxBody,
+		headers: make(map[string]struct{}, len(o.RedactHeaders)),
+		query:   NewQueryRedactor(o.RedactQuery),
+		toggles: make(map[Target]time.Time),
+	}
+	for _, h := range o.RedactHeaders {
+		c.headers[http.CanonicalHeaderKey(h)] = struct{}{}
+	}
+	for _, p := range o.RedactJSON {
+		c.paths = append(c.paths, strings.Split(p, "."))
+	}
+	return c
+}
+
+// Enable captures requests matching t until ttl elapses, replacing any
+// earlier toggle for t.
+func (c *Capture) Enable(t Target, ttl time.Duration, now time.Time) Toggle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until := now.Add(ttl)
+	c.toggles[t] = until
+	return Toggle{Target: t, Until: until}
+}
+
+// Disable removes the toggle for t and reports whether one was active.
+func (c *Capture) Disable(t Target) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.toggles[t]
+	delete(c.toggles, t)
+	return ok
+}
+
+// Active lists unexpired toggles, pruning expired ones.
+func (c *Capture) Active(now time.Time) []Toggle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := []Toggle{}
+	for t, until := range c.toggles {
+		if !now.Before(until) {
+			delete(c.toggles, t)
+			continue
+		}
+		out = append(out, Toggle{Target: t, Until: until})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Until.Before(out[j].Until) })
+	return out
+}
+
+func (c *Capture) match(route, key string, now time.Time) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for t, until := range c.toggles {
+		if now.Before(until) &&
+			(t.Route == "" || t.Route == route) &&
+			(t.Key == "" || t.Key == key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware logs matching exchanges to the capture sink. It runs after
+// auth so key toggles can match.
+func (c *Capture) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rt, _ := routing.RouteFrom(r)
+			routeID := ""
+			if rt != nil {
+				routeID = rt.ID
+			}
+			keyID, _ := auth.KeyIDFrom(r.Context())
+			if !c.match(routeID, keyID, time.Now()) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			reqHeader := r.Header.Clone()
+			in := &teeBody{body: clip{limit: c.maxBody}}
+			if r.Body != nil {
+				in.ReadCloser = r.Body
+				r.Body = in
+			}
+			rec := &recorder{ResponseWriter: w, body: clip{limit: c.maxBody}}
+
+			next.ServeHTTP(rec, r)
+
+			status := rec.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			reqID, _ := reqid.From(r.Context())
+			reqBody, reqN := c.body(&in.body, reqHeader)
+			respBody, respN := c.body(&rec.body, rec.header)
+			// Log, not Info: captures are asked for explicitly and must not
+			// depend on the log level
+			c.log.Log().
+				Str("request_id", reqID).
+				Str("route", routeID).
+				Str("key_id", keyID).
+				Dict("request", zerolog.Dict().
+					Str("method", r.Method).
+					Str("url", c.redactURL(r.URL)).
+					Interface("headers", c.redactHeader(reqHeader)).
+					Str("body", reqBody).
+					Int64("body_bytes", reqN)).
+				Dict("response", zerolog.Dict().
+					Int("status", status).
+					Interface("headers", c.redactHeader(rec.header)).
+					Str("body", respBody).
+					Int64("body_bytes", respN)).
+				Msg("debug capture")
+		})
+	}
+}
+
+// redactURL renders the request URI with the configured query parameters
+// redacted.
+func (c *Capture) redactURL(u *url.URL) string {
+	out := *u
+	out.RawQuery = c.query.Redact(u.RawQuery)
+	return out.RequestURI()
+}
+
+// QueryRedactor redacts query parameters by case-insensitive name.
+type QueryRedactor map[string]struct{}
+
+func NewQueryRedactor(names []string) QueryRedactor {
+	q := make(QueryRedactor, len(names))
+	for _, n := range names {
+		q[strings.ToLower(n)] = struct{}{}
+	}
+	return q
+}
+
+// Redact replaces the values of the redacted parameters in a raw query
+// with Redacted. The raw query is kept when nothing needs redacting.
+func (q QueryRedactor) Redact(raw string) string {
+	if raw == "" {
+		return raw
+	}
+	parts := strings.Split(raw, "&")
+	redacted := false
+	for i, part := range parts {
+		name, _, _ := strings.Cut(part, "=")
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if _, ok := q[strings.ToLower(name)]; ok {
+			parts[i] = url.QueryEscape(name) + "=" + url.QueryEscape(Redacted)
+			redacted = true
+		}
+	}
+	if !redacted {
+		return raw
+	}
+	return strings.Join(parts, "&")
+}
+
+func (c *Capture) redactHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, v := range h {
+		if _, ok := c.headers[http.CanonicalHeaderKey(k)]; ok {
+			out[k] = []string{Redacted}
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// body renders a captured body and returns it with the full body size.
+// JSON bodies have the configured paths redacted; a truncated JSON body
+// cannot be parsed, so it is withheld when any path is configured.
+// Compressed bodies are not decoded.
+func (c *Capture) body(cl *clip, h http.Header) (string, int64) {
+	b, n := cl.snapshot()
+	return c.render(b, n > int64(len(b)), h), n
+}
+
+func (c *Capture) render(b []byte, truncated bool, h http.Header) string {
+	if len(b) == 0 {
+		return ""
+	}
+	if enc := h.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return "[" + enc + " body omitted]"
+	}
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	isJSON := mt == "application/json" || strings.HasSuffix(mt, "+json")
+	suffix := ""
+	if truncated {
+		suffix = "...[truncated]"
+	}
+	if !isJSON || len(c.paths) == 0 {
+		return string(b) + suffix
+	}
+	if truncated {
+		return "[truncated JSON withheld]"
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "[invalid JSON withheld]"
+	}
+	for _, p := range c.paths {
+		v = redactPath(v, p)
+	}
+	out, _ := json.Marshal(v)
+	return string(out)
+}
+
+func redactPath(v any, path []string) any {
+	switch x := v.(type) {
+	case []any:
+		for i := range x {
+			x[i] = redactPath(x[i], path)
+		}
+	case map[string]any:
+		for k, child := range x {
+			if path[0] != "*" && path[0] != k {
+				continue
+			}
+			if len(path) == 1 {
+				x[k] = Redacted
+			} else {
+				x[k] = redactPath(child, path[1:])
+			}
+		}
+	}
+	return v
+}
+
+// clip keeps the first limit bytes of a body and counts the rest. Request
+// bodies are read by the upstream transport on its own goroutine, which may
+// still be running when the capture is logged.
+type clip struct {
+	limit int
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+	n   int64
+}
+
+func (c *clip) keep(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n += int64(len(p))
+	if room := c.limit - c.buf.Len(); room > 0 {
+		c.buf.Write(p[:min(room, len(p))])
+	}
+}
+
+// snapshot returns a copy of the kept bytes and the total seen.
+func (c *clip) snapshot() ([]byte, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.buf.Bytes()), c.n
+}
+
+type teeBody struct {
+	io.ReadCloser
+	body clip
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.body.keep(p[:n])
+	return n, err
+}
+
+type recorder struct {
+	http.ResponseWriter
+	body   clip
+	status int
+	header http.Header
+}
+
+func (w *recorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.body.keep(b[:n])
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush/Hijack on the original.
+func (w *recorder) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,218 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/auth"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+// exchange is the part of a capture line the tests look at.
+type exchange struct {
+	Route   string `json:"route"`
+	KeyID   string `json:"key_id"`
+	Request struct {
+		URL       string      `json:"url"`
+		Headers   http.Header `json:"headers"`
+		Body      string      `json:"body"`
+		BodyBytes int64       `json:"body_bytes"`
+	} `json:"request"`
+	Response struct {
+		Status    int         `json:"status"`
+		Headers   http.Header `json:"headers"`
+		Body      string      `json:"body"`
+		BodyBytes int64       `json:"body_bytes"`
+	} `json:"response"`
+}
+
+// capture serves one request through c's middleware on route echo with
+// key k1, answering with respBody as JSON, and returns the capture line.
+func capture(t *testing.T, c *Capture, buf *bytes.Buffer, r *http.Request, respBody string) (exchange, bool) {
+	t.Helper()
+	buf.Reset()
+	h := c.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(respBody))
+	}))
+	r = routing.WithRoute(r, &routing.Route{ID: "echo"})
+	h.ServeHTTP(httptest.NewRecorder(), r.WithContext(auth.WithKeyID(r.Context(), "k1")))
+	if buf.Len() == 0 {
+		return exchange{}, false
+	}
+	var e exchange
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("%v in %s", err, buf)
+	}
+	return e, true
+}
+
+func post(target, body string) *http.Request {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer s3cret")
+	r.Header.Set("x-api-key", "s3cret")
+	r.Header.Set("Accept", "application/json")
+	return r
+}
+
+func TestMiddlewareRedacts(t *testing.T) {
+	var buf bytes.Buffer
+	c := New(Options{Out: &buf, RedactJSON: []string{"user.password", "cards.number", "token"}})
+	c.Enable(Target{Route: "echo"}, time.Minute, time.Now())
+
+	body := `{"user":{"name":"ann","password":"s3cret"},"cards":[{"number":"s3cret","exp":"12/30"}]}`
+	e, ok := capture(t, c, &buf, post("/v1/pay?API_KEY=s3cret&page=2", body), `{"token":"s3cret","ok":true}`)
+	if !ok {
+		t.Fatal("nothing captured")
+	}
+	if strings.Contains(buf.String(), "s3cret") {
+		t.Fatalf("secret captured: %s", buf.String())
+	}
+	for _, tc := range []struct{ name, got, want string }{
+		{"route", e.Route, "echo"},
+		{"key", e.KeyID, "k1"},
+		{"url", e.Request.URL, "/v1/pay?API_KEY=%5BREDACTED%5D&page=2"},
+		{"authorization", e.Request.Headers.Get("Authorization"), Redacted},
+		{"api key", e.Request.Headers.Get("X-Api-Key"), Redacted},
+		{"accept", e.Request.Headers.Get("Accept"), "application/json"},
+		{"set-cookie", e.Response.Headers.Get("Set-Cookie"), Redacted},
+		{"request body", e.Request.Body, `{"cards":[{"exp":"12/30","number":"[REDACTED]"}],"user":{"name":"ann","password":"[REDACTED]"}}`},
+		{"response body", e.Response.Body, `{"ok":true,"token":"[REDACTED]"}`},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.name, tc.got, tc.want)
+		}
+	}
+	if e.Request.BodyBytes != int64(len(body)) || e.Response.Status != http.StatusCreated {
+		t.Errorf("request body bytes %d, status %d", e.Request.BodyBytes, e.Response.Status)
+	}
+}
+
+func TestMiddlewareTruncates(t *testing.T) {
+	var buf bytes.Buffer
+	c := New(Options{Out: &buf, MaxBody: 16, RedactJSON: []string{"password"}})
+	c.Enable(Target{}, time.Minute, time.Now())
+
+	// cut mid-way, the JSON could leak the field it would have redacted
+	body := `{"name":"ann","password":"s3cret"}`
+	e, _ := capture(t, c, &buf, post("/x", body), `{"ok":true}`)
+	if e.Request.Body != "[truncated JSON withheld]" || e.Request.BodyBytes != int64(len(body)) {
+		t.Fatalf("request body %q (%d bytes), want it withheld with the full size", e.Request.Body, e.Request.BodyBytes)
+	}
+	if e.Response.Body != `{"ok":true}` {
+		t.Fatalf("response body %q, want it whole", e.Response.Body)
+	}
+
+	// other bodies are cut and marked
+	r := post("/x", "0123456789abcdefXYZ")
+	r.Header.Set("Content-Type", "text/plain")
+	e, _ = capture(t, c, &buf, r, "")
+	if e.Request.Body != "0123456789abcdef...[truncated]" || e.Request.BodyBytes != 19 {
+		t.Fatalf("request body %q (%d bytes)", e.Request.Body, e.Request.BodyBytes)
+	}
+}
+
+func TestRender(t *testing.T) {
+	c := New(Options{RedactJSON: []string{"a.*", "secret"}})
+	plain := New(Options{})
+	header := func(kv ...string) http.Header {
+		h := http.Header{}
+		for i := 0; i < len(kv); i += 2 {
+			h.Set(kv[i], kv[i+1])
+		}
+		return h
+	}
+	jsonCT := header("Content-Type", "application/json; charset=utf-8")
+	for _, tc := range []struct {
+		name      string
+		c         *Capture
+		body      string
+		truncated bool
+		h         http.Header
+		want      string
+	}{
+		{"empty", c, "", false, jsonCT, ""},
+		{"wildcard", c, `{"a":{"x":1,"y":2},"b":3}`, false, jsonCT, `{"a":{"x":"[REDACTED]","y":"[REDACTED]"},"b":3}`},
+		{"arrays", c, `[{"secret":1},{"secret":2,"ok":3}]`, false, jsonCT, `[{"secret":"[REDACTED]"},{"ok":3,"secret":"[REDACTED]"}]`},
+		{"json suffix", c, `{"secret":1}`, false, header("Content-Type", "application/problem+json"), `{"secret":"[REDACTED]"}`},
+		{"truncated json", c, `{"secret":`, true, jsonCT, "[truncated JSON withheld]"},
+		{"invalid json", c, `{"secret":`, false, jsonCT, "[invalid JSON withheld]"},
+		{"no paths", plain, `{"secret":`, true, jsonCT, `{"secret":...[truncated]`},
+		{"not json", c, `secret=1`, false, header("Content-Type", "application/x-www-form-urlencoded"), `secret=1`},
+		{"compressed", c, "\x1f\x8b", false, header("Content-Type", "application/json", "Content-Encoding", "gzip"), "[gzip body omitted]"},
+	} {
+		if got := tc.c.render([]byte(tc.body), tc.truncated, tc.h); got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRedactHeaderNames(t *testing.T) {
+	c := New(Options{RedactHeaders: []string{"x-secret"}})
+	got := c.redactHeader(http.Header{"X-Secret": {"a"}, "Authorization": {"b"}})
+	// a custom list replaces the default
+	if got.Get("X-Secret") != Redacted || got.Get("Authorization") != "b" {
+		t.Fatalf("headers %v", got)
+	}
+}
+
+func TestToggles(t *testing.T) {
+	c := New(Options{Out: io.Discard})
+	now := time.Now()
+	c.Enable(Target{Route: "echo"}, time.Minute, now)
+	c.Enable(Target{Key: "k1"}, time.Hour, now)
+	c.Enable(Target{Route: "other", Key: "k2"}, time.Second, now)
+
+	for _, tc := range []struct {
+		route, key string
+		at         time.Duration
+		want       bool
+	}{
+		{"echo", "", 0, true},
+		{"x", "k1", 0, true},
+		{"other", "k2", 0, true},
+		{"other", "k3", 0, false},
+		{"x", "k2", 0, false},
+		{"other", "k2", time.Second, false}, // expired
+		{"echo", "", time.Minute, false},
+		{"x", "k1", time.Minute, true},
+	} {
+		if got := c.match(tc.route, tc.key, now.Add(tc.at)); got != tc.want {
+			t.Errorf("match(%q, %q) at +%v = %v, want %v", tc.route, tc.key, tc.at, got, tc.want)
+		}
+	}
+
+	active := c.Active(now.Add(2 * time.Second))
+	if len(active) != 2 || active[0].Route != "echo" || active[1].Key != "k1" {
+		t.Fatalf("active %+v, want echo then k1, soonest to expire first", active)
+	}
+	if !c.Disable(Target{Route: "echo"}) || c.Disable(Target{Route: "echo"}) {
+		t.Fatal("Disable should report the toggle only once")
+	}
+	if active := c.Active(now); len(active) != 1 {
+		t.Fatalf("active %+v after disabling echo and pruning other", active)
+	}
+}
+
+func TestMiddlewareSkipsUnmatched(t *testing.T) {
+	var buf bytes.Buffer
+	c := New(Options{Out: &buf})
+	c.Enable(Target{Route: "other"}, time.Minute, time.Now())
+	if _, ok := capture(t, c, &buf, post("/x", "{}"), "{}"); ok {
+		t.Fatal("captured a request no toggle matches")
+	}
+	c.Enable(Target{Route: "echo"}, -time.Second, time.Now())
+	if _, ok := capture(t, c, &buf, post("/x", "{}"), "{}"); ok {
+		t.Fatal("captured with an expired toggle")
+	}
+}
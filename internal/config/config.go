@@ -1,9 +1,14 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"sort"
+	"strconv"
 	"time"
 
+	"github.com/AlexKimmel/GateLite/internal/quota"
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
 	"gopkg.in/yaml.v3"
 )
 
@@ -13,28 +18,173 @@ type Server struct {
 	WriteTimeoutMS int    `yaml:"write_timeout_ms"`
 	IdleTimeoutMS  int    `yaml:"idle_timeout_ms"`
 	MaxBodyBytes   int64  `yaml:"max_body_bytes"`
+
+	// Inbound request IDs are trusted from this header when well-formed and
+	// generated otherwise; the ID is forwarded upstream and echoed back.
+	RequestIDHeader string `yaml:"request_id_header"` // default "X-Request-ID"
+
+	// Shutdown: after SIGTERM the gateway reports not ready, keeps serving
+	// for PreStopDelayMS so load balancers notice, then stops accepting and
+	// waits up to DrainTimeoutMS for in-flight requests before closing them.
+	PreStopDelayMS int `yaml:"pre_stop_delay_ms"` // default 0
+	DrainTimeoutMS int `yaml:"drain_timeout_ms"`  // default 10000
+	// PublicProbes also serves /livez and /readyz on the public listener,
+	// for load balancers that cannot reach the admin one. They shadow
+	// routes with the same paths.
+	PublicProbes bool `yaml:"public_probes"`
+
+	// SIGUSR2 starts the binary on disk with the listening sockets; the old
+	// process drains once the new one reports ready within UpgradeTimeoutMS.
+	UpgradeTimeoutMS int `yaml:"upgrade_timeout_ms"` // default 30000
 }
 
 type Observability struct {
 	LogLevel       string `yaml:"log_level"`       // "debug","info","warn","error"
 	PrometheusPath string `yaml:"prometheus_path"` // e.g. "/metrics"
+
+	// Histogram buckets; empty keeps the defaults.
+	Buckets struct {
+		Latency []float64 `yaml:"latency"` // seconds, request and upstream timings
+		Size    []float64 `yaml:"size"`    // bytes, upstream request/response bodies
+	} `yaml:"buckets"`
+
+	// Opt-in per API key metrics. Key label values are capped at MaxKeys
+	// (default 100), further keys are reported as "other"; Always lists key
+	// IDs that are tracked regardless.
+	KeyMetrics struct {
+		Enabled bool     `yaml:"enabled"`
+		MaxKeys int      `yaml:"max_keys"`
+		Always  []string `yaml:"always"`
+	} `yaml:"key_metrics"`
+
+	// Access log, separate from the application log.
+	AccessLog struct {
+		Enabled        bool              `yaml:"enabled"`
+		Format         string            `yaml:"format"`      // json (default), logfmt, combined
+		Fields         []string          `yaml:"fields"`      // json/logfmt field selection
+		Output         string            `yaml:"output"`      // stdout (default), stderr or a file path
+		MaxSizeMB      int               `yaml:"max_size_mb"` // rotate files past this size; 0 disables
+		Rotate         string            `yaml:"rotate"`      // "hourly", "daily" or "" (none)
+		MaxBackups     int               `yaml:"max_backups"` // rotated files kept; 0 keeps all
+		TrustedProxies []string          `yaml:"trusted_proxies"`
+		Sample         []AccessLogSample `yaml:"sample"`
+	} `yaml:"access_log"`
+
+	// Debug capture logs headers and bodies of requests matching a toggle
+	// set through the admin API. The auth header is always redacted.
+	Capture struct {
+		Output        string   `yaml:"output"`         // "stdout" (default), "stderr" or a file path; not filtered by log_level
+		MaxBodyBytes  int      `yaml:"max_body_bytes"` // per direction, default 4096
+		RedactHeaders []string `yaml:"redact_headers"` // default Authorization, X-API-Key, Cookie, Set-Cookie
+		RedactQuery   []string `yaml:"redact_query"`   // query parameter names, default api_key, apikey, key, token, access_token, password, secret; also applies to the access log
+		RedactJSON    []string `yaml:"redact_json"`    // dot paths, e.g. "card.number"; "*" matches any field
+	} `yaml:"capture"`
+
+	// OpenTelemetry tracing with W3C trace context propagation.
+	Tracing struct {
+		Enabled     bool    `yaml:"enabled"`
+		Exporter    string  `yaml:"exporter"` // "otlp" (default) or "stdout"
+		Endpoint    string  `yaml:"endpoint"` // OTLP/HTTP collector host:port, default localhost:4318
+		Insecure    bool    `yaml:"insecure"` // plain HTTP to the collector
+		Sampler     string  `yaml:"sampler"`  // parent_ratio (default), ratio, always_on, always_off
+		SampleRatio float64 `yaml:"sample_ratio"`
+		ServiceName string  `yaml:"service_name"`
+	} `yaml:"tracing"`
+}
+
+// AccessLogSample logs Rate (0..1) of the requests matching Status ("5xx",
+// "404") and Route; the first matching rule applies, unmatched are logged.
+type AccessLogSample struct {
+	Status string  `yaml:"status"`
+	Route  string  `yaml:"route"`
+	Rate   float64 `yaml:"rate"`
 }
 
 type Limits struct {
-	Default struct {
-		RequestsPerMinute int `yaml:"requests_per_minute"`
-		Burst             int `yaml:"burst"`
-	} `yaml:"default"`
+	Default RateLimitPolicy            `yaml:"default"`
+	Global  RateLimitPolicy            `yaml:"global"` // per key across all routes
+	Groups  map[string]RateLimitPolicy `yaml:"groups"` // per key across routes with the tag
+
+	QuotaStore string  `yaml:"quota_store"` // bbolt file for quota counters
+	Quotas     []Quota `yaml:"quotas"`
+
+	Backend LimiterBackend `yaml:"backend"`
+
+	// Headers selects the rate-limit response headers: "legacy" (default,
+	// X-RateLimit-*), "ietf" (RateLimit/RateLimit-Policy) or "both".
+	Headers string `yaml:"headers"`
+	// DebugHeaders adds X-RateLimit-Source (override, plan, route or global)
+	// to responses.
+	DebugHeaders bool `yaml:"debug_headers"`
+}
+
+// LimiterBackend selects where rate-limit buckets live.
+type LimiterBackend struct {
+	Type        string `yaml:"type"`         // "memory" (default) or "redis"
+	FailureMode string `yaml:"failure_mode"` // "closed" (default, 500) or "open" (allow)
+	Memory      struct {
+		Shards            int `yaml:"shards"`
+		MaxKeys           int `yaml:"max_keys"`            // 0 is unbounded
+		JanitorIntervalMS int `yaml:"janitor_interval_ms"` // idle sweep; default 60000
+	} `yaml:"memory"`
+	Redis struct {
+		Addr          string `yaml:"addr"`    // with cluster, any node
+		Cluster       bool   `yaml:"cluster"` // Redis Cluster instead of a single server
+		Username      string `yaml:"username"`
+		Password      string `yaml:"password"`
+		DB            int    `yaml:"db"`
+		PoolSize      int    `yaml:"pool_size"`
+		MinIdleConns  int    `yaml:"min_idle_conns"`
+		DialTimeoutMS int    `yaml:"dial_timeout_ms"`
+		TimeoutMS     int    `yaml:"timeout_ms"`
+		KeyPrefix     string `yaml:"key_prefix"`
+	} `yaml:"redis"`
+}
+
+// Quota is a calendar-aligned (UTC) allowance, e.g. 10000 calls per month.
+type Quota struct {
+	ID        string           `yaml:"id"`
+	Limit     int64            `yaml:"limit"`
+	Period    string           `yaml:"period"` // "day" or "month"
+	Scope     string           `yaml:"scope"`  // "key" (default) or "key_route"
+	Routes    []string         `yaml:"routes"` // route IDs; empty applies to all
+	Overrides map[string]int64 `yaml:"overrides"`
 }
 
 type RateLimits struct {
-	Default RateLimitPolicy `yaml:"default"`
+	Default   RateLimitPolicy            `yaml:"default"`
 	Overrides map[string]RateLimitPolicy `yaml:"overrides"`
+	KeyBy     []string                   `yaml:"key_by"` // key for default/overrides, e.g. ["key"]
+	Limits    []RouteLimit               `yaml:"limits"` // additional limits, all must pass
 }
 
 type RateLimitPolicy struct {
-	RequestsPerMinute int `yaml:"requests_per_minute"`
-	Burst             int `yaml:"burst"`
+	RequestsPerMinute int    `yaml:"requests_per_minute"`
+	RequestsPerSecond int    `yaml:"requests_per_second"` // used when requests_per_minute is unset
+	Burst             int    `yaml:"burst"`
+	Algorithm         string `yaml:"algorithm"` // token_bucket (default), gcra, sliding_window_log, sliding_window_counter, fixed_window
+	Mode              string `yaml:"mode"`      // "enforce" (default) or "shadow": log and count would-be rejections only
+}
+
+// RouteLimit is an extra limit evaluated alongside the route default.
+type RouteLimit struct {
+	ID              string   `yaml:"id"`
+	KeyBy           []string `yaml:"key_by"` // e.g. ["ip"], ["key","header:X-Tenant"]
+	RateLimitPolicy `yaml:",inline"`
+}
+
+// RPM returns the per-minute rate, converting requests_per_second if needed.
+func (p RateLimitPolicy) RPM() int {
+	if p.RequestsPerMinute > 0 {
+		return p.RequestsPerMinute
+	}
+	return p.RequestsPerSecond * 60
+}
+
+// Plan is a named limit tier; keys select it via metadata.plan.
+type Plan struct {
+	Default RateLimitPolicy            `yaml:"default"`
+	Routes  map[string]RateLimitPolicy `yaml:"routes"` // by route ID
 }
 
 type APIKey struct {
@@ -49,26 +199,80 @@ type Auth struct {
 }
 
 type Routes struct {
-	ID    string `yaml:"id"`
+	ID    string   `yaml:"id"`
+	Tags  []string `yaml:"tags"` // route groups, see Limits.Groups
 	Match struct {
 		PathPrefix string   `yaml:"path_prefix"`
 		Methods    []string `yaml:"methods"`
 	} `yaml:"match"`
 
 	Upstream struct {
-		URL       string `yaml:"url"`
-		TimeoutMS int    `yaml:"timeout_ms"`
+		URL         string `yaml:"url"`
+		TimeoutMS   int    `yaml:"timeout_ms"`
+		MaxInFlight int    `yaml:"max_in_flight"` // across all routes using this host
+		HealthPath  string `yaml:"health_path"`   // probed with GET, e.g. "/healthz"; empty disables
+		Critical    bool   `yaml:"critical"`      // not ready while this route's upstream is unhealthy
 	} `yaml:"upstream"`
 
-	RateLimitPolicy RateLimits `yaml:"rate_limit_policy"`
+	Concurrency struct {
+		MaxInFlight    int `yaml:"max_in_flight"`
+		MaxPerKey      int `yaml:"max_per_key"`
+		QueueSize      int `yaml:"queue_size"`
+		QueueTimeoutMS int `yaml:"queue_timeout_ms"`
+	} `yaml:"concurrency"`
+
+	// Rate-limit cost per request; 1 unless configured.
+	Cost struct {
+		Default        int            `yaml:"default"`
+		Methods        map[string]int `yaml:"methods"`
+		Header         string         `yaml:"header"`          // e.g. "X-Request-Cost"
+		Query          string         `yaml:"query"`           // e.g. "cost"
+		Max            int            `yaml:"max"`             // caps header/query/response costs
+		ResponseHeader string         `yaml:"response_header"` // e.g. "X-Cost", debited after the response
+	} `yaml:"cost"`
+
+	// Adaptive concurrency limit driven by upstream latency (AIMD).
+	Adaptive struct {
+		Enabled            bool    `yaml:"enabled"`
+		MinLimit           int     `yaml:"min_limit"`
+		MaxLimit           int     `yaml:"max_limit"`
+		InitialLimit       int     `yaml:"initial_limit"`
+		LatencyThresholdMS int     `yaml:"latency_threshold_ms"`
+		Backoff            float64 `yaml:"backoff"`
+	} `yaml:"adaptive"`
+
+	RateLimitPolicy RateLimits `yaml:"rate_limits"`
+
+	// OldRateLimitPolicy catches the former name of rate_limits, which
+	// Validate rejects rather than load the route without limits.
+	OldRateLimitPolicy *yaml.Node `yaml:"rate_limit_policy"`
 }
 
 type Root struct {
-	Server        Server        `yaml:"server"`
-	Observability Observability `yaml:"observability"`
-	Auth          Auth          `yaml:"auth"`
-	Limits        Limits        `yaml:"limits"`
-	Routes        []Routes      `yaml:"routes"`
+	Server        Server          `yaml:"server"`
+	Observability Observability   `yaml:"observability"`
+	Auth          Auth            `yaml:"auth"`
+	Limits        Limits          `yaml:"limits"`
+	Plans         map[string]Plan `yaml:"plans"`
+	Admin         Admin           `yaml:"admin"`
+	Health        Health          `yaml:"health"`
+	Routes        []Routes        `yaml:"routes"`
+}
+
+// Health configures upstream probes behind /readyz.
+type Health struct {
+	IntervalMS int `yaml:"interval_ms"` // default 5000
+	TimeoutMS  int `yaml:"timeout_ms"`  // default 1000
+	Failures   int `yaml:"failures"`    // consecutive failures before unhealthy; default 2
+}
+
+// Admin is the private listener for ops, debug and admin endpoints.
+type Admin struct {
+	Addr   string `yaml:"addr"`   // default 127.0.0.1:9090
+	Socket string `yaml:"socket"` // unix socket path; takes precedence over addr
+	Token  string `yaml:"token"`  // bearer token for all but the health probes; may only be empty on loopback or a socket
+
+	AuditLog string `yaml:"audit_log"` // JSON lines trail of admin changes, default ./data/audit.log
 }
 
 func (s Server) ReadTimeout() time.Duration {
@@ -92,6 +296,24 @@ func (s Server) IdleTimeout() time.Duration {
 	return time.Duration(s.IdleTimeoutMS) * time.Millisecond
 }
 
+func (s Server) PreStopDelay() time.Duration {
+	return time.Duration(s.PreStopDelayMS) * time.Millisecond
+}
+
+func (s Server) DrainTimeout() time.Duration {
+	if s.DrainTimeoutMS == 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(s.DrainTimeoutMS) * time.Millisecond
+}
+
+func (s Server) UpgradeTimeout() time.Duration {
+	if s.UpgradeTimeoutMS == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(s.UpgradeTimeoutMS) * time.Millisecond
+}
+
 func (s Server) MaxBody() int64 {
 	if s.MaxBodyBytes == 0 {
 		return 10 << 20
@@ -116,6 +338,12 @@ func Load(path string) (*Root, error) {
 	if cfg.Server.Addr == "" {
 		cfg.Server.Addr = ":8080"
 	}
+	if cfg.Server.RequestIDHeader == "" {
+		cfg.Server.RequestIDHeader = "X-Request-ID"
+	}
+	if cfg.Admin.Addr == "" {
+		cfg.Admin.Addr = "127.0.0.1:9090"
+	}
 	if cfg.Observability.LogLevel == "" {
 		cfg.Observability.LogLevel = "info"
 	}
@@ -128,6 +356,125 @@ func Load(path string) (*Root, error) {
 	if cfg.Limits.Default.Burst <= 0 {
 		cfg.Limits.Default.Burst = 30
 	}
+	if cfg.Limits.Backend.Type == "" {
+		cfg.Limits.Backend.Type = "memory"
+	}
+	if cfg.Limits.Backend.Redis.Addr == "" {
+		cfg.Limits.Backend.Redis.Addr = "localhost:6379"
+	}
+	if cfg.Limits.Backend.Redis.TimeoutMS <= 0 {
+		cfg.Limits.Backend.Redis.TimeoutMS = 100
+	}
+	if cfg.Admin.AuditLog == "" {
+		cfg.Admin.AuditLog = "./data/audit.log"
+	}
+	if cfg.Limits.QuotaStore == "" {
+		cfg.Limits.QuotaStore = "./data/quota.db"
+	}
 
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
+
+// Validate rejects settings that would otherwise be silently ignored or
+// fall back to a default.
+func (r *Root) Validate() error {
+	switch r.Limits.Backend.Type {
+	case "memory", "redis":
+	default:
+		return fmt.Errorf("limits.backend.type: unknown backend %q (want memory or redis)", r.Limits.Backend.Type)
+	}
+	switch r.Limits.Backend.FailureMode {
+	case "", "closed", "open":
+	default:
+		return fmt.Errorf("limits.backend.failure_mode: unknown mode %q (want closed or open)", r.Limits.Backend.FailureMode)
+	}
+
+	for _, rc := range r.Routes {
+		if rc.OldRateLimitPolicy != nil {
+			return fmt.Errorf("routes.%s: rate_limit_policy has been renamed to rate_limits", rc.ID)
+		}
+		rl := rc.RateLimitPolicy
+		if _, err := ratelimit.ParseKeyBy(rl.KeyBy); err != nil {
+			return fmt.Errorf("routes.%s.rate_limits.key_by: %w", rc.ID, err)
+		}
+		for i, lc := range rl.Limits {
+			name := fmt.Sprintf("routes.%s.rate_limits.limits[%d]", rc.ID, i)
+			if _, err := ratelimit.ParseKeyBy(lc.KeyBy); err != nil {
+				return fmt.Errorf("%s.key_by: %w", name, err)
+			}
+			if lc.RPM() <= 0 {
+				return fmt.Errorf("%s: needs a positive rate", name)
+			}
+		}
+	}
+	policies := r.policies()
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := policies[name].validate(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	for i, qc := range r.Limits.Quotas {
+		name := fmt.Sprintf("limits.quotas[%d]", i)
+		if qc.ID == "" || qc.Limit <= 0 {
+			return fmt.Errorf("%s: needs an id and a positive limit", name)
+		}
+		if _, err := quota.ParsePeriod(qc.Period); err != nil {
+			return fmt.Errorf("%s.period: %w", name, err)
+		}
+		switch qc.Scope {
+		case "", "key", "key_route":
+		default:
+			return fmt.Errorf("%s.scope: unknown scope %q (want key or key_route)", name, qc.Scope)
+		}
+	}
+	return nil
+}
+
+// policies lists every rate-limit policy by its path in the config.
+func (r *Root) policies() map[string]RateLimitPolicy {
+	ps := map[string]RateLimitPolicy{
+		"limits.default": r.Limits.Default,
+		"limits.global":  r.Limits.Global,
+	}
+	for tag, p := range r.Limits.Groups {
+		ps["limits.groups."+tag] = p
+	}
+	for name, pl := range r.Plans {
+		ps["plans."+name+".default"] = pl.Default
+		for id, p := range pl.Routes {
+			ps["plans."+name+".routes."+id] = p
+		}
+	}
+	for _, rc := range r.Routes {
+		prefix := "routes." + rc.ID + ".rate_limits."
+		ps[prefix+"default"] = rc.RateLimitPolicy.Default
+		for key, p := range rc.RateLimitPolicy.Overrides {
+			ps[prefix+"overrides."+key] = p
+		}
+		for i, lc := range rc.RateLimitPolicy.Limits {
+			ps[prefix+"limits["+strconv.Itoa(i)+"]"] = lc.RateLimitPolicy
+		}
+	}
+	return ps
+}
+
+func (p RateLimitPolicy) validate() error {
+	if _, err := ratelimit.ParseAlgorithm(p.Algorithm); err != nil {
+		return fmt.Errorf("algorithm: %w", err)
+	}
+	switch p.Mode {
+	case "", "enforce", "shadow":
+	default:
+		return fmt.Errorf("mode: unknown mode %q (want enforce or shadow)", p.Mode)
+	}
+	return nil
+}
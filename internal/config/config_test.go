@@ -0,0 +1,117 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadValidatesFailureMode(t *testing.T) {
+	for mode, wantErr := range map[string]bool{
+		"":       false,
+		"closed": false,
+		"open":   false,
+		"Open":   true,
+		"allow":  true,
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		yml := "limits:\n  backend:\n    failure_mode: \"" + mode + "\"\n"
+		if err := os.WriteFile(path, []byte(yml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load(path)
+		if (err != nil) != wantErr {
+			t.Errorf("failure_mode %q: err = %v, want error %v", mode, err, wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "failure_mode") {
+			t.Errorf("failure_mode %q: error %q does not name the setting", mode, err)
+		}
+	}
+}
+
+func TestLoadValidates(t *testing.T) {
+	for _, tc := range []struct {
+		name, yml, wantErr string
+	}{
+		{"valid", `
+limits:
+  global: {requests_per_minute: 100, algorithm: gcra, mode: shadow}
+  quotas: [{id: monthly, limit: 1000, period: month, scope: key_route}]
+routes:
+  - id: echo
+    rate_limits:
+      default: {requests_per_minute: 60, algorithm: sliding_window_log}
+      key_by: ["key", "header:X-Tenant"]
+      limits: [{key_by: ["ip"], requests_per_second: 5}]
+`, ""},
+		{"renamed key", `
+routes:
+  - id: echo
+    rate_limit_policy:
+      default: {requests_per_minute: 60}
+`, "routes.echo: rate_limit_policy has been renamed to rate_limits"},
+		{"algorithm", `
+limits:
+  groups:
+    search: {requests_per_minute: 10, algorithm: leaky}
+`, "limits.groups.search: algorithm: unknown rate limit algorithm"},
+		{"mode", `
+plans:
+  free:
+    routes:
+      echo: {requests_per_minute: 10, mode: dry_run}
+`, "plans.free.routes.echo: mode: unknown mode"},
+		{"override algorithm", `
+routes:
+  - id: echo
+    rate_limits:
+      overrides:
+        k1: {algorithm: token-bucket}
+`, "routes.echo.rate_limits.overrides.k1: algorithm"},
+		{"key_by", `
+routes:
+  - id: echo
+    rate_limits:
+      key_by: ["cookie:session"]
+`, "routes.echo.rate_limits.key_by"},
+		{"limit key_by", `
+routes:
+  - id: echo
+    rate_limits:
+      limits: [{key_by: ["header:"], requests_per_minute: 5}]
+`, "routes.echo.rate_limits.limits[0].key_by"},
+		{"limit rate", `
+routes:
+  - id: echo
+    rate_limits:
+      limits: [{key_by: ["ip"]}]
+`, "routes.echo.rate_limits.limits[0]: needs a positive rate"},
+		{"quota period", `
+limits:
+  quotas: [{id: q, limit: 10, period: week}]
+`, "limits.quotas[0].period: unknown quota period"},
+		{"quota scope", `
+limits:
+  quotas: [{id: q, limit: 10, period: day, scope: route}]
+`, "limits.quotas[0].scope"},
+		{"quota limit", `
+limits:
+  quotas: [{id: q, period: day}]
+`, "limits.quotas[0]: needs an id and a positive limit"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tc.yml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Load(path)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
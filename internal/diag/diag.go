@@ -0,0 +1,120 @@
+// Package diag serves profiling and runtime diagnostics. Mount it on the
+// admin listener only: profiles expose internals and cost CPU.
+package diag
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	rpprof "runtime/pprof"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/proxy"
+)
+
+type Options struct {
+	Transports     map[string]*proxy.ConnCount // by name, e.g. "upstream"
+	LimiterBuckets func() int                  // nil when the limiter keeps no local state
+}
+
+// Register adds to mux:
+//
+//	/debug/pprof/          net/http/pprof index, profiles and traces
+//	/debug/goroutines      full goroutine dump (text)
+//	/debug/runtime         runtime stats (JSON)
+func Register(mux *http.ServeMux, o Options) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_ = rpprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+
+	mux.HandleFunc("/debug/runtime", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stats(o))
+	})
+}
+
+type transportStats struct {
+	Open   int64 `json:"open"`
+	Dialed int64 `json:"dialed"`
+}
+
+type runtimeStats struct {
+	Goroutines int    `json:"goroutines"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	NumCPU     int    `json:"num_cpu"`
+	GoVersion  string `json:"go_version"`
+
+	Memory struct {
+		HeapAlloc   uint64 `json:"heap_alloc_bytes"`
+		HeapInuse   uint64 `json:"heap_inuse_bytes"`
+		HeapObjects uint64 `json:"heap_objects"`
+		StackInuse  uint64 `json:"stack_inuse_bytes"`
+		Sys         uint64 `json:"sys_bytes"`
+		TotalAlloc  uint64 `json:"total_alloc_bytes"`
+	} `json:"memory"`
+
+	GC struct {
+		NumGC        uint32    `json:"num_gc"`
+		NextGC       uint64    `json:"next_gc_bytes"`
+		Last         time.Time `json:"last_gc"`
+		PauseTotalMS float64   `json:"pause_total_ms"`
+		RecentMS     []float64 `json:"recent_pauses_ms"` // newest first
+		CPUFraction  float64   `json:"cpu_fraction"`
+	} `json:"gc"`
+
+	Transports     map[string]transportStats `json:"transports"`
+	LimiterBuckets *int                      `json:"limiter_buckets,omitempty"`
+}
+
+// stats stops the world briefly (runtime.ReadMemStats); fine for an
+// endpoint polled by hand.
+func stats(o Options) runtimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+
+	var s runtimeStats
+	s.Goroutines = runtime.NumGoroutine()
+	s.GOMAXPROCS = runtime.GOMAXPROCS(0)
+	s.NumCPU = runtime.NumCPU()
+	s.GoVersion = runtime.Version()
+
+	s.Memory.HeapAlloc = ms.HeapAlloc
+	s.Memory.HeapInuse = ms.HeapInuse
+	s.Memory.HeapObjects = ms.HeapObjects
+	s.Memory.StackInuse = ms.StackInuse
+	s.Memory.Sys = ms.Sys
+	s.Memory.TotalAlloc = ms.TotalAlloc
+
+	s.GC.NumGC = ms.NumGC
+	s.GC.NextGC = ms.NextGC
+	s.GC.Last = gc.LastGC
+	s.GC.PauseTotalMS = millis(gc.PauseTotal)
+	s.GC.RecentMS = []float64{}
+	for _, p := range gc.Pause[:min(len(gc.Pause), 10)] {
+		s.GC.RecentMS = append(s.GC.RecentMS, millis(p))
+	}
+	s.GC.CPUFraction = ms.GCCPUFraction
+
+	s.Transports = make(map[string]transportStats, len(o.Transports))
+	for name, c := range o.Transports {
+		s.Transports[name] = transportStats{Open: c.Open(), Dialed: c.Dialed()}
+	}
+	if o.LimiterBuckets != nil {
+		n := o.LimiterBuckets()
+		s.LimiterBuckets = &n
+	}
+	return s
+}
+
+func millis(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
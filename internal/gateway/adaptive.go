@@ -0,0 +1,38 @@
+package gateway
+
+import (
+	"net/http"
+
+	"github.com/AlexKimmel/GateLite/internal/adaptive"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+// Adaptive sheds load with 503 once a route's adaptive concurrency limit is
+// reached. The limits are fed with upstream samples by the proxy.
+func Adaptive(
+	limiters map[string]*adaptive.Limiter,
+	onShed func(routeID string),
+) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rt, _ := routing.RouteFrom(r)
+			if rt == nil || limiters[rt.ID] == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			l := limiters[rt.ID]
+			if !l.TryAcquire() {
+				if onShed != nil {
+					onShed(rt.ID)
+				}
+				w.Header().Set("Retry-After", "1")
+				writeJSON(w, r, http.StatusServiceUnavailable, "overloaded", "Upstream is at capacity, retry later")
+				return
+			}
+			defer l.Release()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
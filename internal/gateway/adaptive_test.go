@@ -0,0 +1,41 @@
+package gateway
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/AlexKimmel/GateLite/internal/adaptive"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+func TestAdaptiveSheds(t *testing.T) {
+	l := adaptive.New(adaptive.Config{InitialLimit: 1})
+	var shed []string
+	next, entered, release := blocking()
+	h := Adaptive(map[string]*adaptive.Limiter{"echo": l}, func(routeID string) { shed = append(shed, routeID) })(next)
+	rt := &routing.Route{ID: "echo"}
+
+	done := make(chan int)
+	go func() { done <- serve(h, request(rt, "k")).Code }()
+	<-entered
+
+	rec := serve(h, request(rt, "k"))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("status %d, Retry-After %q; want 503 with Retry-After 1", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if len(shed) != 1 || shed[0] != "echo" {
+		t.Fatalf("onShed calls %v, want [echo]", shed)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusNoContent {
+		t.Fatalf("admitted request: status %d", code)
+	}
+	// routes without an adaptive limit pass
+	if rec := serve(h, request(&routing.Route{ID: "other"}, "k")); rec.Code != http.StatusNoContent {
+		t.Fatalf("route without a limit: status %d", rec.Code)
+	}
+	if !l.TryAcquire() {
+		t.Fatal("slot not released after the request")
+	}
+}
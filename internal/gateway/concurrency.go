@@ -0,0 +1,102 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/auth"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+// Concurrency scopes reported to onRejected.
+const (
+	ScopeRoute    = "route"
+	ScopeKey      = "key"
+	ScopeUpstream = "upstream"
+)
+
+// Concurrency bounds in-flight requests per route, per key on a route and
+// per upstream target, as configured on the route. Requests over a limit
+// wait in a bounded FIFO queue for up to the route's queue timeout; when the
+// queue is full or the wait times out they get 429 (per-key limit) or 503
+// (route/upstream limit) with Retry-After.
+func Concurrency(
+	onRejected func(routeID, scope string),
+	onInFlight func(routeID string, delta int),
+	onQueued func(routeID string, delta int),
+) Middleware {
+	sems := newSemaphores()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rt, _ := routing.RouteFrom(r)
+			if rt == nil || (rt.MaxInFlight <= 0 && rt.MaxInFlightPerKey <= 0 && rt.MaxInFlightUpstream <= 0) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			keyID, ok := auth.KeyIDFrom(r.Context())
+			if !ok || keyID == "" {
+				keyID = "anon"
+			}
+
+			limits := []struct {
+				scope, key string
+				size       int
+			}{
+				{ScopeKey, "key:" + rt.ID + ":" + keyID, rt.MaxInFlightPerKey},
+				{ScopeRoute, "route:" + rt.ID, rt.MaxInFlight},
+				{ScopeUpstream, "upstream:" + rt.UpUrl.Host, rt.MaxInFlightUpstream},
+			}
+
+			deadline := time.Now().Add(rt.QueueTimeout)
+			var releases []func()
+			defer func() {
+				for _, release := range releases {
+					release()
+				}
+			}()
+
+			var onWait func(int)
+			if onQueued != nil {
+				onWait = func(delta int) { onQueued(rt.ID, delta) }
+			}
+			for _, l := range limits {
+				if l.size <= 0 {
+					continue
+				}
+				release, err := sems.acquire(r.Context(), l.key, l.size, rt.QueueSize, deadline, onWait)
+				if err != nil {
+					if errors.Is(err, r.Context().Err()) {
+						return // client went away while queued
+					}
+					if onRejected != nil {
+						onRejected(rt.ID, l.scope)
+					}
+					w.Header().Set("Retry-After", retryAfter(rt.QueueTimeout))
+					if l.scope == ScopeKey {
+						writeJSON(w, r, http.StatusTooManyRequests, "too_many_concurrent_requests", "Too many concurrent requests for this key")
+					} else {
+						writeJSON(w, r, http.StatusServiceUnavailable, "overloaded", "Too many concurrent requests, retry later")
+					}
+					return
+				}
+				releases = append(releases, release)
+			}
+
+			if onInFlight != nil {
+				onInFlight(rt.ID, 1)
+				defer onInFlight(rt.ID, -1)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// retryAfter renders d as whole seconds, at least 1.
+func retryAfter(d time.Duration) string {
+	sec := int((d + time.Second - 1) / time.Second)
+	return strconv.Itoa(max(sec, 1))
+}
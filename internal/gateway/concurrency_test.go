@@ -0,0 +1,170 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+// blocking returns a handler that holds every request until release is
+// closed, and a channel that receives once per request that got in.
+func blocking() (h http.Handler, entered chan struct{}, release chan struct{}) {
+	entered, release = make(chan struct{}, 16), make(chan struct{})
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return h, entered, release
+}
+
+func concurrencyRoute(id string) *routing.Route {
+	return &routing.Route{ID: id, UpUrl: &url.URL{Scheme: "http", Host: "upstream:9001"}, QueueTimeout: 1500 * time.Millisecond}
+}
+
+func TestConcurrencyRejections(t *testing.T) {
+	for _, tc := range []struct {
+		scope     string
+		set       func(*routing.Route)
+		secondKey string // key of the rejected request
+		code      int
+		errCode   string
+	}{
+		{ScopeKey, func(rt *routing.Route) { rt.MaxInFlightPerKey = 1 }, "k", http.StatusTooManyRequests, "too_many_concurrent_requests"},
+		{ScopeRoute, func(rt *routing.Route) { rt.MaxInFlight = 1 }, "other", http.StatusServiceUnavailable, "overloaded"},
+		{ScopeUpstream, func(rt *routing.Route) { rt.MaxInFlightUpstream = 1 }, "other", http.StatusServiceUnavailable, "overloaded"},
+	} {
+		t.Run(tc.scope, func(t *testing.T) {
+			rt := concurrencyRoute("echo")
+			tc.set(rt)
+			var rejected []string
+			next, entered, release := blocking()
+			h := Concurrency(func(routeID, scope string) { rejected = append(rejected, routeID+"/"+scope) }, nil, nil)(next)
+
+			done := make(chan int)
+			go func() { done <- serve(h, request(rt, "k")).Code }()
+			<-entered
+
+			rec := serve(h, request(rt, tc.secondKey))
+			if rec.Code != tc.code {
+				t.Fatalf("status %d, want %d", rec.Code, tc.code)
+			}
+			want := `{"error":{"code":"` + tc.errCode + `",`
+			if body := rec.Body.String(); len(body) < len(want) || body[:len(want)] != want {
+				t.Fatalf("body %s, want code %s", body, tc.errCode)
+			}
+			if got := rec.Header().Get("Retry-After"); got != "2" {
+				t.Fatalf("Retry-After %q, want 2 (the queue timeout rounded up)", got)
+			}
+			if len(rejected) != 1 || rejected[0] != "echo/"+tc.scope {
+				t.Fatalf("onRejected calls %v, want [echo/%s]", rejected, tc.scope)
+			}
+
+			close(release)
+			if code := <-done; code != http.StatusNoContent {
+				t.Fatalf("first request: status %d, want 204", code)
+			}
+		})
+	}
+}
+
+func TestConcurrencyQueue(t *testing.T) {
+	rt := concurrencyRoute("echo")
+	rt.MaxInFlight, rt.QueueSize, rt.QueueTimeout = 1, 1, time.Minute
+	next, entered, release := blocking()
+	queued := make(chan int, 4)
+	h := Concurrency(nil, nil, func(_ string, delta int) { queued <- delta })(next)
+
+	first := make(chan int)
+	go func() { first <- serve(h, request(rt, "a")).Code }()
+	<-entered
+	second := make(chan int)
+	go func() { second <- serve(h, request(rt, "b")).Code }()
+	if d := <-queued; d != 1 {
+		t.Fatalf("queued delta %d, want 1", d)
+	}
+
+	// the queue holds one
+	if rec := serve(h, request(rt, "c")); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d with the queue full, want 503", rec.Code)
+	}
+
+	release <- struct{}{}
+	if code := <-first; code != http.StatusNoContent {
+		t.Fatalf("first: status %d", code)
+	}
+	<-entered
+	if d := <-queued; d != -1 {
+		t.Fatalf("queued delta %d, want -1", d)
+	}
+	close(release)
+	if code := <-second; code != http.StatusNoContent {
+		t.Fatalf("queued request: status %d, want 204", code)
+	}
+}
+
+func TestConcurrencyReleasesOnPanic(t *testing.T) {
+	rt := concurrencyRoute("echo")
+	rt.MaxInFlight = 1
+	var entered, inFlight int
+	h := Concurrency(nil, func(_ string, delta int) { inFlight += delta }, nil)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		entered++
+		panic(http.ErrAbortHandler)
+	}))
+
+	// with no queue, a leaked slot would turn the next request away
+	for range 3 {
+		func() {
+			defer func() { _ = recover() }()
+			serve(h, request(rt, "k"))
+		}()
+	}
+	if entered != 3 {
+		t.Fatalf("%d of 3 requests got in", entered)
+	}
+	if inFlight != 0 {
+		t.Fatalf("in flight %d after panics, want 0", inFlight)
+	}
+}
+
+func TestConcurrencyReleasesOnCancel(t *testing.T) {
+	rt := concurrencyRoute("echo")
+	rt.MaxInFlight, rt.QueueSize, rt.QueueTimeout = 1, 1, time.Minute
+	next, entered, release := blocking()
+	queued := make(chan int, 4)
+	h := Concurrency(nil, nil, func(_ string, delta int) { queued <- delta })(next)
+
+	first := make(chan int)
+	go func() { first <- serve(h, request(rt, "a")).Code }()
+	<-entered
+
+	// a queued client goes away: nothing is written and it leaves the queue
+	r := request(rt, "b")
+	ctx, cancel := context.WithCancel(r.Context())
+	gone := make(chan int)
+	go func() {
+		rec := serve(h, r.WithContext(ctx))
+		gone <- len(rec.Body.Bytes())
+	}()
+	<-queued
+	cancel()
+	if n := <-gone; n != 0 {
+		t.Fatalf("wrote %d bytes to a client that went away", n)
+	}
+	<-queued
+
+	// so the queue has room again
+	third := make(chan int)
+	go func() { third <- serve(h, request(rt, "c")).Code }()
+	<-queued
+	close(release)
+	for _, c := range []chan int{first, third} {
+		if code := <-c; code != http.StatusNoContent {
+			t.Fatalf("status %d, want 204", code)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+// requestCost returns the tokens a request consumes up front: the static
+// per-method or default cost, raised (never lowered) by a cost declared in
+// the configured header or query parameter, e.g. a bulk page size.
+func requestCost(r *http.Request, rt *routing.Route) int {
+	if rt == nil {
+		return 1
+	}
+	c := rt.Cost
+	cost := max(c.Default, 1)
+	if mc, ok := c.Methods[r.Method]; ok && mc > 0 {
+		cost = mc
+	}
+	if c.Header != "" {
+		cost = max(cost, parseCost(r.Header.Get(c.Header), c.Max))
+	}
+	if c.Query != "" {
+		cost = max(cost, parseCost(r.URL.Query().Get(c.Query), c.Max))
+	}
+	return cost
+}
+
+// parseCost parses a positive integer cost, capped at limit if limit > 0.
+// Anything unparsable counts as 0.
+func parseCost(v string, limit int) int {
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n <= 0 {
+		return 0
+	}
+	if limit > 0 && n > limit {
+		return limit
+	}
+	return n
+}
+
+// costWriter captures and strips the upstream's cost header before the
+// response headers are sent to the client.
+type costWriter struct {
+	http.ResponseWriter
+	header      string
+	cost        int
+	limit       int
+	wroteHeader bool
+}
+
+func (w *costWriter) capture() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.cost = parseCost(w.Header().Get(w.header), w.limit)
+	w.Header().Del(w.header)
+}
+
+func (w *costWriter) WriteHeader(code int) {
+	w.capture()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *costWriter) Write(b []byte) (int, error) {
+	w.capture()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Flush/Hijack on the original.
+func (w *costWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
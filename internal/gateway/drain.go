@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Drain counts in-flight requests, including upgraded connections that
+// http.Server.Shutdown does not wait for, so shutdown can wait for them and
+// report how many completed or were cut off.
+type Drain struct {
+	inFlight  atomic.Int64
+	draining  atomic.Bool
+	completed atomic.Int64 // finished since Start
+}
+
+func (d *Drain) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d.inFlight.Add(1)
+			defer func() {
+				if d.draining.Load() {
+					d.completed.Add(1)
+				}
+				d.inFlight.Add(-1)
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Start begins counting completions. It returns the requests in flight.
+func (d *Drain) Start() int64 {
+	d.draining.Store(true)
+	return d.inFlight.Load()
+}
+
+// Wait blocks until no request is in flight or ctx is done.
+func (d *Drain) Wait(ctx context.Context) error {
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+	for d.inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+func (d *Drain) InFlight() int64  { return d.inFlight.Load() }
+func (d *Drain) Completed() int64 { return d.completed.Load() }
+
+// PreStop marks the process not ready, then waits delay so load balancers
+// stop sending traffic before the listener closes. force cuts the wait
+// short.
+func (d *Drain) PreStop(force context.Context, delay time.Duration, notReady func()) {
+	notReady()
+	select {
+	case <-time.After(delay):
+	case <-force.Done():
+	}
+}
+
+// DrainStats is the outcome of Shutdown.
+type DrainStats struct {
+	InFlight  int64 // when it stopped accepting
+	Completed int64
+	Aborted   int64
+	Forced    bool // the deadline passed or force was done
+}
+
+// Shutdown stops srv accepting and waits up to timeout, or until force is
+// done, for in-flight requests. Past that it calls abort, which should end
+// upgraded connections, and closes srv.
+func (d *Drain) Shutdown(force context.Context, srv *http.Server, timeout time.Duration, abort func()) DrainStats {
+	ctx, cancel := context.WithTimeout(force, timeout)
+	defer cancel()
+
+	st := DrainStats{InFlight: d.Start()}
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		err = d.Wait(ctx)
+	}
+	st.Aborted = d.InFlight()
+	if err != nil {
+		st.Forced = true
+		abort()
+		_ = srv.Close()
+	}
+	st.Completed = d.Completed()
+	return st
+}
@@ -0,0 +1,167 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// drainServer serves h behind d on a loopback port. Cancelling the returned
+// function ends the server's base context, as main does for upgraded
+// connections.
+func drainServer(t *testing.T, d *Drain, h http.Handler) (*http.Server, string, context.CancelFunc) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Handler:     d.Middleware()(h),
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() { cancel(); _ = srv.Close() })
+	return srv, "http://" + ln.Addr().String(), cancel
+}
+
+func TestDrainPreStop(t *testing.T) {
+	var d Drain
+	var notReady atomic.Bool
+	done := make(chan time.Duration)
+	start := time.Now()
+	go func() {
+		d.PreStop(context.Background(), 200*time.Millisecond, func() { notReady.Store(true) })
+		done <- time.Since(start)
+	}()
+
+	// readiness flips before the delay, not after
+	time.Sleep(20 * time.Millisecond)
+	if !notReady.Load() {
+		t.Fatal("still ready during the pre-stop delay")
+	}
+	if took := <-done; took < 200*time.Millisecond {
+		t.Fatalf("pre-stop returned after %v, want the 200ms delay", took)
+	}
+
+	force, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	d.PreStop(force, time.Hour, func() {})
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("forced pre-stop took %v", took)
+	}
+}
+
+func TestDrainShutdown(t *testing.T) {
+	var d Drain
+	next, entered, release := blocking()
+	srv, url, abort := drainServer(t, &d, next)
+
+	res := make(chan error)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		res <- err
+	}()
+	<-entered
+
+	stats := make(chan DrainStats)
+	go func() { stats <- d.Shutdown(context.Background(), srv, 5*time.Second, abort) }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	st := <-stats
+	if err := <-res; err != nil {
+		t.Fatalf("in-flight request: %v", err)
+	}
+	if st != (DrainStats{InFlight: 1, Completed: 1}) {
+		t.Fatalf("stats %+v, want one request completed", st)
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Fatal("still accepting after shutdown")
+	}
+}
+
+// TestDrainForceClose holds an upgraded connection, which
+// http.Server.Shutdown does not wait for, past the deadline.
+func TestDrainForceClose(t *testing.T) {
+	var d Drain
+	hijacked := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"))
+		close(hijacked)
+		<-r.Context().Done()
+	})
+	srv, url, abort := drainServer(t, &d, h)
+
+	conn, err := net.Dial("tcp", url[len("http://"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"))
+	<-hijacked
+
+	var aborted atomic.Bool
+	start := time.Now()
+	st := d.Shutdown(context.Background(), srv, 200*time.Millisecond, func() { aborted.Store(true); abort() })
+	if took := time.Since(start); took < 200*time.Millisecond || took > 2*time.Second {
+		t.Fatalf("shutdown took %v, want about the 200ms deadline", took)
+	}
+	if !aborted.Load() || st != (DrainStats{InFlight: 1, Aborted: 1, Forced: true}) {
+		t.Fatalf("stats %+v, aborted %v; want the upgraded connection cut off", st, aborted.Load())
+	}
+
+	// the handler returns once aborted, closing the connection
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(conn)
+	for {
+		if _, err := br.ReadByte(); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("upgraded connection still open after the forced close")
+			}
+			break
+		}
+	}
+	if err := d.Wait(context.Background()); err != nil || d.InFlight() != 0 {
+		t.Fatalf("in flight %d after the forced close", d.InFlight())
+	}
+}
+
+func TestDrainForce(t *testing.T) {
+	var d Drain
+	next, entered, release := blocking()
+	defer close(release)
+	srv, url, abort := drainServer(t, &d, next)
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-entered
+
+	// a second signal skips the rest of the deadline
+	force, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	st := d.Shutdown(force, srv, time.Hour, abort)
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("forced shutdown took %v", took)
+	}
+	if !st.Forced || st.Aborted != 1 {
+		t.Fatalf("stats %+v, want forced with one aborted", st)
+	}
+}
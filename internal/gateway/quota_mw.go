@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/auth"
+	"github.com/AlexKimmel/GateLite/internal/quota"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+	"github.com/rs/zerolog/hlog"
+)
+
+// Quota enforces long-window quotas after rate limiting. Every applicable
+// quota is charged atomically; the tightest one drives the X-Quota-* headers.
+func Quota(
+	store quota.Store,
+	quotas []quota.Quota,
+	onExceeded func(routeID string),
+	onError func(routeID string),
+) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(quotas) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			keyID, ok := auth.KeyIDFrom(r.Context())
+			if !ok || keyID == "" {
+				keyID = "anon"
+			}
+			routeID := "unknown"
+			if rt, _ := routing.RouteFrom(r); rt != nil && rt.ID != "" {
+				routeID = rt.ID
+			}
+
+			now := time.Now()
+			var (
+				counters []quota.Counter
+				resets   []time.Time
+			)
+			for _, q := range quotas {
+				if !q.AppliesTo(routeID) {
+					continue
+				}
+				key := q.ID + ":" + keyID
+				if q.PerRoute {
+					key += ":" + routeID
+				}
+				start, end := q.Period.Window(now)
+				counters = append(counters, quota.Counter{Key: key, WindowStart: start, Limit: q.LimitFor(keyID)})
+				resets = append(resets, end)
+			}
+			if len(counters) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			used, allowed, err := store.Consume(r.Context(), counters, 1)
+			if errors.Is(err, quota.ErrHandoff) {
+				hlog.FromRequest(r).Debug().Str("route", routeID).Msg("quota store handed off, not counting")
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err != nil {
+				if onError != nil {
+					onError(routeID)
+				}
+				writeJSON(w, r, http.StatusInternalServerError, "quota_error", "internal quota error")
+				return
+			}
+
+			// report the quota with the least remaining
+			tight := 0
+			for i := range counters {
+				if counters[i].Limit-used[i] < counters[tight].Limit-used[tight] {
+					tight = i
+				}
+			}
+			w.Header().Set("X-Quota-Limit", itoa64(counters[tight].Limit))
+			w.Header().Set("X-Quota-Remaining", itoa64(max64(counters[tight].Limit-used[tight], 0)))
+			w.Header().Set("X-Quota-Reset", itoa64(resets[tight].Unix()))
+
+			if !allowed {
+				if onExceeded != nil {
+					onExceeded(routeID)
+				}
+				writeJSON(w, r, http.StatusTooManyRequests, "quota_exceeded", "Quota exceeded")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
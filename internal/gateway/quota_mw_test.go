@@ -0,0 +1,144 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/auth"
+	"github.com/AlexKimmel/GateLite/internal/quota"
+	"github.com/AlexKimmel/GateLite/internal/quota/bolt"
+	"github.com/AlexKimmel/GateLite/internal/reqid"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+// request returns a request that has been through route matching and auth.
+func request(rt *routing.Route, keyID string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/v1/x", nil)
+	ctx := auth.WithKeyID(r.Context(), keyID)
+	ctx = reqid.With(ctx, "req-1")
+	return routing.WithRoute(r.WithContext(ctx), rt)
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+})
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestQuota(t *testing.T) {
+	store, err := bolt.Open(filepath.Join(t.TempDir(), "q.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var exceeded []string
+	quotas := []quota.Quota{
+		{ID: "daily", Limit: 2, Period: quota.Day},
+		{ID: "monthly", Limit: 100, Period: quota.Month},
+	}
+	h := Quota(store, quotas, func(routeID string) { exceeded = append(exceeded, routeID) }, nil)(okHandler)
+	rt := &routing.Route{ID: "echo"}
+	_, reset := quota.Day.Window(time.Now())
+
+	for remaining := 1; remaining >= 0; remaining-- {
+		rec := serve(h, request(rt, "k"))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("status %d, want 204", rec.Code)
+		}
+		// the daily quota is the tighter one
+		for name, want := range map[string]string{
+			"X-Quota-Limit":     "2",
+			"X-Quota-Remaining": fmt.Sprint(remaining),
+			"X-Quota-Reset":     fmt.Sprint(reset.Unix()),
+		} {
+			if got := rec.Header().Get(name); got != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+	}
+
+	rec := serve(h, request(rt, "k"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", rec.Code)
+	}
+	want := `{"error":{"code":"quota_exceeded","message":"Quota exceeded","request_id":"req-1"}}`
+	if body := rec.Body.String(); body != want {
+		t.Fatalf("body %s, want %s", body, want)
+	}
+	if rec.Header().Get("X-Quota-Remaining") != "0" {
+		t.Fatalf("X-Quota-Remaining = %q, want 0", rec.Header().Get("X-Quota-Remaining"))
+	}
+	if fmt.Sprint(exceeded) != "[echo]" {
+		t.Fatalf("onExceeded calls %v, want [echo]", exceeded)
+	}
+
+	// another key has its own counters
+	if rec := serve(h, request(rt, "other")); rec.Code != http.StatusNoContent {
+		t.Fatalf("other key: status %d, want 204", rec.Code)
+	}
+}
+
+func TestQuotaScope(t *testing.T) {
+	store, err := bolt.Open(filepath.Join(t.TempDir(), "q.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	quotas := []quota.Quota{{
+		ID: "daily", Limit: 1, Period: quota.Day, PerRoute: true,
+		Routes: map[string]struct{}{"a": {}, "b": {}},
+	}}
+	h := Quota(store, quotas, nil, nil)(okHandler)
+
+	for _, id := range []string{"a", "b"} {
+		if rec := serve(h, request(&routing.Route{ID: id}, "k")); rec.Code != http.StatusNoContent {
+			t.Fatalf("route %s: status %d, want 204", id, rec.Code)
+		}
+	}
+	if rec := serve(h, request(&routing.Route{ID: "a"}, "k")); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("route a again: status %d, want 429", rec.Code)
+	}
+	// routes the quota does not list are not counted
+	rec := serve(h, request(&routing.Route{ID: "c"}, "k"))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("X-Quota-Limit") != "" {
+		t.Fatalf("route c: status %d, headers %v; want 204 without quota headers", rec.Code, rec.Header())
+	}
+}
+
+type handoffStore struct{}
+
+func (handoffStore) Consume(context.Context, []quota.Counter, int64) ([]int64, bool, error) {
+	return nil, false, fmt.Errorf("released: %w", quota.ErrHandoff)
+}
+
+func (handoffStore) Close() error { return nil }
+
+func TestQuotaHandoff(t *testing.T) {
+	var errs int
+	quotas := []quota.Quota{{ID: "daily", Limit: 1, Period: quota.Day}}
+	h := Quota(handoffStore{}, quotas, nil, func(string) { errs++ })(okHandler)
+
+	for range 3 {
+		rec := serve(h, request(&routing.Route{ID: "echo"}, "k"))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("status %d during a handoff, want 204", rec.Code)
+		}
+		if rec.Header().Get("X-Quota-Limit") != "" {
+			t.Fatal("quota headers set while not counting")
+		}
+	}
+	if errs != 0 {
+		t.Fatalf("onError called %d times for a handoff", errs)
+	}
+}
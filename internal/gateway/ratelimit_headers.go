@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+)
+
+// HeaderFormat selects which rate-limit response headers are sent.
+type HeaderFormat string
+
+const (
+	HeadersLegacy HeaderFormat = "legacy" // X-RateLimit-Limit/-Remaining/-Reset for the strictest limit
+	HeadersIETF   HeaderFormat = "ietf"   // RateLimit-Policy and RateLimit for every limit
+	HeadersBoth   HeaderFormat = "both"
+)
+
+func setLegacyHeaders(h http.Header, dec ratelimit.Decision) {
+	if dec.Limit <= 0 {
+		return
+	}
+	h.Set("X-RateLimit-Limit", itoa(dec.Limit))
+	h.Set("X-RateLimit-Remaining", itoa(max(dec.Remaining, 0)))
+	h.Set("X-RateLimit-Reset", itoa64(dec.ResetUnixSec))
+}
+
+// setIETFHeaders writes the structured-field headers from
+// draft-ietf-httpapi-ratelimit-headers, one list item per limit:
+//
+//	RateLimit-Policy: "route";q=10;w=60, "global";q=600;w=60
+//	RateLimit: "route";r=3;t=12, "global";r=590;t=1
+//
+// t is the seconds until the request would be allowed for exhausted limits,
+// and until the limit is full again otherwise.
+func setIETFHeaders(h http.Header, checks []Bucket, decs []ratelimit.Decision, now time.Time) {
+	window := strconv.Itoa(int(ratelimit.Window / time.Second))
+	var policies, limits []string
+	for i, c := range checks {
+		d := decs[i]
+		if d.Limit <= 0 {
+			continue
+		}
+		name := strconv.Quote(c.Name)
+		t := max(int(d.ResetUnixSec-now.Unix()), 0)
+		if !d.Allowed {
+			t = seconds(d.RetryAfter)
+		}
+		policies = append(policies, name+";q="+itoa(d.Limit)+";w="+window)
+		limits = append(limits, name+";r="+itoa(max(d.Remaining, 0))+";t="+itoa(t))
+	}
+	if len(policies) == 0 {
+		return
+	}
+	h.Set("RateLimit-Policy", strings.Join(policies, ", "))
+	h.Set("RateLimit", strings.Join(limits, ", "))
+}
+
+// seconds rounds d up to whole seconds.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
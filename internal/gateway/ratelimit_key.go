@@ -0,0 +1,100 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/AlexKimmel/GateLite/internal/auth"
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+// limitKey renders kb for the request. Parts are joined with "|"; a part
+// that is absent from the request becomes "-" so it still shares a bucket.
+func limitKey(r *http.Request, rt *routing.Route, kb ratelimit.KeyBy, keyID string) string {
+	if len(kb) == 0 {
+		kb = ratelimit.DefaultKeyBy
+	}
+	parts := make([]string, 0, len(kb))
+	for _, p := range kb {
+		v := keyPart(r, rt, p, keyID)
+		if v == "" {
+			v = "-"
+		}
+		parts = append(parts, v)
+	}
+	return strings.Join(parts, "|")
+}
+
+func keyPart(r *http.Request, rt *routing.Route, p ratelimit.KeyPart, keyID string) string {
+	switch p.Source {
+	case ratelimit.KeyAPIKey:
+		return keyID
+	case ratelimit.KeyIP:
+		return clientIP(r)
+	case ratelimit.KeyHeader:
+		return strings.TrimSpace(r.Header.Get(p.Name))
+	case ratelimit.KeyMeta:
+		md, _ := auth.MetadataFrom(r.Context())
+		return md[p.Name]
+	case ratelimit.KeyClaim:
+		return bearerClaim(r, p.Name)
+	case ratelimit.KeyParam:
+		return pathParam(r.URL.Path, rt, p.Index)
+	}
+	return ""
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// pathParam returns the i-th path segment after the route prefix.
+func pathParam(path string, rt *routing.Route, i int) string {
+	if rt != nil {
+		path = strings.TrimPrefix(path, rt.Prefix)
+	}
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	if i >= len(segs) {
+		return ""
+	}
+	return segs[i]
+}
+
+// bearerClaim reads a claim from the JWT in the Authorization header.
+// The signature is NOT verified: only use claims for bucketing when tokens
+// are validated upstream, otherwise clients can pick their own bucket.
+func bearerClaim(r *http.Request, name string) string {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	segs := strings.Split(strings.TrimSpace(tok), ".")
+	if len(segs) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(segs[1])
+	if err != nil {
+		return ""
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	v, ok := claims[name]
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
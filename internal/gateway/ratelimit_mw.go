@@ -1,30 +1,89 @@
 package gateway
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/AlexKimmel/GateLite/internal/auth"
 	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+	"github.com/AlexKimmel/GateLite/internal/reqid"
 	"github.com/AlexKimmel/GateLite/internal/routing"
+	"github.com/rs/zerolog/hlog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/AlexKimmel/GateLite/internal/gateway")
+
+// Policies are the limits that apply beyond a single route's own limits.
+type Policies struct {
+	Default ratelimit.Policy            // fallback when the route has no default
+	Global  ratelimit.Policy            // per key across all routes; zero disables
+	Groups  map[string]ratelimit.Policy // per key across routes tagged with the group
+	Plans   map[string]Plan             // by name, selected via key metadata "plan"
+
+	FailOpen bool         // allow requests when the limiter errors instead of 500
+	Headers  HeaderFormat // response header style; empty means legacy
+
+	// DebugHeaders adds X-RateLimit-Source, which reveals how a key's limit
+	// was chosen; meant for debugging, not for production clients.
+	DebugHeaders bool
+}
+
+// Plan is a named limit tier with an optional per-route policy.
+type Plan struct {
+	Default ratelimit.Policy
+	Routes  map[string]ratelimit.Policy // by route ID
+}
+
+// Policy sources reported in X-RateLimit-Source and logs.
+const (
+	SourceOverride = "override"
+	SourcePlan     = "plan"
+	SourceRoute    = "route"
+	SourceGlobal   = "global"
+)
+
+// Resolve picks the route policy for a key: key override, then the plan's
+// policy for the route, then the route default, then the global default.
+// It returns the policy and its source.
+func (ps Policies) Resolve(rt *routing.Route, keyID, plan string) (ratelimit.Policy, string) {
+	if rt != nil {
+		if o, ok := rt.LimitOverrides[keyID]; ok && !ratelimit.Unlimited(o) {
+			return o, SourceOverride
+		}
+	}
+	if pl, ok := ps.Plans[plan]; ok {
+		p := pl.Default
+		if rt != nil {
+			if rp, ok := pl.Routes[rt.ID]; ok {
+				p = rp
+			}
+		}
+		if !ratelimit.Unlimited(p) {
+			return p, SourcePlan
+		}
+	}
+	if rt != nil && !ratelimit.Unlimited(rt.LimitDefault) {
+		return rt.LimitDefault, SourceRoute
+	}
+	return ps.Default, SourceGlobal
+}
+
 func RateLimit(
 	lim ratelimit.Limiter,
-	policy ratelimit.Policy,
-	skipPaths map[string]struct{},
-	onLimited func(routeID string),
+	policies Policies,
+	onLimited func(routeID, keyID string),
+	onShadow func(routeID, keyID, limit string),
 	onError func(routeID string),
 ) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// allow ops endpoints without limits
-			if _, ok := skipPaths[r.URL.Path]; ok {
-				next.ServeHTTP(w, r)
-				return
-			}
-
 			// auth key id
 			keyID, ok := auth.KeyIDFrom(r.Context())
 			if !ok || keyID == "" {
@@ -41,56 +100,265 @@ func RateLimit(
 				routeID = rt.ID
 			}
 
-			// limiter key = routeID:keyID (per-route per-key)
-			limKey := keyID
-			if rt != nil && rt.ID != "" {
-				limKey = rt.ID + ":" + keyID
+			// choose policy for this key on this route
+			md, _ := auth.MetadataFrom(r.Context())
+			p, source := policies.Resolve(rt, keyID, md["plan"])
+			if policies.DebugHeaders {
+				w.Header().Set("X-RateLimit-Source", source)
 			}
+			hlog.FromRequest(r).Debug().
+				Str("route", routeID).
+				Str("key_id", keyID).
+				Str("limit_source", source).
+				Int("limit_rpm", p.RPM).
+				Int("limit_burst", p.Burst).
+				Msg("rate limit policy")
 
-			// choose policy: start with global fallback
-			p := policy
+			checks := policies.buckets(rt, keyID, p, func(kb ratelimit.KeyBy) (string, bool) {
+				return limitKey(r, rt, kb, keyID), true
+			})
 
-			// override from route default if present (>0)
-			if rt != nil && rt.LimitDefaultRPM > 0 && rt.LimitDefaultBurst > 0 {
-				p = ratelimit.Policy{RPM: rt.LimitDefaultRPM, Burst: rt.LimitDefaultBurst}
+			// every limit is evaluated; the strictest enforced decision (closest
+			// to exhaustion) wins and drives the response headers. Shadow limits
+			// only report what they would have rejected. A rejected request is
+			// refunded to every bucket that took its cost, so it drains none.
+			cost := requestCost(r, rt)
+			ctx, span := tracer.Start(r.Context(), "ratelimit", trace.WithAttributes(
+				attribute.String("gatelite.ratelimit.source", source),
+				attribute.Int("gatelite.ratelimit.cost", cost),
+				attribute.Int("gatelite.ratelimit.limits", len(checks)),
+			))
+			dec := ratelimit.Decision{Allowed: true}
+			var (
+				enforced []Bucket
+				decs     []ratelimit.Decision
+				tooLarge bool     // some enforced limit can never afford cost
+				taken    []Bucket // buckets that took cost, for refunds
+				took     []ratelimit.Decision
+			)
+			refund := func() {
+				for i, c := range taken {
+					if err := lim.Refund(r.Context(), c.Key, c.Policy, cost, took[i], now); err != nil {
+						if onError != nil {
+							onError(routeID)
+						}
+						hlog.FromRequest(r).Warn().Err(err).Str("route", routeID).Msg("rate limiter refund failed")
+						return
+					}
+				}
 			}
-
-			// optional per-key override on this route
-			if rt != nil && rt.LimitOverrides != nil {
-				if o, ok := rt.LimitOverrides[keyID]; ok && o.RPM > 0 && o.Burst > 0 {
-					p = ratelimit.Policy{RPM: o.RPM, Burst: o.Burst}
+			for _, c := range checks {
+				d, err := lim.Allow(ctx, c.Key, c.Policy, cost, now)
+				if errors.Is(err, ratelimit.ErrCostExceedsCapacity) {
+					// a denial no wait will lift
+					d, err = ratelimit.Decision{Limit: c.Policy.RPM, ResetUnixSec: now.Unix()}, nil
+					tooLarge = tooLarge || !c.Policy.Shadow
+				}
+				if err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, "rate limiter error")
+					span.End()
+					if onError != nil {
+						onError(routeID)
+					}
+					if policies.FailOpen {
+						hlog.FromRequest(r).Warn().Err(err).Str("route", routeID).Msg("rate limiter error, failing open")
+						next.ServeHTTP(w, r)
+						return
+					}
+					refund()
+					writeJSON(w, r, http.StatusInternalServerError, "rate_limiter_error", "internal rate limiter error")
+					return
 				}
+				if d.Allowed {
+					taken = append(taken, c)
+					took = append(took, d)
+				}
+				if c.Policy.Shadow {
+					if !d.Allowed {
+						if onShadow != nil {
+							onShadow(routeID, keyID, c.Name)
+						}
+						hlog.FromRequest(r).Info().
+							Str("route", routeID).
+							Str("key_id", keyID).
+							Str("limit", c.Name).
+							Int("limit_rpm", c.Policy.RPM).
+							Msg("rate limit shadow rejection")
+					}
+					continue
+				}
+				if len(decs) == 0 || stricter(d, dec) {
+					dec = d
+				}
+				enforced = append(enforced, c)
+				decs = append(decs, d)
 			}
+			span.SetAttributes(
+				attribute.Bool("gatelite.ratelimit.allowed", dec.Allowed),
+				attribute.Int("gatelite.ratelimit.remaining", dec.Remaining),
+			)
+			span.End()
 
-			dec, err := lim.Allow(r.Context(), limKey, p, now)
-			if err != nil {
-				if onError != nil {
-					onError(routeID)
+			if tooLarge || !dec.Allowed {
+				refund()
+			}
+
+			// no reset or retry time would be true, so no headers either
+			if tooLarge {
+				if onLimited != nil {
+					onLimited(routeID, keyID)
 				}
-				writeJSON(w, http.StatusInternalServerError, "rate_limiter_error", "internal rate limiter error")
+				writeJSON(w, r, http.StatusTooManyRequests, "cost_exceeds_limit", "Request cost exceeds the rate limit")
 				return
 			}
 
 			// headers for good DX
-			if dec.Limit > 0 {
-				w.Header().Set("X-RateLimit-Limit", itoa(dec.Limit))
-				w.Header().Set("X-RateLimit-Remaining", itoa(max(dec.Remaining, 0)))
-				w.Header().Set("X-RateLimit-Reset", itoa64(dec.ResetUnixSec))
+			switch policies.Headers {
+			case HeadersIETF:
+				setIETFHeaders(w.Header(), enforced, decs, now)
+			case HeadersBoth:
+				setLegacyHeaders(w.Header(), dec)
+				setIETFHeaders(w.Header(), enforced, decs, now)
+			default:
+				setLegacyHeaders(w.Header(), dec)
 			}
 
 			if !dec.Allowed {
 				if onLimited != nil {
-					onLimited(routeID)
+					onLimited(routeID, keyID)
+				}
+				// the request may go through once every exhausted limit allows it
+				var retry time.Duration
+				for _, d := range decs {
+					if !d.Allowed && d.RetryAfter > retry {
+						retry = d.RetryAfter
+					}
 				}
-				writeJSON(w, http.StatusTooManyRequests, "rate_limited", "Too many requests")
+				w.Header().Set("Retry-After", itoa(max(seconds(retry), 1)))
+				writeJSON(w, r, http.StatusTooManyRequests, "rate_limited", "Too many requests")
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			if rt == nil || rt.Cost.ResponseHeader == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// debit whatever the upstream reports beyond the up-front cost
+			cw := &costWriter{ResponseWriter: w, header: rt.Cost.ResponseHeader, limit: rt.Cost.Max}
+			next.ServeHTTP(cw, r)
+			if extra := cw.cost - cost; extra > 0 {
+				for _, c := range checks {
+					if err := lim.Charge(r.Context(), c.Key, c.Policy, extra, time.Now()); err != nil {
+						if onError != nil {
+							onError(routeID)
+						}
+						hlog.FromRequest(r).Warn().Err(err).Str("route", routeID).Msg("rate limiter post-hoc charge failed")
+						break
+					}
+				}
+			}
 		})
 	}
 }
 
+// Bucket is one limiter bucket a request is checked against.
+type Bucket struct {
+	Name   string // policy name in IETF headers
+	Key    string // limiter key
+	Policy ratelimit.Policy
+}
+
+// Buckets lists the buckets keyID is checked against on rt. Limits keyed by
+// anything but the API key (IP, headers, ...) depend on the request and are
+// left out.
+func (ps Policies) Buckets(rt *routing.Route, keyID, plan string) []Bucket {
+	p, _ := ps.Resolve(rt, keyID, plan)
+	return ps.buckets(rt, keyID, p, func(kb ratelimit.KeyBy) (string, bool) {
+		for _, part := range kb {
+			if part.Source != ratelimit.KeyAPIKey {
+				return "", false
+			}
+		}
+		return limitKey(nil, rt, kb, keyID), true
+	})
+}
+
+// buckets builds the checks for keyID on rt with route policy p. keyFor
+// renders a key_by, reporting false to leave its bucket out.
+func (ps Policies) buckets(rt *routing.Route, keyID string, p ratelimit.Policy, keyFor func(ratelimit.KeyBy) (string, bool)) []Bucket {
+	var bs []Bucket
+
+	// limiter key = routeID:<key_by> (per-route, keyed by key ID unless configured)
+	if rt == nil || rt.ID == "" {
+		bs = append(bs, Bucket{Name: "route", Key: keyID, Policy: p})
+	} else {
+		if k, ok := keyFor(rt.LimitKeyBy); ok {
+			bs = append(bs, Bucket{Name: "route", Key: rt.ID + ":" + k, Policy: p})
+		}
+		for _, l := range rt.Limits {
+			if k, ok := keyFor(l.KeyBy); ok {
+				bs = append(bs, Bucket{Name: l.ID, Key: rt.ID + "#" + l.ID + ":" + k, Policy: l.Policy})
+			}
+		}
+	}
+
+	// key-level limits shared across routes
+	if g := ps.Global; !ratelimit.Unlimited(g) {
+		bs = append(bs, Bucket{Name: "global", Key: "global:" + keyID, Policy: g})
+	}
+	if rt != nil {
+		for _, tag := range rt.Tags {
+			if g, ok := ps.Groups[tag]; ok && !ratelimit.Unlimited(g) {
+				bs = append(bs, Bucket{Name: "group-" + tag, Key: "group:" + tag + ":" + keyID, Policy: g})
+			}
+		}
+	}
+	return bs
+}
+
+// Bucket maps a limiter key built by Buckets back to its bucket. A route
+// bucket keyed by anything but the API key gets the route's policy for an
+// unknown key, as the key that filled it is not recorded.
+func (ps Policies) Bucket(routes []*routing.Route, key string, plan func(keyID string) string) (Bucket, bool) {
+	if _, ok := strings.CutPrefix(key, "global:"); ok {
+		g := ps.Global
+		return Bucket{Name: "global", Key: key, Policy: g}, !ratelimit.Unlimited(g)
+	}
+	if rest, ok := strings.CutPrefix(key, "group:"); ok {
+		tag, _, _ := strings.Cut(rest, ":")
+		g, ok := ps.Groups[tag]
+		return Bucket{Name: "group-" + tag, Key: key, Policy: g}, ok
+	}
+	for _, rt := range routes {
+		if rt.ID == "" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(key, rt.ID+"#"); ok {
+			for _, l := range rt.Limits {
+				if strings.HasPrefix(rest, l.ID+":") {
+					return Bucket{Name: l.ID, Key: key, Policy: l.Policy}, true
+				}
+			}
+		}
+		if keyID, ok := strings.CutPrefix(key, rt.ID+":"); ok {
+			p, _ := ps.Resolve(rt, keyID, plan(keyID))
+			return Bucket{Name: "route", Key: key, Policy: p}, true
+		}
+	}
+	return Bucket{}, false
+}
+
+// stricter reports whether a should be reported instead of b:
+// denials win, then whichever has fewer tokens left.
+func stricter(a, b ratelimit.Decision) bool {
+	if a.Allowed != b.Allowed {
+		return !a.Allowed
+	}
+	return a.Remaining < b.Remaining
+}
+
 func itoa(i int) string     { return fmtInt(int64(i)) }
 func itoa64(i int64) string { return fmtInt(i) }
 
@@ -107,8 +375,9 @@ func max(a, b int) int {
 }
 
 // local tiny JSON helper to avoid coupling to auth package
-func writeJSON(w http.ResponseWriter, code int, errCode, msg string) {
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, errCode, msg string) {
+	id, _ := reqid.From(r.Context())
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	_, _ = w.Write([]byte(`{"error":{"code":"` + errCode + `","message":"` + msg + `"}}`))
+	_, _ = w.Write([]byte(`{"error":{"code":"` + errCode + `","message":"` + msg + `","request_id":"` + id + `"}}`))
 }
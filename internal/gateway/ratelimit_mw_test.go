@@ -0,0 +1,102 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+	"github.com/AlexKimmel/GateLite/internal/ratelimit/memory"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+)
+
+func remaining(t *testing.T, lim ratelimit.Limiter, key string, p ratelimit.Policy) int {
+	t.Helper()
+	d, err := lim.Inspect(context.Background(), key, p, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.Remaining
+}
+
+// A request one limit rejects must not drain the others.
+func TestRateLimitRejectionDebitsNothing(t *testing.T) {
+	lim := memory.New(memory.Options{JanitorInterval: -1})
+	defer lim.Close()
+
+	route := ratelimit.Policy{RPM: 60, Burst: 10}
+	shadow := ratelimit.Policy{RPM: 60, Burst: 10, Shadow: true}
+	global := ratelimit.Policy{RPM: 1, Burst: 2}
+	rt := &routing.Route{
+		ID:           "echo",
+		LimitDefault: route,
+		Limits:       []routing.Limit{{ID: "dry", Policy: shadow}},
+	}
+	var limited int
+	h := RateLimit(lim, Policies{Global: global}, func(string, string) { limited++ }, nil, nil)(okHandler)
+
+	for range 2 {
+		if rec := serve(h, request(rt, "k")); rec.Code != http.StatusNoContent {
+			t.Fatalf("status %d, want 204", rec.Code)
+		}
+	}
+	for range 5 {
+		rec := serve(h, request(rt, "k"))
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("status %d past the global limit, want 429", rec.Code)
+		}
+		if rec.Header().Get("Retry-After") == "" {
+			t.Fatal("429 without Retry-After")
+		}
+	}
+	if limited != 5 {
+		t.Fatalf("onLimited called %d times, want 5", limited)
+	}
+
+	// only the two admitted requests count
+	if n := remaining(t, lim, "echo:k", route); n != 8 {
+		t.Fatalf("route bucket has %d left, want 8", n)
+	}
+	if n := remaining(t, lim, "echo#dry:k", shadow); n != 8 {
+		t.Fatalf("shadow bucket has %d left, want 8", n)
+	}
+}
+
+func TestRateLimitCostExceedsLimit(t *testing.T) {
+	lim := memory.New(memory.Options{JanitorInterval: -1})
+	defer lim.Close()
+
+	route := ratelimit.Policy{RPM: 60, Burst: 10}
+	rt := &routing.Route{
+		ID:           "echo",
+		LimitDefault: route,
+		Limits:       []routing.Limit{{ID: "small", Policy: ratelimit.Policy{RPM: 60, Burst: 2}}},
+		Cost:         routing.Cost{Default: 3},
+	}
+	h := RateLimit(lim, Policies{}, nil, nil, nil)(okHandler)
+
+	rec := serve(h, request(rt, "k"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", rec.Code)
+	}
+	want := `{"error":{"code":"cost_exceeds_limit","message":"Request cost exceeds the rate limit","request_id":"req-1"}}`
+	if body := rec.Body.String(); body != want {
+		t.Fatalf("body %s, want %s", body, want)
+	}
+	if rec.Header().Get("Retry-After") != "" || rec.Header().Get("X-RateLimit-Limit") != "" {
+		t.Fatalf("rate-limit headers on a request no wait would admit: %v", rec.Header())
+	}
+	if n := remaining(t, lim, "echo:k", route); n != 10 {
+		t.Fatalf("route bucket has %d left, want 10", n)
+	}
+}
+
+func TestResolveWindowPolicyWithoutBurst(t *testing.T) {
+	window := ratelimit.Policy{RPM: 30, Algorithm: ratelimit.FixedWindow}
+	rt := &routing.Route{ID: "echo", LimitDefault: window}
+	p, source := Policies{Default: ratelimit.Policy{RPM: 60, Burst: 60}}.Resolve(rt, "k", "")
+	if p != window || source != SourceRoute {
+		t.Fatalf("Resolve = %+v from %s, want the route's fixed window", p, source)
+	}
+}
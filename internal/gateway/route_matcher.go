@@ -1,42 +1,35 @@
 package gateway
 
 import (
-	"log"
 	"net/http"
-	"strconv"
-	"strings"
 
 	"github.com/AlexKimmel/GateLite/internal/routing"
+	"github.com/rs/zerolog/hlog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func RouteMatcher(rr *routing.Router, skip map[string]struct{}) Middleware {
+func RouteMatcher(rr *routing.Router) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if _, ok := skip[r.URL.Path]; ok {
-				next.ServeHTTP(w, r)
-				return
-			}
-
 			method := r.Method
 			path := r.URL.Path
 
 			rt, ok := rr.Match(method, path)
 			if !ok {
-				// TEMP DEBUG: show why
-				var prefixes []string
-				for _, x := range rr.Routes() {
-					prefixes = append(prefixes, strconv.Quote(x.Prefix))
-				}
-				log.Printf("RouteMatcher: NO MATCH method=%s path=%q known_prefixes=%s",
-					method, path, strings.Join(prefixes, ","),
-				)
-
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusNotFound)
-				_, _ = w.Write([]byte(`{"error":{"code":"no_route","message":"no matching route"}}`))
+				hlog.FromRequest(r).Debug().
+					Str("method", method).
+					Str("path", path).
+					Msg("no matching route")
+				writeJSON(w, r, http.StatusNotFound, "no_route", "no matching route")
 				return
 			}
 
+			// name the server span after the route, not the raw path
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(method + " " + rt.ID)
+			span.SetAttributes(attribute.String("gatelite.route.id", rt.ID), attribute.String("http.route", rt.Prefix))
+
 			next.ServeHTTP(w, routing.WithRoute(r, rt))
 		})
 	}
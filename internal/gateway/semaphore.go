@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("queue full")
+	errQueueTimeout = errors.New("queue timeout")
+)
+
+// semaphore bounds in-flight requests. Waiters block on the slots channel,
+// which the runtime serves in FIFO order, so queued requests are admitted in
+// arrival order.
+type semaphore struct {
+	slots   chan struct{}
+	waiting int // guarded by semaphores.mu
+	users   int // holders + waiters, guarded by semaphores.mu
+}
+
+// semaphores lazily creates one semaphore per key and drops it once nobody
+// holds or waits on it, so per-key state doesn't accumulate.
+type semaphores struct {
+	mu sync.Mutex
+	m  map[string]*semaphore
+}
+
+func newSemaphores() *semaphores {
+	return &semaphores{m: map[string]*semaphore{}}
+}
+
+// acquire takes a slot of the size-limited semaphore for key, waiting in a
+// queue of at most queue requests until deadline. onWait (optional) is told
+// when the caller starts (+1) and stops (-1) waiting. On success the returned
+// release func must be called exactly once.
+func (ss *semaphores) acquire(ctx context.Context, key string, size, queue int, deadline time.Time, onWait func(delta int)) (func(), error) {
+	ss.mu.Lock()
+	s, ok := ss.m[key]
+	if !ok {
+		s = &semaphore{slots: make(chan struct{}, size)}
+		ss.m[key] = s
+	}
+	s.users++
+	ss.mu.Unlock()
+
+	select {
+	case s.slots <- struct{}{}:
+		return func() { <-s.slots; ss.done(key, s) }, nil
+	default:
+	}
+
+	ss.mu.Lock()
+	if s.waiting >= queue {
+		ss.mu.Unlock()
+		ss.done(key, s)
+		return nil, errQueueFull
+	}
+	s.waiting++
+	ss.mu.Unlock()
+	if onWait != nil {
+		onWait(1)
+		defer onWait(-1)
+	}
+
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+
+	var err error
+	select {
+	case s.slots <- struct{}{}:
+	case <-t.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	ss.mu.Lock()
+	s.waiting--
+	ss.mu.Unlock()
+	if err != nil {
+		ss.done(key, s)
+		return nil, err
+	}
+	return func() { <-s.slots; ss.done(key, s) }, nil
+}
+
+func (ss *semaphores) done(key string, s *semaphore) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s.users--
+	if s.users == 0 && ss.m[key] == s {
+		delete(ss.m, key)
+	}
+}
@@ -0,0 +1,146 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func (ss *semaphores) len() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.m)
+}
+
+func TestSemaphoreFIFO(t *testing.T) {
+	ss := newSemaphores()
+	ctx := context.Background()
+	deadline := time.Now().Add(time.Minute)
+
+	release, err := ss.acquire(ctx, "k", 1, 10, deadline, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i := range 5 {
+		queued := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rel, err := ss.acquire(ctx, "k", 1, 10, deadline, func(delta int) {
+				if delta > 0 {
+					close(queued)
+				}
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			rel()
+		}()
+		// queue the next waiter only once this one is waiting
+		<-queued
+	}
+
+	release()
+	wg.Wait()
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("admitted in order %v, want arrival order", order)
+		}
+	}
+	if n := ss.len(); n != 0 {
+		t.Fatalf("%d semaphores left after every release, want 0", n)
+	}
+}
+
+func TestSemaphoreQueueFull(t *testing.T) {
+	ss := newSemaphores()
+	ctx := context.Background()
+	deadline := time.Now().Add(time.Minute)
+
+	release, err := ss.acquire(ctx, "k", 1, 0, deadline, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.acquire(ctx, "k", 1, 0, deadline, nil); !errors.Is(err, errQueueFull) {
+		t.Fatalf("err = %v, want errQueueFull", err)
+	}
+	// other keys are independent
+	rel, err := ss.acquire(ctx, "other", 1, 0, deadline, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel()
+	release()
+	if n := ss.len(); n != 0 {
+		t.Fatalf("%d semaphores left, want 0", n)
+	}
+}
+
+func TestSemaphoreTimeout(t *testing.T) {
+	ss := newSemaphores()
+	ctx := context.Background()
+
+	release, err := ss.acquire(ctx, "k", 1, 1, time.Now().Add(time.Minute), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	var waits []int
+	begin := time.Now()
+	_, err = ss.acquire(ctx, "k", 1, 1, begin.Add(20*time.Millisecond), func(delta int) { waits = append(waits, delta) })
+	if !errors.Is(err, errQueueTimeout) {
+		t.Fatalf("err = %v, want errQueueTimeout", err)
+	}
+	if waited := time.Since(begin); waited < 20*time.Millisecond {
+		t.Fatalf("gave up after %v, before the deadline", waited)
+	}
+	if len(waits) != 2 || waits[0] != 1 || waits[1] != -1 {
+		t.Fatalf("onWait calls %v, want [1 -1]", waits)
+	}
+}
+
+func TestSemaphoreCancel(t *testing.T) {
+	ss := newSemaphores()
+	release, err := ss.acquire(context.Background(), "k", 1, 1, time.Now().Add(time.Minute), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := ss.acquire(ctx, "k", 1, 1, time.Now().Add(time.Minute), func(delta int) {
+			if delta > 0 {
+				cancel()
+			}
+		})
+		errc <- err
+	}()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+
+	// the cancelled waiter gave its queue place back
+	release()
+	rel, err := ss.acquire(context.Background(), "k", 1, 0, time.Now().Add(time.Minute), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel()
+	if n := ss.len(); n != 0 {
+		t.Fatalf("%d semaphores left, want 0", n)
+	}
+}
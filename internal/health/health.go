@@ -0,0 +1,219 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lifecycle states reported by /readyz.
+const (
+	StateStarting = "starting"
+	StateReady    = "ready"
+	StateDraining = "draining"
+)
+
+// Upstream status per route.
+const (
+	StatusHealthy   = "healthy"
+	StatusUnhealthy = "unhealthy"
+	StatusUnchecked = "unchecked" // no health path configured
+)
+
+type Options struct {
+	Interval time.Duration // between probe rounds; default 5s
+	Timeout  time.Duration // per probe; default 1s
+	Failures int           // consecutive failures before unhealthy; default 2
+}
+
+// Target is a route's upstream. URL is probed with GET and counts as
+// healthy on 2xx/3xx; an empty URL leaves the route unchecked.
+type Target struct {
+	RouteID  string
+	URL      string
+	Critical bool // unhealthy makes the gateway not ready
+}
+
+type target struct {
+	Target
+
+	mu        sync.Mutex
+	status    string
+	failures  int
+	lastErr   string
+	lastCheck time.Time
+}
+
+// Checker tracks the gateway lifecycle and probes upstreams.
+type Checker struct {
+	opts    Options
+	client  *http.Client
+	state   atomic.Value // string
+	targets []*target
+}
+
+func New(o Options, targets []Target) *Checker {
+	if o.Interval <= 0 {
+		o.Interval = 5 * time.Second
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Second
+	}
+	if o.Failures <= 0 {
+		o.Failures = 2
+	}
+	c := &Checker{opts: o, client: &http.Client{Timeout: o.Timeout}}
+	c.state.Store(StateStarting)
+	for _, t := range targets {
+		st := StatusUnchecked
+		if t.URL != "" {
+			// not known to be healthy until the first probe says so
+			st = StatusUnhealthy
+		}
+		c.targets = append(c.targets, &target{Target: t, status: st})
+	}
+	return c
+}
+
+// Start runs one probe round, then keeps probing until ctx is done.
+func (c *Checker) Start(ctx context.Context) {
+	c.probeAll(ctx)
+	go func() {
+		t := time.NewTicker(c.opts.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				c.probeAll(ctx)
+			}
+		}
+	}()
+}
+
+func (c *Checker) SetReady()    { c.state.Store(StateReady) }
+func (c *Checker) SetDraining() { c.state.Store(StateDraining) }
+
+// Ready reports whether the gateway is ready and every critical route has a
+// healthy upstream.
+func (c *Checker) Ready() bool {
+	if c.state.Load() != StateReady {
+		return false
+	}
+	for _, t := range c.targets {
+		t.mu.Lock()
+		down := t.Critical && t.status == StatusUnhealthy
+		t.mu.Unlock()
+		if down {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Checker) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range c.targets {
+		if t.URL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.probe(ctx, t)
+		}()
+	}
+	wg.Wait()
+}
+
+func (c *Checker) probe(ctx context.Context, t *target) {
+	err := c.get(ctx, t.URL)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastCheck = time.Now()
+	if err == nil {
+		t.status, t.failures, t.lastErr = StatusHealthy, 0, ""
+		return
+	}
+	t.failures++
+	t.lastErr = err.Error()
+	if t.failures >= c.opts.Failures {
+		t.status = StatusUnhealthy
+	}
+}
+
+func (c *Checker) get(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Livez reports that the process is up and serving.
+func (c *Checker) Livez(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+}
+
+type routeStatus struct {
+	Route     string `json:"route"`
+	Critical  bool   `json:"critical"`
+	Upstream  string `json:"upstream,omitempty"`
+	Status    string `json:"status"`
+	Failures  int    `json:"consecutive_failures,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	LastCheck string `json:"last_check,omitempty"`
+}
+
+// Readyz reports readiness with per-route upstream status: 200 when ready,
+// 503 otherwise.
+func (c *Checker) Readyz(w http.ResponseWriter, _ *http.Request) {
+	routes := make([]routeStatus, 0, len(c.targets))
+	for _, t := range c.targets {
+		t.mu.Lock()
+		rs := routeStatus{
+			Route:     t.RouteID,
+			Critical:  t.Critical,
+			Upstream:  t.URL,
+			Status:    t.status,
+			Failures:  t.failures,
+			LastError: t.lastErr,
+		}
+		if !t.lastCheck.IsZero() {
+			rs.LastCheck = t.lastCheck.UTC().Format(time.RFC3339)
+		}
+		t.mu.Unlock()
+		routes = append(routes, rs)
+	}
+
+	status, code := "ready", http.StatusOK
+	if !c.Ready() {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]any{
+		"status": status,
+		"state":  c.state.Load(),
+		"routes": routes,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,197 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstream answers its health probes with the code in status.
+func upstream(t *testing.T) (url string, status *atomic.Int32) {
+	t.Helper()
+	status = new(atomic.Int32)
+	status.Store(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/healthz", status
+}
+
+type readyz struct {
+	Status string
+	State  string
+	Routes []routeStatus
+}
+
+func get(t *testing.T, h http.HandlerFunc) (int, readyz) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/", nil))
+	var body readyz
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v in %s", err, rec.Body)
+	}
+	return rec.Code, body
+}
+
+func (c *Checker) route(id string) routeStatus {
+	for _, t := range c.targets {
+		if t.RouteID == id {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			return routeStatus{Route: id, Status: t.status, Failures: t.failures, LastError: t.lastErr}
+		}
+	}
+	return routeStatus{}
+}
+
+func TestFailureThreshold(t *testing.T) {
+	url, status := upstream(t)
+	c := New(Options{Failures: 3}, []Target{{RouteID: "echo", URL: url, Critical: true}})
+	c.SetReady()
+	ctx := context.Background()
+	c.probeAll(ctx)
+
+	status.Store(http.StatusInternalServerError)
+	for i := 1; i < 3; i++ {
+		c.probeAll(ctx)
+		if rs := c.route("echo"); rs.Status != StatusHealthy || rs.Failures != i {
+			t.Fatalf("after %d failures: %+v, want still healthy", i, rs)
+		}
+		if !c.Ready() {
+			t.Fatalf("not ready after %d failures", i)
+		}
+	}
+	c.probeAll(ctx)
+	if rs := c.route("echo"); rs.Status != StatusUnhealthy || rs.LastError != "health check returned 500" {
+		t.Fatalf("after 3 failures: %+v, want unhealthy with the error", rs)
+	}
+	if c.Ready() {
+		t.Fatal("ready with a critical route down")
+	}
+
+	// one success is enough to come back
+	status.Store(http.StatusNoContent)
+	c.probeAll(ctx)
+	if rs := c.route("echo"); rs.Status != StatusHealthy || rs.Failures != 0 || rs.LastError != "" {
+		t.Fatalf("after recovering: %+v", rs)
+	}
+	if !c.Ready() {
+		t.Fatal("not ready after recovering")
+	}
+}
+
+func TestCriticalUntilFirstProbe(t *testing.T) {
+	url, status := upstream(t)
+	status.Store(http.StatusServiceUnavailable)
+	c := New(Options{Interval: time.Hour}, []Target{
+		{RouteID: "echo", URL: url, Critical: true},
+		{RouteID: "static"}, // no health path
+	})
+	c.SetReady()
+	if c.Ready() {
+		t.Fatal("ready before the critical route was ever probed")
+	}
+	if rs := c.route("static"); rs.Status != StatusUnchecked {
+		t.Fatalf("route without a health path: %s, want unchecked", rs.Status)
+	}
+
+	// a failing first probe below the threshold does not make it healthy
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.Start(ctx)
+	if rs := c.route("echo"); rs.Status != StatusUnhealthy || rs.Failures != 1 {
+		t.Fatalf("after a failed first probe: %+v, want unhealthy", rs)
+	}
+
+	status.Store(http.StatusOK)
+	c.probeAll(ctx)
+	if !c.Ready() {
+		t.Fatal("not ready after the first successful probe")
+	}
+}
+
+func TestNonCriticalRoute(t *testing.T) {
+	url, status := upstream(t)
+	status.Store(http.StatusBadGateway)
+	c := New(Options{Failures: 1}, []Target{{RouteID: "echo", URL: url}})
+	c.SetReady()
+	c.probeAll(context.Background())
+	if rs := c.route("echo"); rs.Status != StatusUnhealthy {
+		t.Fatalf("status %s, want unhealthy", rs.Status)
+	}
+	if !c.Ready() {
+		t.Fatal("a non-critical route made the gateway not ready")
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	c := New(Options{}, nil)
+	for _, tc := range []struct {
+		set   func()
+		state string
+		ready bool
+	}{
+		{func() {}, StateStarting, false},
+		{c.SetReady, StateReady, true},
+		{c.SetDraining, StateDraining, false},
+	} {
+		tc.set()
+		code, body := get(t, c.Readyz)
+		if body.State != tc.state || c.Ready() != tc.ready {
+			t.Fatalf("state %s ready %v, want %s %v", body.State, c.Ready(), tc.state, tc.ready)
+		}
+		want := http.StatusServiceUnavailable
+		if tc.ready {
+			want = http.StatusOK
+		}
+		if code != want {
+			t.Fatalf("%s: /readyz %d, want %d", tc.state, code, want)
+		}
+		// liveness does not depend on the lifecycle
+		rec := httptest.NewRecorder()
+		c.Livez(rec, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: /livez %d", tc.state, rec.Code)
+		}
+	}
+}
+
+func TestReadyzBody(t *testing.T) {
+	url, status := upstream(t)
+	status.Store(http.StatusInternalServerError)
+	c := New(Options{Failures: 1}, []Target{
+		{RouteID: "echo", URL: url, Critical: true},
+		{RouteID: "static"},
+	})
+	c.SetReady()
+	c.probeAll(context.Background())
+
+	code, body := get(t, c.Readyz)
+	if code != http.StatusServiceUnavailable || body.Status != "not_ready" || body.State != StateReady {
+		t.Fatalf("/readyz %d %+v, want 503 not_ready in state ready", code, body)
+	}
+	if len(body.Routes) != 2 {
+		t.Fatalf("routes %+v, want echo and static", body.Routes)
+	}
+	echo, static := body.Routes[0], body.Routes[1]
+	if echo.Route != "echo" || !echo.Critical || echo.Upstream != url || echo.Status != StatusUnhealthy ||
+		echo.Failures != 1 || echo.LastError == "" || echo.LastCheck == "" {
+		t.Fatalf("echo %+v", echo)
+	}
+	if static.Route != "static" || static.Status != StatusUnchecked || static.LastCheck != "" {
+		t.Fatalf("static %+v", static)
+	}
+
+	// /livez reports the process only, not the routes
+	rec := httptest.NewRecorder()
+	c.Livez(rec, nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"status\":\"alive\"}\n" {
+		t.Fatalf("/livez %d %s", rec.Code, rec.Body)
+	}
+}
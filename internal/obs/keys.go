@@ -0,0 +1,155 @@
+package obs
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AlexKimmel/GateLite/internal/auth"
+	"github.com/AlexKimmel/GateLite/internal/gateway"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OtherKey is the label value keys fold into once the label budget is spent.
+const OtherKey = "other"
+
+// keyLabels bounds the number of distinct key label values: the first max
+// keys seen get their own series, later ones share OtherKey. Allow-listed
+// keys are always tracked and do not count against max.
+type keyLabels struct {
+	max    int
+	always map[string]struct{}
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newKeyLabels(max int, always []string) *keyLabels {
+	k := &keyLabels{
+		max:    max,
+		always: make(map[string]struct{}, len(always)),
+		seen:   make(map[string]struct{}),
+	}
+	for _, id := range always {
+		k.always[id] = struct{}{}
+	}
+	return k
+}
+
+func (k *keyLabels) label(id string) string {
+	if _, ok := k.always[id]; ok {
+		return id
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.seen[id]; ok {
+		return id
+	}
+	if len(k.seen) >= k.max {
+		return OtherKey
+	}
+	k.seen[id] = struct{}{}
+	return id
+}
+
+// KeyLabel returns the metric label for an API key ID, folding keys past
+// the cardinality budget into OtherKey.
+func (m *Metrics) KeyLabel(id string) string { return m.keys.label(id) }
+
+// ObserveKeyLimited counts a rate-limited request for the key, if per-key
+// metrics are enabled.
+func (m *Metrics) ObserveKeyLimited(routeID, keyID string) {
+	if m.KeyRateLimited != nil {
+		m.KeyRateLimited.WithLabelValues(m.KeyLabel(keyID), routeID).Inc()
+	}
+}
+
+func (m *Metrics) registerKeyMetrics() {
+	m.KeyRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gatelite_key_requests_total",
+			Help: "Total requests per API key",
+		},
+		[]string{"key", "route", "code"},
+	)
+	m.KeyErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gatelite_key_errors_total",
+			Help: "Total requests per API key answered with a 5xx status",
+		},
+		[]string{"key", "route"},
+	)
+	m.KeyRateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gatelite_key_rate_limited_total",
+			Help: "Total requests per API key rejected due to rate limiting",
+		},
+		[]string{"key", "route"},
+	)
+	m.KeyBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gatelite_key_bytes_total",
+			Help: "Total body bytes per API key, by direction (in, out)",
+		},
+		[]string{"key", "route", "direction"},
+	)
+	m.reg.MustRegister(m.KeyRequests, m.KeyErrors, m.KeyRateLimited, m.KeyBytes)
+}
+
+// KeyMiddleware records per-key metrics. It must run after auth; requests
+// without a key are not counted. A no-op unless per-key metrics are enabled.
+func (m *Metrics) KeyMiddleware() gateway.Middleware {
+	return func(next http.Handler) http.Handler {
+		if m.KeyRequests == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			keyID, ok := auth.KeyIDFrom(r.Context())
+			if !ok || keyID == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &statusRecorder{ResponseWriter: w}
+			in := &countingReader{ReadCloser: r.Body}
+			if r.Body != nil {
+				r.Body = in
+			}
+
+			next.ServeHTTP(rec, r)
+
+			route := "unknown"
+			if rt, ok := routing.RouteFrom(r); ok && rt != nil && rt.ID != "" {
+				route = rt.ID
+			}
+			code := rec.status
+			if code == 0 {
+				code = http.StatusOK
+			}
+
+			key := m.KeyLabel(keyID)
+			m.KeyRequests.WithLabelValues(key, route, strconv.Itoa(code)).Inc()
+			if code >= 500 {
+				m.KeyErrors.WithLabelValues(key, route).Inc()
+			}
+			m.KeyBytes.WithLabelValues(key, route, "in").Add(float64(in.n.Load()))
+			m.KeyBytes.WithLabelValues(key, route, "out").Add(float64(rec.bytes))
+		})
+	}
+}
+
+// countingReader counts request body bytes. The upstream transport reads
+// on its own goroutine, possibly still after the handler returned.
+type countingReader struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
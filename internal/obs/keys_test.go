@@ -0,0 +1,86 @@
+package obs
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/AlexKimmel/GateLite/internal/auth"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestKeyLabels(t *testing.T) {
+	k := newKeyLabels(2, []string{"vip"})
+	for _, tc := range []struct{ id, want string }{
+		{"a", "a"},
+		{"vip", "vip"}, // allow-listed keys do not use up the budget
+		{"b", "b"},
+		{"c", OtherKey}, // over budget
+		{"a", "a"},      // keys already seen keep their label
+		{"vip", "vip"},
+		{"d", OtherKey},
+		{"c", OtherKey}, // a folded key stays folded
+	} {
+		if got := k.label(tc.id); got != tc.want {
+			t.Fatalf("label(%q) = %q, want %q", tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestKeyLabelsConcurrent(t *testing.T) {
+	k := newKeyLabels(10, nil)
+	var wg sync.WaitGroup
+	labels := make([]string, 100)
+	for i := range labels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			labels[i] = k.label(fmt.Sprintf("k%d", i))
+		}()
+	}
+	wg.Wait()
+	own := 0
+	for i, l := range labels {
+		if l != OtherKey {
+			if l != fmt.Sprintf("k%d", i) {
+				t.Fatalf("key k%d labelled %q", i, l)
+			}
+			own++
+		}
+	}
+	if own != 10 {
+		t.Fatalf("%d keys got their own label, want 10", own)
+	}
+}
+
+func TestKeyMiddlewareCardinality(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg, MetricsOptions{KeyMetrics: true, MaxKeys: 2, AlwaysKeys: []string{"vip"}})
+	h := m.KeyMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rt := &routing.Route{ID: "echo"}
+	for _, id := range []string{"a", "b", "c", "d", "vip", "a", ""} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if id != "" {
+			r = r.WithContext(auth.WithKeyID(r.Context(), id))
+		}
+		h.ServeHTTP(httptest.NewRecorder(), routing.WithRoute(r, rt))
+	}
+	m.ObserveKeyLimited("echo", "e")
+
+	for key, want := range map[string]float64{"a": 2, "b": 1, OtherKey: 2, "vip": 1} {
+		if got := testutil.ToFloat64(m.KeyRequests.WithLabelValues(key, "echo", "200")); got != want {
+			t.Errorf("requests for %q: %v, want %v", key, got, want)
+		}
+	}
+	// a, b, other and vip; the request without a key is not counted
+	if n := testutil.CollectAndCount(m.KeyRequests); n != 4 {
+		t.Fatalf("%d request series, want 4", n)
+	}
+	if got := testutil.ToFloat64(m.KeyRateLimited.WithLabelValues(OtherKey, "echo")); got != 1 {
+		t.Fatalf("rate limited for other: %v, want 1", got)
+	}
+}
@@ -6,19 +6,72 @@ import (
 	"time"
 
 	"github.com/AlexKimmel/GateLite/internal/gateway"
+	"github.com/AlexKimmel/GateLite/internal/proxy"
 	"github.com/AlexKimmel/GateLite/internal/routing"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Metrics struct {
+	reg  prometheus.Registerer
+	keys *keyLabels
+
 	RequestsTotal   *prometheus.CounterVec
 	RequestDuration *prometheus.HistogramVec
 	RateLimited     *prometheus.CounterVec
 	LimiterErrors   *prometheus.CounterVec
+	ShadowLimited   *prometheus.CounterVec
+	QuotaExceeded   *prometheus.CounterVec
+	QuotaErrors     *prometheus.CounterVec
+
+	LimiterEvictions *prometheus.CounterVec
+
+	InFlight            *prometheus.GaugeVec
+	Queued              *prometheus.GaugeVec
+	ConcurrencyRejected *prometheus.CounterVec
+
+	AdaptiveLimit *prometheus.GaugeVec
+	AdaptiveShed  *prometheus.CounterVec
+
+	UpstreamLatency      *prometheus.HistogramVec
+	UpstreamTTFB         *prometheus.HistogramVec
+	UpstreamResponses    *prometheus.CounterVec
+	UpstreamErrors       *prometheus.CounterVec
+	UpstreamRequestSize  *prometheus.HistogramVec
+	UpstreamResponseSize *prometheus.HistogramVec
+	UpstreamInFlight     *prometheus.GaugeVec
+
+	// per API key; nil unless MetricsOptions.KeyMetrics
+	KeyRequests    *prometheus.CounterVec
+	KeyErrors      *prometheus.CounterVec
+	KeyRateLimited *prometheus.CounterVec
+	KeyBytes       *prometheus.CounterVec
 }
 
-func NewMetrics(reg prometheus.Registerer) *Metrics {
+// MetricsOptions sets histogram buckets; nil keeps the defaults.
+type MetricsOptions struct {
+	LatencyBuckets []float64 // seconds; default prometheus.DefBuckets
+	SizeBuckets    []float64 // bytes; default 256B to 4MiB in powers of 4
+
+	// Key labels (per-key metrics and shadow rejections) are capped at
+	// MaxKeys distinct values, default 100; AlwaysKeys are exempt.
+	KeyMetrics bool
+	MaxKeys    int
+	AlwaysKeys []string
+}
+
+func NewMetrics(reg prometheus.Registerer, o MetricsOptions) *Metrics {
+	if len(o.LatencyBuckets) == 0 {
+		o.LatencyBuckets = prometheus.DefBuckets
+	}
+	if len(o.SizeBuckets) == 0 {
+		o.SizeBuckets = prometheus.ExponentialBuckets(256, 4, 8)
+	}
+	if o.MaxKeys <= 0 {
+		o.MaxKeys = 100
+	}
 	m := &Metrics{
+		reg:  reg,
+		keys: newKeyLabels(o.MaxKeys, o.AlwaysKeys),
 		RequestsTotal: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "gatelite_requests_total",
@@ -30,7 +83,7 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			prometheus.HistogramOpts{
 				Name:    "gatelite_request_duration_seconds",
 				Help:    "Request duration in seconds",
-				Buckets: prometheus.DefBuckets,
+				Buckets: o.LatencyBuckets,
 			},
 			[]string{"route", "method"},
 		),
@@ -48,12 +101,168 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			},
 			[]string{"route"},
 		),
+		ShadowLimited: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gatelite_rate_limit_shadow_rejections_total",
+				Help: "Total requests a shadow-mode limit would have rejected",
+			},
+			[]string{"route", "key", "limit"},
+		),
+		QuotaExceeded: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gatelite_quota_exceeded_total",
+				Help: "Total requests rejected due to exhausted quotas",
+			},
+			[]string{"route"},
+		),
+		QuotaErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gatelite_quota_errors_total",
+				Help: "Total quota store errors",
+			},
+			[]string{"route"},
+		),
+		LimiterEvictions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gatelite_limiter_evictions_total",
+				Help: "Total in-memory rate limit buckets evicted, by reason (idle, capacity)",
+			},
+			[]string{"reason"},
+		),
+		InFlight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "gatelite_in_flight_requests",
+				Help: "Requests currently admitted past the concurrency limiter",
+			},
+			[]string{"route"},
+		),
+		Queued: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "gatelite_queued_requests",
+				Help: "Requests currently waiting for a concurrency slot",
+			},
+			[]string{"route"},
+		),
+		ConcurrencyRejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gatelite_concurrency_rejected_total",
+				Help: "Total requests rejected by concurrency limits, by scope (route, key, upstream)",
+			},
+			[]string{"route", "scope"},
+		),
+		AdaptiveLimit: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "gatelite_adaptive_concurrency_limit",
+				Help: "Current adaptive in-flight limit per route",
+			},
+			[]string{"route"},
+		),
+		AdaptiveShed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gatelite_adaptive_shed_total",
+				Help: "Total requests shed by the adaptive concurrency limit",
+			},
+			[]string{"route"},
+		),
+		UpstreamLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "gatelite_upstream_latency_seconds",
+				Help:    "Upstream exchange duration in seconds, including the response body",
+				Buckets: o.LatencyBuckets,
+			},
+			[]string{"route", "target"},
+		),
+		UpstreamTTFB: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "gatelite_upstream_ttfb_seconds",
+				Help:    "Time until the first upstream response byte in seconds",
+				Buckets: o.LatencyBuckets,
+			},
+			[]string{"route", "target"},
+		),
+		UpstreamResponses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gatelite_upstream_responses_total",
+				Help: "Total upstream responses by status code",
+			},
+			[]string{"route", "target", "code"},
+		),
+		UpstreamErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "gatelite_upstream_errors_total",
+				Help: "Total failed upstream exchanges, by class (dial, tls, timeout, reset, canceled, other)",
+			},
+			[]string{"route", "target", "class"},
+		),
+		UpstreamRequestSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "gatelite_upstream_request_size_bytes",
+				Help:    "Request body bytes sent upstream",
+				Buckets: o.SizeBuckets,
+			},
+			[]string{"route", "target"},
+		),
+		UpstreamResponseSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "gatelite_upstream_response_size_bytes",
+				Help:    "Response body bytes received from upstream",
+				Buckets: o.SizeBuckets,
+			},
+			[]string{"route", "target"},
+		),
+		UpstreamInFlight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "gatelite_upstream_in_flight_requests",
+				Help: "Upstream exchanges currently in progress",
+			},
+			[]string{"route", "target"},
+		),
 	}
 
-	reg.MustRegister(m.RequestsTotal, m.RequestDuration, m.RateLimited, m.LimiterErrors)
+	reg.MustRegister(m.RequestsTotal, m.RequestDuration, m.RateLimited, m.LimiterErrors, m.ShadowLimited, m.QuotaExceeded, m.QuotaErrors,
+		m.LimiterEvictions, m.InFlight, m.Queued, m.ConcurrencyRejected, m.AdaptiveLimit, m.AdaptiveShed,
+		m.UpstreamLatency, m.UpstreamTTFB, m.UpstreamResponses, m.UpstreamErrors,
+		m.UpstreamRequestSize, m.UpstreamResponseSize, m.UpstreamInFlight)
+	if o.KeyMetrics {
+		m.registerKeyMetrics()
+	}
 	return m
 }
 
+// UpstreamBegin is a proxy.Begin tracking in-flight upstream exchanges.
+func (m *Metrics) UpstreamBegin(rt *routing.Route) func() {
+	g := m.UpstreamInFlight.WithLabelValues(rt.ID, rt.UpUrl.Host)
+	g.Inc()
+	return g.Dec
+}
+
+// ObserveUpstream is a proxy.Observer recording upstream metrics.
+func (m *Metrics) ObserveUpstream(_ *http.Request, rt *routing.Route, res proxy.Result) {
+	route, target := rt.ID, rt.UpUrl.Host
+	m.UpstreamLatency.WithLabelValues(route, target).Observe(res.Duration.Seconds())
+	m.UpstreamRequestSize.WithLabelValues(route, target).Observe(float64(res.RequestBytes))
+	if res.TTFB > 0 {
+		m.UpstreamTTFB.WithLabelValues(route, target).Observe(res.TTFB.Seconds())
+	}
+	if res.Err != nil {
+		m.UpstreamErrors.WithLabelValues(route, target, proxy.ErrorClass(res.Err)).Inc()
+		return
+	}
+	m.UpstreamResponses.WithLabelValues(route, target, strconv.Itoa(res.Status)).Inc()
+	m.UpstreamResponseSize.WithLabelValues(route, target).Observe(float64(res.ResponseBytes))
+}
+
+// TrackLimiterBuckets exports the number of tracked in-memory buckets.
+func (m *Metrics) TrackLimiterBuckets(count func() int) {
+	m.reg.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "gatelite_limiter_buckets",
+			Help: "Rate limit buckets currently tracked in memory",
+		},
+		func() float64 { return float64(count()) },
+	))
+}
+
 type statusRecorder struct {
 	http.ResponseWriter
 	status int
@@ -74,16 +283,14 @@ func (w *statusRecorder) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Unwrap lets http.ResponseController reach Flush/Hijack on the original.
+func (w *statusRecorder) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
 // Middleware records per-request metrics.
 // It uses the route stored by RouteMatcher (gateway.RouteFrom).
-func (m *Metrics) Middleware(skip map[string]struct{}) gateway.Middleware {
+func (m *Metrics) Middleware() gateway.Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if _, ok := skip[r.URL.Path]; ok {
-				next.ServeHTTP(w, r)
-				return
-			}
-
 			start := time.Now()
 			rec := &statusRecorder{ResponseWriter: w}
 
@@ -1,21 +1,16 @@
 package obs
 
 import (
-	"context"
-
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/AlexKimmel/GateLite/internal/reqid"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 )
 
-type ctxKey int
-
-const keyRID ctxKey = 0
-
 func SetupLogger(level string) zerolog.Logger {
 	lvl, err := zerolog.ParseLevel(strings.ToLower(level))
 	if err != nil {
@@ -29,16 +24,17 @@ func SetupLogger(level string) zerolog.Logger {
 	return logger
 }
 
-// RequestID middleware: uses X-Request-ID if present, else generates one.
-func RequestID() func(http.Handler) http.Handler {
-	return hlog.RequestIDHandler("req_id", "X-Request-ID")
-}
-
 // Logger returns a middleware that logs per-request with duration and status.
-func Logger(logger zerolog.Logger) func(http.Handler) http.Handler {
+// Every line logged through hlog.FromRequest carries the request ID set by
+// reqid.Middleware, which must run first. The per-request line is skipped
+// when requests is false, e.g. when a dedicated access log is configured.
+func Logger(logger zerolog.Logger, requests bool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		h := hlog.NewHandler(logger)(
 			hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
+				if !requests {
+					return
+				}
 				hlog.FromRequest(r).Info().
 					Str("method", r.Method).
 					Str("path", r.URL.Path).
@@ -50,7 +46,7 @@ func Logger(logger zerolog.Logger) func(http.Handler) http.Handler {
 			})(
 				hlog.UserAgentHandler("ua")(
 					hlog.RefererHandler("referer")(
-						hlog.RequestIDHandler("req_id", "X-Request-ID")(next),
+						requestIDHandler(next),
 					),
 				),
 			),
@@ -58,16 +54,15 @@ func Logger(logger zerolog.Logger) func(http.Handler) http.Handler {
 		return h
 	}
 }
-func WithReqID(ctx context.Context, id string) context.Context {
-	return context.WithValue(ctx, keyRID, id)
-}
-func ReqIDFrom(ctx context.Context) (string, bool) {
-	v := ctx.Value(keyRID)
-	if v == nil {
-
-		return "", false
-	}
 
-	s, ok := v.(string)
-	return s, ok
+// requestIDHandler adds the request ID to the request's logger.
+func requestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := reqid.From(r.Context()); ok {
+			zerolog.Ctx(r.Context()).UpdateContext(func(c zerolog.Context) zerolog.Context {
+				return c.Str("req_id", id)
+			})
+		}
+		next.ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,126 @@
+package obs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/AlexKimmel/GateLite/internal/gateway"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type TracingOptions struct {
+	Exporter    string  // "otlp" (default) or "stdout"
+	Endpoint    string  // OTLP/HTTP collector host:port; default localhost:4318
+	Insecure    bool    // plain HTTP to the collector
+	Sampler     string  // "parent_ratio" (default), "ratio", "always_on" or "always_off"
+	SampleRatio float64 // for the ratio samplers; default 1
+	ServiceName string  // default "gatelite"
+}
+
+// SetupTracing installs the global tracer provider and the W3C trace
+// context propagator. The returned function flushes and stops exporting.
+func SetupTracing(ctx context.Context, o TracingOptions) (func(context.Context) error, error) {
+	if o.ServiceName == "" {
+		o.ServiceName = "gatelite"
+	}
+	if o.SampleRatio <= 0 {
+		o.SampleRatio = 1
+	}
+
+	var (
+		exp sdktrace.SpanExporter
+		err error
+	)
+	switch o.Exporter {
+	case "", "otlp":
+		opts := []otlptracehttp.Option{}
+		if o.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(o.Endpoint))
+		}
+		if o.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q (want otlp or stdout)", o.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sampler sdktrace.Sampler
+	switch o.Sampler {
+	case "", "parent_ratio":
+		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.SampleRatio))
+	case "ratio":
+		sampler = sdktrace.TraceIDRatioBased(o.SampleRatio)
+	case "always_on":
+		sampler = sdktrace.AlwaysSample()
+	case "always_off":
+		sampler = sdktrace.NeverSample()
+	default:
+		return nil, fmt.Errorf("unknown tracing sampler %q", o.Sampler)
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", o.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+var tracer = otel.Tracer("github.com/AlexKimmel/GateLite/internal/obs")
+
+// Tracing starts the server span of a request, continuing the trace from
+// incoming traceparent/tracestate headers. Inner middlewares name it after
+// the route and add the route and key IDs.
+func Tracing() gateway.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("url.path", r.URL.Path),
+					attribute.String("client.address", r.RemoteAddr),
+				),
+			)
+			defer span.End()
+
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			code := rec.status
+			if code == 0 {
+				code = http.StatusOK
+			}
+			span.SetAttributes(attribute.Int("http.response.status_code", code))
+			if code >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(code))
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package obs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/auth"
+	"github.com/AlexKimmel/GateLite/internal/gateway"
+	"github.com/AlexKimmel/GateLite/internal/proxy"
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+	"github.com/AlexKimmel/GateLite/internal/ratelimit/memory"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	incomingTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	incomingSpan  = "00f067aa0ba902b7"
+)
+
+// tracedGateway serves the tracing, auth, rate limit and proxy layers of
+// the gateway in front of an upstream that records the traceparent it gets.
+func tracedGateway(t *testing.T, sr *tracetest.SpanRecorder) (h http.Handler, traceparent chan string) {
+	t.Helper()
+	traceparent = make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+	}))
+	t.Cleanup(upstream.Close)
+	up, _ := url.Parse(upstream.URL)
+
+	// the package tracers delegate to the first provider installed
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	rr := routing.New()
+	rr.Add(&routing.Route{
+		ID:           "echo",
+		Methods:      map[string]struct{}{"GET": {}},
+		Prefix:       "/echo",
+		UpUrl:        up,
+		Timeout:      5 * time.Second,
+		LimitDefault: ratelimit.Policy{RPM: 60, Burst: 1},
+	})
+	lim := memory.New(memory.Options{JanitorInterval: -1})
+	t.Cleanup(func() { _ = lim.Close() })
+
+	h = gateway.Chain(
+		proxy.Handler(proxy.NewHTTPTransport(), nil),
+		Tracing(),
+		gateway.RouteMatcher(rr),
+		auth.NewStatic("", map[string]string{"secret": "k1"}).Middleware(),
+		gateway.RateLimit(lim, gateway.Policies{}, nil, nil, nil),
+	)
+	return h, traceparent
+}
+
+func spanNamed(t *testing.T, spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	for _, s := range spans {
+		if s.Name() == name {
+			return s
+		}
+	}
+	t.Fatalf("no span %q", name)
+	return nil
+}
+
+func attr(s sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	h, traceparent := tracedGateway(t, sr)
+
+	r := httptest.NewRequest("GET", "/echo/x", nil)
+	r.Header.Set("X-API-Key", "secret")
+	r.Header.Set("traceparent", "00-"+incomingTrace+"-"+incomingSpan+"-01")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	spans := sr.Ended()
+	server := spanNamed(t, spans, "GET echo")
+	authn := spanNamed(t, spans, "auth")
+	limit := spanNamed(t, spans, "ratelimit")
+	upstream := spanNamed(t, spans, "upstream echo")
+
+	// the server span continues the incoming trace
+	for _, s := range spans {
+		if got := s.SpanContext().TraceID().String(); got != incomingTrace {
+			t.Fatalf("span %s in trace %s, want %s", s.Name(), got, incomingTrace)
+		}
+	}
+	if p := server.Parent(); p.SpanID().String() != incomingSpan || !p.IsRemote() {
+		t.Fatalf("server span parent %v, want the remote %s", p.SpanID(), incomingSpan)
+	}
+	if server.SpanKind() != trace.SpanKindServer || upstream.SpanKind() != trace.SpanKindClient {
+		t.Fatalf("kinds %v and %v, want server and client", server.SpanKind(), upstream.SpanKind())
+	}
+
+	// auth, rate limiting and the upstream call are children of it
+	for _, s := range []sdktrace.ReadOnlySpan{authn, limit, upstream} {
+		if s.Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Fatalf("span %s: parent %v, want the server span %v", s.Name(), s.Parent().SpanID(), server.SpanContext().SpanID())
+		}
+	}
+
+	// and the upstream continues from the client span
+	want := "00-" + incomingTrace + "-" + upstream.SpanContext().SpanID().String() + "-01"
+	if got := <-traceparent; got != want {
+		t.Fatalf("upstream traceparent %q, want %q", got, want)
+	}
+
+	for _, tc := range []struct {
+		span sdktrace.ReadOnlySpan
+		key  attribute.Key
+		want attribute.Value
+	}{
+		{server, "gatelite.route.id", attribute.StringValue("echo")},
+		{server, "gatelite.key.id", attribute.StringValue("k1")},
+		{server, "http.response.status_code", attribute.IntValue(200)},
+		{authn, "gatelite.key.id", attribute.StringValue("k1")},
+		{limit, "gatelite.ratelimit.allowed", attribute.BoolValue(true)},
+		{upstream, "http.response.status_code", attribute.IntValue(200)},
+	} {
+		if got := attr(tc.span, tc.key); got != tc.want {
+			t.Errorf("span %s: %s = %v, want %v", tc.span.Name(), tc.key, got.Emit(), tc.want.Emit())
+		}
+	}
+
+	// a rejected request records the decision and never reaches the upstream
+	sr2 := tracetest.NewSpanRecorder()
+	otel.GetTracerProvider().(*sdktrace.TracerProvider).RegisterSpanProcessor(sr2)
+	r = httptest.NewRequest("GET", "/echo/x", nil)
+	r.Header.Set("X-API-Key", "secret")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	spans = sr2.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("%d spans for a rejected request, want server, auth and ratelimit", len(spans))
+	}
+	server = spanNamed(t, spans, "GET echo")
+	if server.Parent().IsValid() {
+		t.Fatal("server span has a parent without a traceparent")
+	}
+	if got := attr(spanNamed(t, spans, "ratelimit"), "gatelite.ratelimit.allowed"); got != attribute.BoolValue(false) {
+		t.Fatalf("ratelimit allowed = %v, want false", got.Emit())
+	}
+	if got := attr(server, "http.response.status_code"); got != attribute.IntValue(http.StatusTooManyRequests) {
+		t.Fatalf("server status %v, want 429", got.Emit())
+	}
+}
@@ -2,14 +2,29 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/AlexKimmel/GateLite/internal/reqid"
 	"github.com/AlexKimmel/GateLite/internal/routing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/AlexKimmel/GateLite/internal/proxy")
+
 func NewHTTPTransport() *http.Transport {
 	return &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
@@ -23,16 +38,128 @@ func NewHTTPTransport() *http.Transport {
 	}
 }
 
+// ConnCount tracks a transport's upstream connections.
+type ConnCount struct {
+	open   atomic.Int64
+	dialed atomic.Int64
+}
+
+// CountConns wraps tr's dialer so its connections are counted. TLS
+// connections are counted too, they are layered over the dialed conn.
+func CountConns(tr *http.Transport) *ConnCount {
+	c := &ConnCount{}
+	dial := tr.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c.open.Add(1)
+		c.dialed.Add(1)
+		return &countedConn{Conn: conn, c: c}, nil
+	}
+	return c
+}
+
+// Open is the number of connections currently open.
+func (c *ConnCount) Open() int64 { return c.open.Load() }
+
+// Dialed is the number of connections opened since start.
+func (c *ConnCount) Dialed() int64 { return c.dialed.Load() }
+
+type countedConn struct {
+	net.Conn
+	c      *ConnCount
+	closed atomic.Bool
+}
+
+func (c *countedConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.c.open.Add(-1)
+	}
+	return c.Conn.Close()
+}
+
+// Result describes one upstream exchange.
+type Result struct {
+	Status   int           // upstream status; 0 if no response was received
+	Latency  time.Duration // until response headers arrived (or the call failed)
+	TTFB     time.Duration // until the first response byte; 0 if none arrived
+	Duration time.Duration // whole exchange including the response body
+	Err      error
+
+	RequestBytes  int64 // request body bytes sent upstream
+	ResponseBytes int64 // response body bytes relayed to the client
+}
+
+// Observer is called after every upstream exchange.
+type Observer func(r *http.Request, rt *routing.Route, res Result)
+
+// Begin is called when an upstream exchange starts; the returned func is
+// called when it ends. Used to track in-flight requests.
+type Begin func(rt *routing.Route) (end func())
+
+// ErrorClass buckets an upstream error: "dial", "tls", "timeout", "reset",
+// "canceled" (the client went away) or "other".
+func ErrorClass(err error) string {
+	var (
+		opErr   *net.OpError
+		recErr  tls.RecordHeaderError
+		alert   tls.AlertError
+		certErr *tls.CertificateVerificationError
+		unknown x509.UnknownAuthorityError
+		netErr  net.Error
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "dial"
+	case errors.As(err, &recErr), errors.As(err, &alert), errors.As(err, &certErr), errors.As(err, &unknown):
+		return "tls"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "reset"
+	}
+	return "other"
+}
+
 // Handler returns a handler that proxies to the upstream specified by the matched route.
-func Handler(tr *http.Transport) http.Handler {
+// begin may be nil.
+func Handler(tr *http.Transport, begin Begin, observers ...Observer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rt, ok := routing.RouteFrom(r)
 		if !ok {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = w.Write([]byte(`{"error":{"code":"no_route_ctx","message":"route not in context"}}`))
+			writeJSON(w, r, http.StatusInternalServerError, "no_route_ctx", "route not in context")
 			return
 		}
 
+		if begin != nil {
+			defer begin(rt)()
+		}
+
+		var (
+			res           Result
+			reqN, respN   atomic.Int64
+			firstByteNano atomic.Int64
+		)
+		start := time.Now()
+
+		ctx, span := tracer.Start(r.Context(), "upstream "+rt.ID,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("gatelite.route.id", rt.ID),
+				attribute.String("server.address", rt.UpUrl.Host),
+				attribute.String("http.request.method", r.Method),
+			),
+		)
+		defer span.End()
+
 		proxy := &httputil.ReverseProxy{
 			Director: func(req *http.Request) {
 				req.URL.Scheme = rt.UpUrl.Scheme
@@ -40,12 +167,70 @@ func Handler(tr *http.Transport) http.Handler {
 				// Forwarded headers
 				req.Header.Set("X-Forwarded-Host", req.Host)
 				req.Header.Set("X-Forwarded-Proto", "http")
+				// continue the trace in the upstream
+				otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+				if req.Body != nil && req.Body != http.NoBody {
+					req.Body = &countingBody{ReadCloser: req.Body, n: &reqN}
+				}
 			},
 			Transport: tr,
+			ModifyResponse: func(resp *http.Response) error {
+				res.Status = resp.StatusCode
+				res.Latency = time.Since(start)
+				resp.Body = &countingBody{ReadCloser: resp.Body, n: &respN}
+				return nil
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				res.Err = err
+				res.Latency = time.Since(start)
+				writeJSON(w, r, http.StatusBadGateway, "upstream_error", "upstream unavailable")
+			},
 		}
 		// per-route timeout
-		ctx, cancel := context.WithTimeout(r.Context(), rt.Timeout)
+		ctx, cancel := context.WithTimeout(ctx, rt.Timeout)
 		defer cancel()
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotFirstResponseByte: func() { firstByteNano.Store(int64(time.Since(start))) },
+		})
 		proxy.ServeHTTP(w, r.WithContext(ctx))
+
+		res.Duration = time.Since(start)
+		res.TTFB = time.Duration(firstByteNano.Load())
+		res.RequestBytes = reqN.Load()
+		res.ResponseBytes = respN.Load()
+
+		if res.Status > 0 {
+			span.SetAttributes(attribute.Int("http.response.status_code", res.Status))
+		}
+		if res.Err != nil {
+			span.RecordError(res.Err)
+			span.SetStatus(codes.Error, "upstream error")
+		} else if res.Status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(res.Status))
+		}
+
+		for _, o := range observers {
+			o(r, rt, res)
+		}
 	})
 }
+
+// countingBody counts the bytes read through it. The transport may read the
+// request body from another goroutine, hence the atomic.
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, errCode, msg string) {
+	id, _ := reqid.From(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte(`{"error":{"code":"` + errCode + `","message":"` + msg + `","request_id":"` + id + `"}}`))
+}
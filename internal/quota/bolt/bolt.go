@@ -0,0 +1,137 @@
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/quota"
+	bbolt "go.etcd.io/bbolt"
+)
+
+var bucketName = []byte("quota")
+
+// ErrReleased is returned while the store is released, see Release.
+var ErrReleased = fmt.Errorf("quota store released: %w", quota.ErrHandoff)
+
+// Store keeps quota counters in an embedded bbolt file so usage survives
+// restarts. Each key holds only its current window: a counter from an older
+// window is treated as zero and overwritten on the next write.
+type Store struct {
+	path string
+	mu   sync.RWMutex
+	db   *bbolt.DB // nil while released
+}
+
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{path: path, db: db}, nil
+}
+
+func open(path string) (*bbolt.DB, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Release closes the file so another process can open it (bbolt locks it
+// exclusively); Consume fails with ErrReleased until Reacquire.
+func (s *Store) Release() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+// Reacquire reopens the file after Release.
+func (s *Store) Reacquire() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		return nil
+	}
+	db, err := open(s.path)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+func (s *Store) Close() error { return s.Release() }
+
+func (s *Store) Consume(_ context.Context, cs []quota.Counter, n int64) ([]int64, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db == nil {
+		return nil, false, ErrReleased
+	}
+
+	// Batch coalesces concurrent calls into one transaction (and one fsync);
+	// fn may run more than once, so it starts from scratch each time.
+	used := make([]int64, len(cs))
+	var ok bool
+	err := s.db.Batch(func(tx *bbolt.Tx) error {
+		ok = true
+		b := tx.Bucket(bucketName)
+		for i, c := range cs {
+			used[i] = decode(b.Get([]byte(c.Key)), c.WindowStart)
+			if used[i]+n > c.Limit {
+				ok = false
+			}
+		}
+		if !ok {
+			return nil
+		}
+		for i, c := range cs {
+			used[i] += n
+			if err := b.Put([]byte(c.Key), encode(c.WindowStart, used[i])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return used, ok, nil
+}
+
+// value layout: window start (unix seconds) | count, both big-endian int64
+func encode(window time.Time, count int64) []byte {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v[:8], uint64(window.Unix()))
+	binary.BigEndian.PutUint64(v[8:], uint64(count))
+	return v
+}
+
+func decode(v []byte, window time.Time) int64 {
+	if len(v) != 16 || int64(binary.BigEndian.Uint64(v[:8])) != window.Unix() {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v[8:]))
+}
@@ -0,0 +1,133 @@
+package bolt
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/quota"
+)
+
+func openStore(t *testing.T, path string) *Store {
+	t.Helper()
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func consume(t *testing.T, s *Store, cs ...quota.Counter) ([]int64, bool) {
+	t.Helper()
+	used, ok, err := s.Consume(context.Background(), cs, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return used, ok
+}
+
+func TestConsume(t *testing.T) {
+	s := openStore(t, filepath.Join(t.TempDir(), "q.db"))
+	day, _ := quota.Day.Window(time.Now())
+	c := quota.Counter{Key: "daily:k", WindowStart: day, Limit: 2}
+
+	for want := int64(1); want <= 2; want++ {
+		if used, ok := consume(t, s, c); !ok || used[0] != want {
+			t.Fatalf("used %v ok %v, want %d allowed", used, ok, want)
+		}
+	}
+	if used, ok := consume(t, s, c); ok || used[0] != 2 {
+		t.Fatalf("over the limit: used %v ok %v, want 2 denied", used, ok)
+	}
+}
+
+func TestConsumeIsAllOrNothing(t *testing.T) {
+	s := openStore(t, filepath.Join(t.TempDir(), "q.db"))
+	now := time.Now()
+	day, _ := quota.Day.Window(now)
+	month, _ := quota.Month.Window(now)
+	daily := quota.Counter{Key: "daily:k", WindowStart: day, Limit: 1}
+	monthly := quota.Counter{Key: "monthly:k", WindowStart: month, Limit: 10}
+
+	consume(t, s, daily, monthly)
+	if _, ok := consume(t, s, daily, monthly); ok {
+		t.Fatal("allowed past the daily limit")
+	}
+	// the denied request did not count against the monthly quota
+	if used, _ := consume(t, s, monthly); used[0] != 2 {
+		t.Fatalf("monthly used %d, want 2", used[0])
+	}
+}
+
+func TestRollover(t *testing.T) {
+	s := openStore(t, filepath.Join(t.TempDir(), "q.db"))
+	last := time.Date(2030, 1, 31, 23, 59, 59, 0, time.UTC)
+	for _, p := range []quota.Period{quota.Day, quota.Month} {
+		before, end := p.Window(last)
+		after, _ := p.Window(end)
+		c := quota.Counter{Key: string(p) + ":k", WindowStart: before, Limit: 1}
+
+		consume(t, s, c)
+		if _, ok := consume(t, s, c); ok {
+			t.Fatalf("%s: allowed past the limit", p)
+		}
+		c.WindowStart = after
+		if used, ok := consume(t, s, c); !ok || used[0] != 1 {
+			t.Fatalf("%s: next window used %v ok %v, want a fresh counter", p, used, ok)
+		}
+	}
+}
+
+func TestSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "q.db")
+	day, _ := quota.Day.Window(time.Now())
+	c := quota.Counter{Key: "daily:k", WindowStart: day, Limit: 5}
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consume(t, s, c)
+	consume(t, s, c)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openStore(t, path)
+	if used, _ := consume(t, s, c); used[0] != 3 {
+		t.Fatalf("used %d after reopen, want 3", used[0])
+	}
+}
+
+func TestRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "q.db")
+	s := openStore(t, path)
+	day, _ := quota.Day.Window(time.Now())
+	c := quota.Counter{Key: "daily:k", WindowStart: day, Limit: 5}
+	consume(t, s, c)
+
+	if err := s.Release(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := s.Consume(context.Background(), []quota.Counter{c}, 1)
+	if !errors.Is(err, ErrReleased) || !errors.Is(err, quota.ErrHandoff) {
+		t.Fatalf("Consume while released: %v, want ErrReleased wrapping ErrHandoff", err)
+	}
+
+	// another process can take the file meanwhile
+	other := openStore(t, path)
+	consume(t, other, c)
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Reacquire(); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := consume(t, s, c); used[0] != 3 {
+		t.Fatalf("used %d after reacquire, want 3", used[0])
+	}
+}
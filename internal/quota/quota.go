@@ -0,0 +1,85 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Period is a calendar-aligned quota window in UTC.
+type Period string
+
+const (
+	Day   Period = "day"
+	Month Period = "month"
+)
+
+func ParsePeriod(s string) (Period, error) {
+	switch p := Period(strings.ToLower(strings.TrimSpace(s))); p {
+	case Day, Month:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown quota period %q (want day or month)", s)
+}
+
+// Window returns the [start, end) window containing now.
+func (p Period) Window(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	switch p {
+	case Month:
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	default:
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// Quota is a long-window allowance counted per key, or per key and route.
+type Quota struct {
+	ID        string
+	Limit     int64
+	Period    Period
+	PerRoute  bool                // count per key+route instead of per key
+	Routes    map[string]struct{} // route IDs it applies to; empty means all
+	Overrides map[string]int64    // limit by key ID
+}
+
+// AppliesTo reports whether the quota covers routeID.
+func (q Quota) AppliesTo(routeID string) bool {
+	if len(q.Routes) == 0 {
+		return true
+	}
+	_, ok := q.Routes[routeID]
+	return ok
+}
+
+// LimitFor returns the limit for keyID, honoring overrides.
+func (q Quota) LimitFor(keyID string) int64 {
+	if n, ok := q.Overrides[keyID]; ok {
+		return n
+	}
+	return q.Limit
+}
+
+// Counter identifies one usage counter in a given window.
+type Counter struct {
+	Key         string
+	WindowStart time.Time
+	Limit       int64
+}
+
+// ErrHandoff is returned by Consume while the store is being handed to
+// another process, e.g. during a binary upgrade. Usage in that window goes
+// uncounted rather than failing requests.
+var ErrHandoff = errors.New("quota store handed off")
+
+type Store interface {
+	// Consume adds n to every counter if all of them stay within their
+	// limits, atomically. used holds the resulting (or, when ok is false,
+	// current) usage per counter.
+	Consume(ctx context.Context, cs []Counter, n int64) (used []int64, ok bool, err error)
+	Close() error
+}
@@ -0,0 +1,52 @@
+package quota
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	for _, tc := range []struct {
+		p          Period
+		now        string
+		start, end string
+	}{
+		{Day, "2030-01-31T23:59:59Z", "2030-01-31T00:00:00Z", "2030-02-01T00:00:00Z"},
+		{Day, "2030-02-01T00:00:00Z", "2030-02-01T00:00:00Z", "2030-02-02T00:00:00Z"},
+		// windows are UTC whatever the caller's zone
+		{Day, "2030-03-10T01:00:00+05:00", "2030-03-09T00:00:00Z", "2030-03-10T00:00:00Z"},
+		{Month, "2030-01-31T23:59:59Z", "2030-01-01T00:00:00Z", "2030-02-01T00:00:00Z"},
+		{Month, "2030-12-15T12:00:00Z", "2030-12-01T00:00:00Z", "2031-01-01T00:00:00Z"},
+		{Month, "2032-02-29T12:00:00Z", "2032-02-01T00:00:00Z", "2032-03-01T00:00:00Z"},
+	} {
+		now, _ := time.Parse(time.RFC3339, tc.now)
+		start, end := tc.p.Window(now)
+		if got := start.Format(time.RFC3339); got != tc.start {
+			t.Errorf("%s %s: start %s, want %s", tc.p, tc.now, got, tc.start)
+		}
+		if got := end.Format(time.RFC3339); got != tc.end {
+			t.Errorf("%s %s: end %s, want %s", tc.p, tc.now, got, tc.end)
+		}
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	for in, want := range map[string]Period{"day": Day, " Month ": Month} {
+		if p, err := ParsePeriod(in); err != nil || p != want {
+			t.Errorf("ParsePeriod(%q) = %q, %v; want %q", in, p, err, want)
+		}
+	}
+	if _, err := ParsePeriod("week"); err == nil {
+		t.Error("ParsePeriod(week): no error")
+	}
+}
+
+func TestLimitFor(t *testing.T) {
+	q := Quota{Limit: 10, Overrides: map[string]int64{"gold": 100}}
+	if n := q.LimitFor("gold"); n != 100 {
+		t.Errorf("override: %d, want 100", n)
+	}
+	if n := q.LimitFor("other"); n != 10 {
+		t.Errorf("default: %d, want 10", n)
+	}
+}
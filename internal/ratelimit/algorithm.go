@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Algorithm selects how a Policy is enforced.
+type Algorithm string
+
+const (
+	TokenBucket          Algorithm = "token_bucket"           // RPM refill, Burst capacity (default)
+	GCRA                 Algorithm = "gcra"                   // RPM spacing, Burst tolerance
+	SlidingWindowLog     Algorithm = "sliding_window_log"     // RPM per rolling minute, exact
+	SlidingWindowCounter Algorithm = "sliding_window_counter" // RPM per rolling minute, approximated
+	FixedWindow          Algorithm = "fixed_window"           // RPM per calendar minute
+)
+
+// Window is the period window-based algorithms count RPM over.
+const Window = time.Minute
+
+func ParseAlgorithm(s string) (Algorithm, error) {
+	switch a := Algorithm(strings.ToLower(strings.TrimSpace(s))); a {
+	case "":
+		return TokenBucket, nil
+	case TokenBucket, GCRA, SlidingWindowLog, SlidingWindowCounter, FixedWindow:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown rate limit algorithm %q", s)
+}
+
+// Capacity is the most units p can ever allow at once: Burst for
+// TokenBucket and GCRA, RPM for the window-based algorithms.
+func Capacity(p Policy) int {
+	switch p.Algorithm {
+	case SlidingWindowLog, SlidingWindowCounter, FixedWindow:
+		return p.RPM
+	}
+	return p.Burst
+}
+
+// Unlimited reports whether p enforces nothing: it has no rate or, for its
+// algorithm, no capacity.
+func Unlimited(p Policy) bool {
+	return p.RPM <= 0 || Capacity(p) <= 0
+}
@@ -0,0 +1,82 @@
+package ratelimit
+
+// MatchKey reports whether key matches a Redis-style glob pattern, so
+// Limiter.Keys answers the same on every backend: * matches any run of
+// bytes (including '/'), ? any one byte, [abc], [^abc] and [a-z] a byte
+// class, and \ quotes the next byte. Like Redis, it never rejects a pattern;
+// an unterminated class runs to the end of it.
+func MatchKey(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := range len(key) + 1 {
+				if MatchKey(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if key == "" {
+				return false
+			}
+		case '[':
+			if key == "" {
+				return false
+			}
+			var ok bool
+			if ok, pattern = matchClass(pattern[1:], key[0]); !ok {
+				return false
+			}
+			key = key[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if key == "" || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return key == ""
+}
+
+// matchClass matches c against the class at the start of pattern (just past
+// its '[') and returns the rest of the pattern after the class.
+func matchClass(pattern string, c byte) (bool, string) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			pattern = pattern[1:]
+			match = match || pattern[0] == c
+		case len(pattern) > 2 && pattern[1] == '-':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			match = match || (lo <= c && c <= hi)
+			pattern = pattern[2:]
+		default:
+			match = match || pattern[0] == c
+		}
+		pattern = pattern[1:]
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:] // the ']'
+	}
+	return match != negate, pattern
+}
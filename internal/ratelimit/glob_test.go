@@ -0,0 +1,43 @@
+package ratelimit
+
+import "testing"
+
+func TestMatchKey(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "", true},
+		{"*", "r:a/b", true},
+		{"r:*", "r:a/b/c", true}, // unlike path.Match, * crosses '/'
+		{"r:*/c", "r:a/b/c", true},
+		{"r:*", "g:a", false},
+		{"r:?", "r:a", true},
+		{"r:?", "r:ab", false},
+		{"r:?", "r:", false},
+		{"r:??", "r:/x", true},
+		{"*a*b*", "xaybz", true},
+		{"*a*b*", "xbya", false},
+		{"[abc]", "b", true},
+		{"[abc]", "d", false},
+		{"[^abc]", "d", true},
+		{"[^abc]", "a", false},
+		{"[a-c]x", "bx", true},
+		{"[c-a]x", "bx", true},
+		{"[a-c]x", "dx", false},
+		{`[\]]`, "]", true},
+		{"[ab", "a", true}, // unterminated class
+		{"[]", "a", false},
+		{`r\*`, "r*", true},
+		{`r\*`, "ra", false},
+		{`r\?`, "r?", true},
+		{`a\`, "a\\", true},
+		{"", "", true},
+		{"", "a", false},
+		{"a", "", false},
+	} {
+		if got := MatchKey(tc.pattern, tc.key); got != tc.want {
+			t.Errorf("MatchKey(%q, %q) = %v, want %v", tc.pattern, tc.key, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// KeySource is the part of a request a limiter key is derived from.
+type KeySource int
+
+const (
+	KeyAPIKey KeySource = iota // authenticated key ID ("key")
+	KeyIP                      // client IP ("ip")
+	KeyHeader                  // request header ("header:X-Tenant")
+	KeyMeta                    // API key metadata field ("meta:plan")
+	KeyClaim                   // JWT claim from the bearer token ("claim:sub")
+	KeyParam                   // path segment after the route prefix ("param:0")
+)
+
+type KeyPart struct {
+	Source KeySource
+	Name   string // header, metadata field or claim name
+	Index  int    // path segment index for KeyParam
+}
+
+// KeyBy is a parsed key_by expression list. The parts are combined in order.
+type KeyBy []KeyPart
+
+// DefaultKeyBy keys buckets by authenticated key ID only.
+var DefaultKeyBy = KeyBy{{Source: KeyAPIKey}}
+
+// ParseKeyBy parses expressions like "ip", "key", "header:X-Tenant",
+// "meta:plan", "claim:sub" or "param:0". An empty list yields DefaultKeyBy.
+func ParseKeyBy(exprs []string) (KeyBy, error) {
+	if len(exprs) == 0 {
+		return DefaultKeyBy, nil
+	}
+	kb := make(KeyBy, 0, len(exprs))
+	for _, e := range exprs {
+		kind, name, _ := strings.Cut(strings.TrimSpace(e), ":")
+		name = strings.TrimSpace(name)
+
+		var p KeyPart
+		switch strings.ToLower(kind) {
+		case "key":
+			p.Source = KeyAPIKey
+		case "ip":
+			p.Source = KeyIP
+		case "header":
+			p.Source = KeyHeader
+		case "meta":
+			p.Source = KeyMeta
+		case "claim":
+			p.Source = KeyClaim
+		case "param":
+			p.Source = KeyParam
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("key_by %q: param needs a segment index", e)
+			}
+			p.Index = i
+		default:
+			return nil, fmt.Errorf("key_by %q: unknown source %q", e, kind)
+		}
+		if name == "" && (p.Source == KeyHeader || p.Source == KeyMeta || p.Source == KeyClaim) {
+			return nil, fmt.Errorf("key_by %q: missing name", e)
+		}
+		p.Name = name
+		kb = append(kb, p)
+	}
+	return kb, nil
+}
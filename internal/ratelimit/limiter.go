@@ -2,22 +2,49 @@ package ratelimit
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
+// ErrCostExceedsCapacity is returned by Allow when a request costs more than
+// the policy's Capacity: no amount of waiting would let it through.
+var ErrCostExceedsCapacity = errors.New("cost exceeds rate limit capacity")
+
 type Policy struct {
-	RPM   int // requests per minute
-	Burst int // bucket capacity
+	RPM       int       // requests per minute
+	Burst     int       // bucket capacity (token_bucket, gcra)
+	Algorithm Algorithm // empty means TokenBucket
+	Shadow    bool      // evaluate and report, but never reject (dry run)
 }
 
 type Decision struct {
 	Allowed      bool
-	Limit        int   // limit per minute
-	Remaining    int   // tokens after this request (min 0)
-	ResetUnixSec int64 // when tokens would be full if no more traffic
+	Limit        int           // limit per minute
+	Remaining    int           // tokens after this request (min 0)
+	ResetUnixSec int64         // when tokens would be full if no more traffic
+	RetryAfter   time.Duration // until the same request would be allowed; 0 if allowed
+	Bonus        int           // granted units left (see Grant); Allow may leave it 0 unless it drew on them
+	FromBonus    bool          // Allow took the cost from the bonus, not the regular budget
 }
 
 type Limiter interface {
-	Allow(ctx context.Context, key string, p Policy, now time.Time) (Decision, error)
+	// Allow takes cost units from key's budget if it can afford them. A cost
+	// above Capacity(p) fails with ErrCostExceedsCapacity, bonus or not.
+	Allow(ctx context.Context, key string, p Policy, cost int, now time.Time) (Decision, error)
+	// Charge takes cost units unconditionally, possibly into debt, e.g. to
+	// bill a cost that is only known once the upstream has responded.
+	Charge(ctx context.Context, key string, p Policy, cost int, now time.Time) error
+	// Refund gives back the cost units an Allow that returned d took, e.g.
+	// when another limit rejected the request after all.
+	Refund(ctx context.Context, key string, p Policy, cost int, d Decision, now time.Time) error
+	// Inspect reports key's current budget under p without taking from it.
+	Inspect(ctx context.Context, key string, p Policy, now time.Time) (Decision, error)
+	// Reset forgets key's state (bonus included), restoring its full budget.
+	Reset(ctx context.Context, key string) error
+	// Keys lists the tracked keys matching a glob pattern, see MatchKey.
+	Keys(ctx context.Context, pattern string) ([]string, error)
+	// Grant adds n bonus units to key, drawn on only once its regular budget
+	// is exhausted. The bonus expires ttl after the latest grant.
+	Grant(ctx context.Context, key string, n int, ttl time.Duration, now time.Time) error
 	Close() error
-}
\ No newline at end of file
+}
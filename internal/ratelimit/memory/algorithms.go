@@ -0,0 +1,370 @@
+package memory
+
+import (
+	"slices"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+)
+
+// state is the per-key bookkeeping of one algorithm. Callers hold the
+// bucket lock.
+type state interface {
+	// allow takes cost units if they fit in the budget.
+	allow(p ratelimit.Policy, cost int, now time.Time) ratelimit.Decision
+	// charge takes cost units unconditionally.
+	charge(p ratelimit.Policy, cost int, now time.Time)
+	// refund gives back cost units taken by allow, never beyond a full
+	// budget.
+	refund(p ratelimit.Policy, cost int, now time.Time)
+	// idle reports whether the state is indistinguishable from a new one.
+	idle(p ratelimit.Policy, now time.Time) bool
+	// clone returns an independent copy, e.g. to evaluate without side
+	// effects.
+	clone() state
+}
+
+func newState(alg ratelimit.Algorithm, p ratelimit.Policy, now time.Time) state {
+	switch alg {
+	case ratelimit.GCRA:
+		return &gcra{tat: now}
+	case ratelimit.SlidingWindowLog:
+		return &slidingLog{}
+	case ratelimit.SlidingWindowCounter:
+		return &slidingCounter{start: now.Truncate(ratelimit.Window)}
+	case ratelimit.FixedWindow:
+		return &fixedWindow{start: now.Truncate(ratelimit.Window)}
+	default:
+		return &tokenBucket{token: float64(p.Burst), lastRefill: now}
+	}
+}
+
+type tokenBucket struct {
+	token      float64
+	lastRefill time.Time
+}
+
+func (b *tokenBucket) refill(p ratelimit.Policy, now time.Time) {
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	if elapsed > 0 {
+		b.token += elapsed * float64(p.RPM) / 60
+		b.lastRefill = now
+	}
+	if b.token > float64(p.Burst) {
+		b.token = float64(p.Burst)
+	}
+}
+
+func (b *tokenBucket) allow(p ratelimit.Policy, cost int, now time.Time) ratelimit.Decision {
+	refillPerSec := float64(p.RPM) / 60
+	capacity := float64(p.Burst)
+
+	// refill tokens
+	b.refill(p, now)
+
+	// decide
+	allow := b.token >= float64(cost)
+	if allow {
+		b.token -= float64(cost)
+	}
+
+	// estimate reset time (to full)
+	var resetSec int64
+	if b.token >= capacity {
+		resetSec = now.Unix()
+	} else {
+		need := capacity - b.token
+		sec := need / refillPerSec
+		resetSec = now.Add(time.Duration(sec * float64(time.Second))).Unix()
+	}
+
+	var retry time.Duration
+	if !allow {
+		retry = time.Duration((float64(cost) - b.token) / refillPerSec * float64(time.Second))
+	}
+
+	return ratelimit.Decision{
+		Allowed:      allow,
+		Limit:        p.RPM,
+		Remaining:    int(b.token),
+		ResetUnixSec: resetSec,
+		RetryAfter:   retry,
+	}
+}
+
+func (b *tokenBucket) charge(p ratelimit.Policy, cost int, now time.Time) {
+	b.refill(p, now)
+	b.token -= float64(cost)
+}
+
+func (b *tokenBucket) refund(p ratelimit.Policy, cost int, now time.Time) {
+	b.refill(p, now)
+	b.token = min(b.token+float64(cost), float64(p.Burst))
+}
+
+func (b *tokenBucket) clone() state { c := *b; return &c }
+
+func (b *tokenBucket) idle(p ratelimit.Policy, now time.Time) bool {
+	refill := now.Sub(b.lastRefill).Seconds() * float64(p.RPM) / 60
+	return b.token+refill >= float64(p.Burst)
+}
+
+// gcra tracks the theoretical arrival time (tat) of the next request.
+// Requests are spaced by the emission interval; up to Burst may arrive early.
+type gcra struct {
+	tat time.Time
+}
+
+func (g *gcra) allow(p ratelimit.Policy, cost int, now time.Time) ratelimit.Decision {
+	interval := ratelimit.Window / time.Duration(p.RPM)
+	tolerance := interval * time.Duration(p.Burst)
+
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(interval * time.Duration(cost))
+
+	var retry time.Duration
+	allow := next.Sub(now) <= tolerance
+	if allow {
+		g.tat = next
+	} else {
+		retry = next.Sub(now) - tolerance
+		next = tat
+	}
+
+	return ratelimit.Decision{
+		Allowed:      allow,
+		Limit:        p.RPM,
+		Remaining:    int((tolerance - next.Sub(now)) / interval),
+		ResetUnixSec: next.Unix(),
+		RetryAfter:   retry,
+	}
+}
+
+func (g *gcra) charge(p ratelimit.Policy, cost int, now time.Time) {
+	if g.tat.Before(now) {
+		g.tat = now
+	}
+	g.tat = g.tat.Add(ratelimit.Window / time.Duration(p.RPM) * time.Duration(cost))
+}
+
+func (g *gcra) refund(p ratelimit.Policy, cost int, now time.Time) {
+	g.tat = g.tat.Add(-ratelimit.Window / time.Duration(p.RPM) * time.Duration(cost))
+	if g.tat.Before(now) {
+		g.tat = now
+	}
+}
+
+func (g *gcra) clone() state { c := *g; return &c }
+
+func (g *gcra) idle(_ ratelimit.Policy, now time.Time) bool {
+	return !g.tat.After(now)
+}
+
+// fixedWindow counts requests per calendar-aligned window.
+type fixedWindow struct {
+	start time.Time
+	count int
+}
+
+func (f *fixedWindow) roll(now time.Time) {
+	if start := now.Truncate(ratelimit.Window); start.After(f.start) {
+		f.start, f.count = start, 0
+	}
+}
+
+func (f *fixedWindow) allow(p ratelimit.Policy, cost int, now time.Time) ratelimit.Decision {
+	f.roll(now)
+
+	var retry time.Duration
+	allow := f.count+cost <= p.RPM
+	if allow {
+		f.count += cost
+	} else {
+		retry = f.start.Add(ratelimit.Window).Sub(now)
+	}
+
+	return ratelimit.Decision{
+		Allowed:      allow,
+		Limit:        p.RPM,
+		Remaining:    p.RPM - f.count,
+		ResetUnixSec: f.start.Add(ratelimit.Window).Unix(),
+		RetryAfter:   retry,
+	}
+}
+
+func (f *fixedWindow) charge(_ ratelimit.Policy, cost int, now time.Time) {
+	f.roll(now)
+	f.count += cost
+}
+
+func (f *fixedWindow) refund(_ ratelimit.Policy, cost int, now time.Time) {
+	f.roll(now)
+	f.count = max(f.count-cost, 0)
+}
+
+func (f *fixedWindow) clone() state { c := *f; return &c }
+
+func (f *fixedWindow) idle(_ ratelimit.Policy, now time.Time) bool {
+	return !now.Before(f.start.Add(ratelimit.Window))
+}
+
+// slidingLog keeps every accepted request of the last window with its cost,
+// so it holds at most RPM entries per key.
+type slidingLog struct {
+	hits []hit
+	used int // sum of hits[].cost
+}
+
+type hit struct {
+	at   time.Time
+	cost int
+}
+
+func (s *slidingLog) expire(now time.Time) {
+	cutoff := now.Add(-ratelimit.Window)
+	i := 0
+	for i < len(s.hits) && !s.hits[i].at.After(cutoff) {
+		s.used -= s.hits[i].cost
+		i++
+	}
+	s.hits = s.hits[i:]
+}
+
+func (s *slidingLog) allow(p ratelimit.Policy, cost int, now time.Time) ratelimit.Decision {
+	s.expire(now)
+
+	var retry time.Duration
+	allow := s.used+cost <= p.RPM
+	if allow && cost > 0 {
+		s.hits = append(s.hits, hit{at: now, cost: cost})
+		s.used += cost
+	} else if !allow {
+		// wait until enough of the oldest hits have left the window
+		over := s.used + cost - p.RPM
+		for _, h := range s.hits {
+			over -= h.cost
+			if over <= 0 {
+				retry = h.at.Add(ratelimit.Window).Sub(now)
+				break
+			}
+		}
+	}
+
+	reset := now
+	if len(s.hits) > 0 {
+		reset = s.hits[len(s.hits)-1].at.Add(ratelimit.Window)
+	}
+
+	return ratelimit.Decision{
+		Allowed:      allow,
+		Limit:        p.RPM,
+		Remaining:    p.RPM - s.used,
+		ResetUnixSec: reset.Unix(),
+		RetryAfter:   retry,
+	}
+}
+
+func (s *slidingLog) charge(_ ratelimit.Policy, cost int, now time.Time) {
+	s.expire(now)
+	s.hits = append(s.hits, hit{at: now, cost: cost})
+	s.used += cost
+}
+
+// refund drops cost units from the newest hits.
+func (s *slidingLog) refund(_ ratelimit.Policy, cost int, now time.Time) {
+	s.expire(now)
+	for cost > 0 && len(s.hits) > 0 {
+		h := &s.hits[len(s.hits)-1]
+		n := min(cost, h.cost)
+		h.cost -= n
+		s.used -= n
+		cost -= n
+		if h.cost == 0 {
+			s.hits = s.hits[:len(s.hits)-1]
+		}
+	}
+}
+
+func (s *slidingLog) clone() state {
+	return &slidingLog{hits: slices.Clone(s.hits), used: s.used}
+}
+
+func (s *slidingLog) idle(_ ratelimit.Policy, now time.Time) bool {
+	return len(s.hits) == 0 || !s.hits[len(s.hits)-1].at.After(now.Add(-ratelimit.Window))
+}
+
+// slidingCounter approximates a rolling window by weighting the previous
+// fixed window's count by how much of it still overlaps the rolling one.
+type slidingCounter struct {
+	start      time.Time
+	curr, prev int
+}
+
+func (s *slidingCounter) roll(now time.Time) {
+	if start := now.Truncate(ratelimit.Window); start.After(s.start) {
+		if start.Sub(s.start) == ratelimit.Window {
+			s.prev = s.curr
+		} else {
+			s.prev = 0
+		}
+		s.start, s.curr = start, 0
+	}
+}
+
+func (s *slidingCounter) allow(p ratelimit.Policy, cost int, now time.Time) ratelimit.Decision {
+	s.roll(now)
+
+	weight := 1 - float64(now.Sub(s.start))/float64(ratelimit.Window)
+	used := float64(s.prev)*weight + float64(s.curr)
+
+	var retry time.Duration
+	allow := used+float64(cost) <= float64(p.RPM)
+	if allow {
+		s.curr += cost
+		used += float64(cost)
+	} else {
+		retry = s.retryAfter(p, cost, now)
+	}
+
+	return ratelimit.Decision{
+		Allowed:      allow,
+		Limit:        p.RPM,
+		Remaining:    max(p.RPM-int(used+0.999999), 0),
+		ResetUnixSec: s.start.Add(2 * ratelimit.Window).Unix(),
+		RetryAfter:   retry,
+	}
+}
+
+// retryAfter solves prev*weight(t) + curr + cost <= RPM for t, first in the
+// current window and otherwise in the next one, where curr becomes prev.
+func (s *slidingCounter) retryAfter(p ratelimit.Policy, cost int, now time.Time) time.Duration {
+	w := float64(ratelimit.Window)
+	if room := float64(p.RPM - s.curr - cost); room >= 0 && s.prev > 0 {
+		at := s.start.Add(time.Duration(w * (1 - room/float64(s.prev))))
+		return at.Sub(now)
+	}
+	next := s.start.Add(ratelimit.Window)
+	if room := float64(p.RPM - cost); room >= 0 && s.curr > 0 {
+		next = next.Add(time.Duration(w * max(1-room/float64(s.curr), 0)))
+	}
+	return next.Sub(now)
+}
+
+func (s *slidingCounter) charge(_ ratelimit.Policy, cost int, now time.Time) {
+	s.roll(now)
+	s.curr += cost
+}
+
+func (s *slidingCounter) refund(_ ratelimit.Policy, cost int, now time.Time) {
+	s.roll(now)
+	s.curr = max(s.curr-cost, 0)
+}
+
+func (s *slidingCounter) clone() state { c := *s; return &c }
+
+func (s *slidingCounter) idle(_ ratelimit.Policy, now time.Time) bool {
+	return !now.Before(s.start.Add(2 * ratelimit.Window))
+}
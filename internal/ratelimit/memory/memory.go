@@ -1,79 +1,420 @@
 package memory
 
 import (
+	"container/list"
 	"context"
+	"hash/maphash"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AlexKimmel/GateLite/internal/ratelimit"
 )
 
+// Eviction reasons passed to Options.OnEvict.
+const (
+	EvictIdle     = "idle"     // bucket was back to full capacity
+	EvictCapacity = "capacity" // least recently used key over MaxKeys
+)
+
+type Options struct {
+	Shards          int           // independent maps to reduce lock contention; default 32
+	MaxKeys         int           // hard cap on tracked keys, split across shards; 0 is unbounded
+	JanitorInterval time.Duration // idle sweep period; default 1m, negative disables
+	OnEvict         func(reason string)
+}
+
 type bucket struct {
-	mu         sync.Mutex
-	token      float64
-	lastRefill time.Time
+	mu  sync.Mutex
+	alg ratelimit.Algorithm
+	p   ratelimit.Policy // last policy applied, used to judge idleness
+	st  state
+}
+
+func (b *bucket) idle(now time.Time) bool {
+	return b.st.idle(b.p, now)
+}
+
+// grant is a key's bonus. Grants are kept apart from the buckets so
+// evicting a bucket does not forfeit them.
+type grant struct {
+	n     int
+	until time.Time
+}
+
+type entry struct {
+	key string
+	b   *bucket
+}
+
+// shard is an LRU of buckets: front is most recently used.
+type shard struct {
+	mu    sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List
+	max   int
 }
 
 type Limiter struct {
-	now    func() time.Time
-	bucket sync.Map
+	now     func() time.Time
+	seed    maphash.Seed
+	shards  []*shard
+	size    atomic.Int64
+	onEvict func(reason string)
+
+	grantMu sync.Mutex
+	grants  map[string]grant
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
 }
 
-func New() *Limiter {
-	return &Limiter{
-		now: time.Now,
+func New(o Options) *Limiter {
+	if o.Shards <= 0 {
+		o.Shards = 32
+	}
+	if o.JanitorInterval == 0 {
+		o.JanitorInterval = time.Minute
+	}
+	if o.MaxKeys > 0 {
+		o.Shards = min(o.Shards, o.MaxKeys)
+	}
+
+	l := &Limiter{
+		now:     time.Now,
+		seed:    maphash.MakeSeed(),
+		shards:  make([]*shard, o.Shards),
+		onEvict: o.OnEvict,
+		grants:  map[string]grant{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for i := range l.shards {
+		// the per-shard caps add up to exactly MaxKeys
+		perShard := 0
+		if o.MaxKeys > 0 {
+			perShard = o.MaxKeys / o.Shards
+			if i < o.MaxKeys%o.Shards {
+				perShard++
+			}
+		}
+		l.shards[i] = &shard{items: map[string]*list.Element{}, lru: list.New(), max: perShard}
+	}
+
+	if o.JanitorInterval > 0 {
+		go l.janitor(o.JanitorInterval)
+	} else {
+		close(l.done)
 	}
+	return l
 }
 
-func (l *Limiter) Close() error { return nil }
+// Close stops the janitor and waits for it to exit.
+func (l *Limiter) Close() error {
+	l.stopOnce.Do(func() { close(l.stop) })
+	<-l.done
+	return nil
+}
+
+// Len returns the number of tracked buckets.
+func (l *Limiter) Len() int { return int(l.size.Load()) }
 
-func (l *Limiter) Allow(_ context.Context, key string, p ratelimit.Policy, now time.Time) (ratelimit.Decision, error) {
-	if p.RPM <= 0 || p.Burst <= 0 {
+func (l *Limiter) Allow(_ context.Context, key string, p ratelimit.Policy, cost int, now time.Time) (ratelimit.Decision, error) {
+	if ratelimit.Unlimited(p) {
 		return ratelimit.Decision{Allowed: true, Limit: 60, Remaining: 60, ResetUnixSec: 0}, nil
 	}
+	cost = max(cost, 1)
+	if cost > ratelimit.Capacity(p) {
+		return ratelimit.Decision{}, ratelimit.ErrCostExceedsCapacity
+	}
 
-	refillPerSec := float64(p.RPM) / 60
-	capacity := float64(p.Burst)
+	b := l.lock(key, p, now)
+	defer b.mu.Unlock()
 
-	// create bucket
-	v, _ := l.bucket.LoadOrStore(key, &bucket{
-		token:      capacity,
-		lastRefill: now,
-	})
+	d := b.st.allow(p, cost, now)
+	if !d.Allowed && l.drawBonus(key, cost, now) {
+		d.Allowed, d.RetryAfter, d.FromBonus = true, 0, true
+	}
+	d.Bonus = l.bonusLeft(key, now)
+	return d, nil
+}
 
-	b := v.(*bucket)
+func (l *Limiter) Charge(_ context.Context, key string, p ratelimit.Policy, cost int, now time.Time) error {
+	if ratelimit.Unlimited(p) || cost <= 0 {
+		return nil
+	}
 
-	b.mu.Lock()
+	b := l.lock(key, p, now)
 	defer b.mu.Unlock()
 
-	// refill tokens
-	elapsed := now.Sub(b.lastRefill).Seconds()
-	b.token += elapsed * refillPerSec
-	if b.token > capacity {
-		b.token = capacity
+	b.st.charge(p, cost, now)
+	return nil
+}
+
+func (l *Limiter) Refund(_ context.Context, key string, p ratelimit.Policy, cost int, d ratelimit.Decision, now time.Time) error {
+	if ratelimit.Unlimited(p) || !d.Allowed {
+		return nil
 	}
-	b.lastRefill = now
+	cost = max(cost, 1)
 
-	// decide
-	allow := b.token >= 1.0
-	if allow {
-		b.token -= 1.0
+	if d.FromBonus {
+		l.grantMu.Lock()
+		defer l.grantMu.Unlock()
+		// an expired grant stays expired
+		if g, ok := l.grants[key]; ok && now.Before(g.until) {
+			g.n += cost
+			l.grants[key] = g
+		}
+		return nil
 	}
 
-	// estimate reset time (to full)
-	var resetSec int64
-	if b.token >= capacity {
-		resetSec = now.Unix()
-	} else {
-		need := capacity - b.token
-		sec := need / refillPerSec
-		resetSec = now.Add(time.Duration(sec * float64(time.Second))).Unix()
+	b := l.lock(key, p, now)
+	defer b.mu.Unlock()
+
+	b.st.refund(p, cost, now)
+	return nil
+}
+
+func (l *Limiter) Inspect(_ context.Context, key string, p ratelimit.Policy, now time.Time) (ratelimit.Decision, error) {
+	if ratelimit.Unlimited(p) {
+		return ratelimit.Decision{Allowed: true, Limit: 60, Remaining: 60, ResetUnixSec: 0}, nil
 	}
 
-	return ratelimit.Decision{
-		Allowed:      allow,
-		Limit:        p.RPM,
-		Remaining:    int(b.token),
-		ResetUnixSec: resetSec,
-	}, nil
+	alg := p.Algorithm
+	if alg == "" {
+		alg = ratelimit.TokenBucket
+	}
+	// evaluate a copy: looking must not refill, roll or re-policy the bucket
+	// nor touch its LRU position
+	var st state
+	if b, ok := l.peek(key); ok {
+		b.mu.Lock()
+		if b.alg == alg {
+			st = b.st.clone()
+		}
+		b.mu.Unlock()
+	}
+	if st == nil {
+		// a fresh state answers the same as an untracked key
+		st = newState(alg, p, now)
+	}
+
+	d := st.allow(p, 0, now)
+	d.Bonus = l.bonusLeft(key, now)
+	return d, nil
+}
+
+func (l *Limiter) Reset(_ context.Context, key string) error {
+	s := l.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		s.lru.Remove(el)
+		delete(s.items, key)
+		l.size.Add(-1)
+	}
+
+	l.grantMu.Lock()
+	delete(l.grants, key)
+	l.grantMu.Unlock()
+	return nil
+}
+
+func (l *Limiter) Keys(_ context.Context, pattern string) ([]string, error) {
+	seen := map[string]struct{}{}
+	for _, s := range l.shards {
+		s.mu.Lock()
+		for k := range s.items {
+			if ratelimit.MatchKey(pattern, k) {
+				seen[k] = struct{}{}
+			}
+		}
+		s.mu.Unlock()
+	}
+	now := l.now()
+	l.grantMu.Lock()
+	for k, g := range l.grants {
+		if ratelimit.MatchKey(pattern, k) && now.Before(g.until) {
+			seen[k] = struct{}{}
+		}
+	}
+	l.grantMu.Unlock()
+
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (l *Limiter) Grant(_ context.Context, key string, n int, ttl time.Duration, now time.Time) error {
+	l.grantMu.Lock()
+	defer l.grantMu.Unlock()
+
+	l.grants[key] = grant{n: l.bonusLeftLocked(key, now) + n, until: now.Add(ttl)}
+	return nil
+}
+
+// bonusLeft returns key's unexpired bonus units.
+func (l *Limiter) bonusLeft(key string, now time.Time) int {
+	l.grantMu.Lock()
+	defer l.grantMu.Unlock()
+	return l.bonusLeftLocked(key, now)
+}
+
+func (l *Limiter) bonusLeftLocked(key string, now time.Time) int {
+	if g, ok := l.grants[key]; ok && now.Before(g.until) {
+		return g.n
+	}
+	return 0
+}
+
+// drawBonus takes cost units from key's bonus if enough are left.
+func (l *Limiter) drawBonus(key string, cost int, now time.Time) bool {
+	l.grantMu.Lock()
+	defer l.grantMu.Unlock()
+
+	if l.bonusLeftLocked(key, now) < cost {
+		return false
+	}
+	g := l.grants[key]
+	g.n -= cost
+	l.grants[key] = g
+	return true
+}
+
+// peek returns key's bucket without creating it or touching the LRU order.
+func (l *Limiter) peek(key string) (*bucket, bool) {
+	s := l.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	return el.Value.(*entry).b, true
+}
+
+func (l *Limiter) shardFor(key string) *shard {
+	return l.shards[maphash.String(l.seed, key)%uint64(len(l.shards))]
+}
+
+// lock returns key's bucket, locked and set up for p.
+func (l *Limiter) lock(key string, p ratelimit.Policy, now time.Time) *bucket {
+	alg := p.Algorithm
+	if alg == "" {
+		alg = ratelimit.TokenBucket
+	}
+
+	var b *bucket
+	for {
+		b = l.bucketFor(key, alg, p, now)
+		b.mu.Lock()
+		// evicted or reset before we got the lock: its updates would be
+		// lost, so start again with the key's current bucket
+		if l.owns(key, b) {
+			break
+		}
+		b.mu.Unlock()
+	}
+
+	// policy switched algorithms: start over
+	if b.alg != alg {
+		b.alg = alg
+		b.st = newState(alg, p, now)
+	}
+	b.p = p
+	return b
+}
+
+// bucketFor returns the bucket for key, creating it (and evicting the least
+// recently used key if the shard is full) when needed.
+func (l *Limiter) bucketFor(key string, alg ratelimit.Algorithm, p ratelimit.Policy, now time.Time) *bucket {
+	s := l.shardFor(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		s.lru.MoveToFront(el)
+		return el.Value.(*entry).b
+	}
+
+	b := &bucket{alg: alg, p: p, st: newState(alg, p, now)}
+	s.items[key] = s.lru.PushFront(&entry{key: key, b: b})
+	l.size.Add(1)
+
+	for s.max > 0 && s.lru.Len() > s.max {
+		l.remove(s, s.lru.Back(), EvictCapacity)
+	}
+	return b
+}
+
+// owns reports whether b is still key's tracked bucket.
+func (l *Limiter) owns(key string, b *bucket) bool {
+	s := l.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	return ok && el.Value.(*entry).b == b
+}
+
+// remove drops el from s. Callers hold s.mu.
+func (l *Limiter) remove(s *shard, el *list.Element, reason string) {
+	s.lru.Remove(el)
+	delete(s.items, el.Value.(*entry).key)
+	l.size.Add(-1)
+	if l.onEvict != nil {
+		l.onEvict(reason)
+	}
+}
+
+func (l *Limiter) janitor(every time.Duration) {
+	defer close(l.done)
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+			l.sweep(l.now())
+		}
+	}
+}
+
+// sweep drops buckets that are back to full capacity, since recreating them
+// on the next request gives the same decision, and expired grants.
+func (l *Limiter) sweep(now time.Time) {
+	l.grantMu.Lock()
+	for k, g := range l.grants {
+		if !now.Before(g.until) {
+			delete(l.grants, k)
+		}
+	}
+	l.grantMu.Unlock()
+
+	for _, s := range l.shards {
+		s.mu.Lock()
+		for el := s.lru.Back(); el != nil; {
+			prev := el.Prev()
+			b := el.Value.(*entry).b
+			// skip buckets in use; they are clearly not idle
+			if b.mu.TryLock() {
+				idle := b.idle(now)
+				b.mu.Unlock()
+				if idle {
+					l.remove(s, el, EvictIdle)
+				}
+			}
+			el = prev
+		}
+		s.mu.Unlock()
+	}
 }
@@ -0,0 +1,95 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+	"github.com/AlexKimmel/GateLite/internal/ratelimit/ratelimittest"
+)
+
+func TestMaxKeysIsGlobal(t *testing.T) {
+	for _, max := range []int{1, 10, 100, 1000} {
+		l := New(Options{Shards: 32, MaxKeys: max, JanitorInterval: -1})
+		now := time.Now()
+		for i := range 5 * max {
+			if _, err := l.Allow(context.Background(), fmt.Sprint("k", i), ratelimit.Policy{RPM: 60, Burst: 5}, 1, now); err != nil {
+				t.Fatal(err)
+			}
+			if n := l.Len(); n > max {
+				t.Fatalf("MaxKeys %d: tracking %d keys", max, n)
+			}
+		}
+		_ = l.Close()
+	}
+}
+
+func TestGrantSurvivesEviction(t *testing.T) {
+	ctx := context.Background()
+	l := New(Options{Shards: 1, MaxKeys: 1, JanitorInterval: -1})
+	defer l.Close()
+	p := ratelimit.Policy{RPM: 60, Burst: 1}
+	now := time.Now()
+
+	if err := l.Grant(ctx, "a", 3, time.Hour, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Allow(ctx, "a", p, 1, now); err != nil {
+		t.Fatal(err)
+	}
+	// evicts a's bucket
+	if _, err := l.Allow(ctx, "b", p, 1, now); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := l.Inspect(ctx, "a", p, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Bonus != 3 {
+		t.Fatalf("bonus after eviction = %d, want 3", d.Bonus)
+	}
+	keys, _ := l.Keys(ctx, "*")
+	if fmt.Sprint(keys) != "[a b]" {
+		t.Fatalf("Keys = %v, want [a b]", keys)
+	}
+}
+
+func TestInspectDoesNotMutate(t *testing.T) {
+	ctx := context.Background()
+	l := New(Options{JanitorInterval: -1})
+	defer l.Close()
+	p := ratelimit.Policy{RPM: 60, Burst: 5}
+	now := time.Now()
+
+	for range 5 {
+		if _, err := l.Allow(ctx, "k", p, 1, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a different algorithm or a later time must not reset or refill k
+	if _, err := l.Inspect(ctx, "k", ratelimit.Policy{RPM: 60, Burst: 5, Algorithm: ratelimit.GCRA}, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Inspect(ctx, "k", p, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := l.Allow(ctx, "k", p, 1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Allowed {
+		t.Fatal("Inspect refilled the bucket")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	ratelimittest.Run(t, func(t *testing.T) ratelimit.Limiter {
+		l := New(Options{JanitorInterval: -1})
+		t.Cleanup(func() { _ = l.Close() })
+		return l
+	})
+}
@@ -0,0 +1,364 @@
+// Package ratelimittest is a conformance suite for ratelimit.Limiter
+// implementations: every backend must make the same decisions for every
+// algorithm.
+package ratelimittest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+)
+
+// Algorithms lists every algorithm the suite covers.
+var Algorithms = []ratelimit.Algorithm{
+	ratelimit.TokenBucket,
+	ratelimit.GCRA,
+	ratelimit.SlidingWindowLog,
+	ratelimit.SlidingWindowCounter,
+	ratelimit.FixedWindow,
+}
+
+// start is 10s into a window, so window-based algorithms don't roll over
+// unless a test moves the clock on purpose.
+var start = time.Date(2030, 1, 1, 0, 0, 10, 0, time.UTC)
+
+// Run runs the suite. newLimiter returns an empty limiter that does no
+// background sweeping; it is called once per test.
+func Run(t *testing.T, newLimiter func(t *testing.T) ratelimit.Limiter) {
+	for _, alg := range Algorithms {
+		t.Run(string(alg), func(t *testing.T) {
+			// 1 unit per second; token_bucket and gcra hold 5, the window
+			// algorithms 60 per minute
+			p := ratelimit.Policy{RPM: 60, Burst: 5, Algorithm: alg}
+			for _, tc := range []struct {
+				name string
+				fn   func(*testing.T, *suite)
+			}{
+				{"Burst", testBurst},
+				{"Refill", testRefill},
+				{"RetryAfter", testRetryAfter},
+				{"Cost", testCost},
+				{"CostAboveCapacity", testCostAboveCapacity},
+				{"ZeroBurst", testZeroBurst},
+				{"WindowEdges", testWindowEdges},
+				{"Charge", testCharge},
+				{"Refund", testRefund},
+				{"Inspect", testInspect},
+				{"Reset", testReset},
+				{"Grant", testGrant},
+				{"Keys", testKeys},
+			} {
+				t.Run(tc.name, func(t *testing.T) {
+					tc.fn(t, &suite{t: t, l: newLimiter(t), p: p})
+				})
+			}
+		})
+	}
+}
+
+type suite struct {
+	t *testing.T
+	l ratelimit.Limiter
+	p ratelimit.Policy
+}
+
+func (s *suite) capacity() int { return ratelimit.Capacity(s.p) }
+
+func (s *suite) allow(cost int, at time.Time) ratelimit.Decision {
+	s.t.Helper()
+	d, err := s.l.Allow(context.Background(), "k", s.p, cost, at)
+	if err != nil {
+		s.t.Fatalf("Allow(cost %d, %v): %v", cost, at.Sub(start), err)
+	}
+	return d
+}
+
+// take expects n requests of cost 1 at at to be allowed.
+func (s *suite) take(n int, at time.Time) {
+	s.t.Helper()
+	for i := range n {
+		if d := s.allow(1, at); !d.Allowed {
+			s.t.Fatalf("request %d of %d at %v denied: %+v", i+1, n, at.Sub(start), d)
+		}
+	}
+}
+
+// denied expects a request of cost 1 at at to be denied.
+func (s *suite) denied(at time.Time) ratelimit.Decision {
+	s.t.Helper()
+	d := s.allow(1, at)
+	if d.Allowed {
+		s.t.Fatalf("request at %v allowed, want denied: %+v", at.Sub(start), d)
+	}
+	return d
+}
+
+func (s *suite) windowed() bool {
+	return ratelimit.Capacity(s.p) == s.p.RPM
+}
+
+func testBurst(t *testing.T, s *suite) {
+	s.take(s.capacity(), start)
+	d := s.denied(start)
+	if d.Remaining != 0 {
+		t.Fatalf("remaining %d after the burst, want 0", d.Remaining)
+	}
+	if d.Limit != s.p.RPM {
+		t.Fatalf("limit %d, want %d", d.Limit, s.p.RPM)
+	}
+}
+
+func testRefill(t *testing.T, s *suite) {
+	s.take(s.capacity(), start)
+	s.denied(start)
+
+	if !s.windowed() {
+		// one unit per second
+		s.take(2, start.Add(2*time.Second))
+		s.denied(start.Add(2 * time.Second))
+	}
+
+	// two windows later everything has refilled or expired
+	later := start.Add(2 * ratelimit.Window)
+	s.take(s.capacity(), later)
+	s.denied(later)
+}
+
+func testRetryAfter(t *testing.T, s *suite) {
+	s.take(s.capacity(), start)
+	d := s.denied(start)
+	if d.RetryAfter <= 0 {
+		t.Fatalf("retry after %v, want > 0", d.RetryAfter)
+	}
+
+	s.denied(start.Add(d.RetryAfter - 50*time.Millisecond))
+	s.take(1, start.Add(d.RetryAfter+time.Millisecond))
+}
+
+func testCost(t *testing.T, s *suite) {
+	if d := s.allow(s.capacity()-1, start); !d.Allowed || d.Remaining != 1 {
+		t.Fatalf("cost %d: %+v, want allowed with 1 remaining", s.capacity()-1, d)
+	}
+	d := s.allow(2, start)
+	if d.Allowed {
+		t.Fatalf("cost 2 with 1 remaining allowed: %+v", d)
+	}
+	if d.RetryAfter <= 0 {
+		t.Fatalf("cost 2: retry after %v, want > 0", d.RetryAfter)
+	}
+	// the retry is for the whole cost
+	if d := s.allow(2, start.Add(d.RetryAfter-50*time.Millisecond)); d.Allowed {
+		t.Fatalf("cost 2 allowed before its retry: %+v", d)
+	}
+	if d := s.allow(2, start.Add(d.RetryAfter+time.Millisecond)); !d.Allowed {
+		t.Fatalf("cost 2 denied after its retry: %+v", d)
+	}
+}
+
+func testCostAboveCapacity(t *testing.T, s *suite) {
+	_, err := s.l.Allow(context.Background(), "k", s.p, s.capacity()+1, start)
+	if !errors.Is(err, ratelimit.ErrCostExceedsCapacity) {
+		t.Fatalf("cost %d: err = %v, want ErrCostExceedsCapacity", s.capacity()+1, err)
+	}
+	// the budget is untouched
+	s.take(s.capacity(), start)
+}
+
+// testZeroBurst checks that Burst only matters to the algorithms that use
+// it: a window policy without one is still enforced.
+func testZeroBurst(t *testing.T, s *suite) {
+	s.p.Burst = 0
+	if !s.windowed() {
+		for range 2 * s.p.RPM {
+			if d := s.allow(1, start); !d.Allowed {
+				t.Fatalf("no burst: %+v, want unlimited", d)
+			}
+		}
+		return
+	}
+	s.take(s.p.RPM, start)
+	s.denied(start)
+}
+
+func testWindowEdges(t *testing.T, s *suite) {
+	windowStart := start.Truncate(ratelimit.Window)
+	half := s.p.RPM / 2
+
+	switch s.p.Algorithm {
+	case ratelimit.SlidingWindowLog:
+		// each half leaves the window exactly one window after it came in
+		s.take(half, start)
+		s.take(half, start.Add(30*time.Second))
+		s.denied(start.Add(ratelimit.Window - time.Millisecond))
+		s.take(half, start.Add(ratelimit.Window))
+		s.denied(start.Add(ratelimit.Window))
+
+	case ratelimit.SlidingWindowCounter:
+		// halfway into the next window the previous one weighs half
+		s.take(s.p.RPM, start)
+		s.take(half, windowStart.Add(ratelimit.Window+30*time.Second))
+		s.denied(windowStart.Add(ratelimit.Window + 30*time.Second))
+
+	case ratelimit.FixedWindow:
+		// a full window at the end of one and the start of the next
+		end := windowStart.Add(ratelimit.Window - time.Millisecond)
+		s.take(s.p.RPM, end)
+		s.denied(end)
+		s.take(s.p.RPM, end.Add(time.Millisecond))
+		s.denied(end.Add(time.Millisecond))
+
+	default:
+		t.Skip("no windows")
+	}
+}
+
+func testCharge(t *testing.T, s *suite) {
+	ctx := context.Background()
+	if err := s.l.Charge(ctx, "k", s.p, s.capacity()-1, start); err != nil {
+		t.Fatal(err)
+	}
+	s.take(1, start)
+	s.denied(start)
+
+	// charging past the budget goes into debt, which takes longer to
+	// work off than an empty budget
+	if err := s.l.Charge(ctx, "k", s.p, 3, start); err != nil {
+		t.Fatal(err)
+	}
+	d := s.denied(start)
+	if !s.windowed() && d.RetryAfter < 3*time.Second {
+		t.Fatalf("retry after %v in debt, want at least 3s", d.RetryAfter)
+	}
+}
+
+func testRefund(t *testing.T, s *suite) {
+	ctx := context.Background()
+	s.take(s.capacity()-2, start)
+	d := s.allow(2, start)
+	if err := s.l.Refund(ctx, "k", s.p, 2, d, start); err != nil {
+		t.Fatal(err)
+	}
+	s.take(2, start)
+	s.denied(start)
+
+	// a denied Allow took nothing, so there is nothing to give back
+	d = s.denied(start)
+	if err := s.l.Refund(ctx, "k", s.p, 1, d, start); err != nil {
+		t.Fatal(err)
+	}
+	s.denied(start)
+
+	// a bonus draw goes back to the bonus
+	if err := s.l.Grant(ctx, "k", 1, time.Hour, start); err != nil {
+		t.Fatal(err)
+	}
+	d = s.allow(1, start)
+	if !d.Allowed || !d.FromBonus {
+		t.Fatalf("bonus draw: %+v, want allowed from the bonus", d)
+	}
+	if err := s.l.Refund(ctx, "k", s.p, 1, d, start); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := s.l.Inspect(ctx, "k", s.p, start); err != nil || d.Bonus != 1 || d.Remaining != 0 {
+		t.Fatalf("after refunding the bonus: %+v, %v; want 1 bonus and 0 remaining", d, err)
+	}
+}
+
+func testInspect(t *testing.T, s *suite) {
+	ctx := context.Background()
+	inspect := func(at time.Time) ratelimit.Decision {
+		t.Helper()
+		d, err := s.l.Inspect(ctx, "k", s.p, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	if d := inspect(start); d.Remaining != s.capacity() {
+		t.Fatalf("untouched key: remaining %d, want %d", d.Remaining, s.capacity())
+	}
+	s.take(2, start)
+	for range 3 {
+		if d := inspect(start); d.Remaining != s.capacity()-2 {
+			t.Fatalf("after 2: remaining %d, want %d", d.Remaining, s.capacity()-2)
+		}
+	}
+	// looking ahead in time must not refill the bucket either
+	inspect(start.Add(time.Hour))
+	s.take(s.capacity()-2, start)
+	s.denied(start)
+}
+
+func testReset(t *testing.T, s *suite) {
+	ctx := context.Background()
+	s.take(s.capacity(), start)
+	if err := s.l.Grant(ctx, "k", 1, time.Hour, start); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.l.Reset(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	s.take(s.capacity(), start)
+	s.denied(start) // the bonus went too
+}
+
+func testGrant(t *testing.T, s *suite) {
+	ctx := context.Background()
+	if err := s.l.Grant(ctx, "k", 2, time.Hour, start); err != nil {
+		t.Fatal(err)
+	}
+	d, err := s.l.Inspect(ctx, "k", s.p, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Bonus != 2 {
+		t.Fatalf("bonus %d, want 2", d.Bonus)
+	}
+
+	// drawn on only once the regular budget is gone
+	s.take(s.capacity(), start)
+	for left := 1; left >= 0; left-- {
+		if d := s.allow(1, start); !d.Allowed || d.Bonus != left {
+			t.Fatalf("bonus draw: %+v, want allowed with %d left", d, left)
+		}
+	}
+	s.denied(start)
+}
+
+func testKeys(t *testing.T, s *suite) {
+	ctx := context.Background()
+	// key_by values from headers or path parameters may hold '/'
+	for _, k := range []string{"r:a", "r:a/b", "r:ab", "r:[x]", "g:a"} {
+		if _, err := s.l.Allow(ctx, k, s.p, 1, start); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.l.Grant(ctx, "r:bonus-only", 1, time.Hour, start); err != nil {
+		t.Fatal(err)
+	}
+
+	for pattern, want := range map[string]string{
+		"*":       "[g:a r:[x] r:a r:a/b r:ab r:bonus-only]",
+		"r:*":     "[r:[x] r:a r:a/b r:ab r:bonus-only]",
+		"r:a*":    "[r:a r:a/b r:ab]",
+		"r:a?":    "[r:ab]",
+		"r:a?b":   "[r:a/b]",
+		"r:[ab]*": "[r:a r:a/b r:ab r:bonus-only]",
+		`r:\[*`:   "[r:[x]]",
+		"r:a":     "[r:a]",
+		"none":    "[]",
+	} {
+		keys, err := s.l.Keys(ctx, pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(keys); got != want && !(want == "[]" && keys == nil) {
+			t.Errorf("Keys(%q) = %v, want %s", pattern, got, want)
+		}
+	}
+}
@@ -0,0 +1,531 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Every script takes the cost and a mode as its last two arguments (1
+// forces the debit even when over the limit, see Charge; 2 only peeks, see
+// Inspect; 3 gives cost back, see Refund) and the key's bonus as its last
+// key, and returns {allowed, remaining, reset_ms, retry_ms, bonus}: reset_ms
+// is when the limit would be fully available again, retry_ms how long until
+// the same request would be allowed (-1 if never), and bonus the units left
+// after drawing on the bonus (-1 if not drawn). Fractional state is stored as
+// strings because Redis truncates Lua numbers to integers.
+
+// drawBonus is shared by every script: in mode 0, a request the limit
+// denied draws cost units from the bonus if enough are left, in the same
+// script so concurrent gateways cannot both spend the last of it.
+const drawBonus = `
+local function draw_bonus(mode, allowed, retry, cost)
+  if mode ~= '0' or allowed == 1 or retry < 0 then
+    return allowed, retry, -1
+  end
+  local n = tonumber(redis.call('GET', KEYS[#KEYS]) or '0')
+  if n < cost then
+    return allowed, retry, -1
+  end
+  return 1, 0, redis.call('DECRBY', KEYS[#KEYS], cost)
+end
+`
+
+// tokenBucket refills and takes tokens atomically. The bucket is a hash
+// {tokens, ts}; ts never moves backwards so replicas with slightly skewed
+// clocks can't mint tokens.
+var tokenBucket = goredis.NewScript(drawBonus + `
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local force = ARGV[5] == '1'
+local peek = ARGV[5] == '2'
+local refund = ARGV[5] == '3'
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+  tokens = capacity
+  ts = now
+end
+
+if now > ts then
+  tokens = math.min(capacity, tokens + (now - ts) / 1000 * rate)
+  ts = now
+end
+if refund then
+  tokens = math.min(capacity, tokens + cost)
+  cost = 0
+end
+
+local allowed = 0
+local retry = 0
+if force or tokens >= cost then
+  tokens = tokens - cost
+  allowed = 1
+else
+  retry = math.ceil((cost - tokens) / rate * 1000)
+end
+
+local full = math.ceil((capacity - tokens) / rate * 1000)
+if not peek then
+  redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', ts)
+  redis.call('PEXPIRE', KEYS[1], full + 1000)
+end
+local bonus
+allowed, retry, bonus = draw_bonus(ARGV[5], allowed, retry, cost)
+return {allowed, math.floor(tokens), now + full, retry, bonus}
+`)
+
+// gcra stores the theoretical arrival time of the next request.
+var gcra = goredis.NewScript(drawBonus + `
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local force = ARGV[5] == '1'
+local peek = ARGV[5] == '2'
+local refund = ARGV[5] == '3'
+
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if refund then
+  tat = tat - interval * cost
+  cost = 0
+end
+if tat < now then
+  tat = now
+end
+
+local nxt = tat + interval * cost
+local allowed = 0
+local retry = 0
+if force or nxt - now <= tolerance then
+  allowed = 1
+  if not peek then
+    redis.call('SET', KEYS[1], string.format('%.3f', nxt), 'PX', math.ceil(nxt - now) + 1000)
+  end
+else
+  retry = math.ceil(nxt - now - tolerance)
+  nxt = tat
+end
+local bonus
+allowed, retry, bonus = draw_bonus(ARGV[5], allowed, retry, cost)
+return {allowed, math.floor((tolerance - (nxt - now)) / interval), math.ceil(nxt), retry, bonus}
+`)
+
+// fixedWindow counts into a key per window; KEYS[1] embeds the window start.
+var fixedWindow = goredis.NewScript(drawBonus + `
+local limit = tonumber(ARGV[1])
+local reset = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local force = ARGV[5] == '1'
+local peek = ARGV[5] == '2'
+local refund = ARGV[5] == '3'
+
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+if refund then
+  if count > 0 then
+    count = redis.call('DECRBY', KEYS[1], math.min(cost, count))
+  end
+  cost = 0
+end
+local allowed = 0
+local retry = 0
+if force or count + cost <= limit then
+  if not peek then
+    count = redis.call('INCRBY', KEYS[1], cost)
+    redis.call('PEXPIRE', KEYS[1], reset - now + 1000)
+  end
+  allowed = 1
+else
+  retry = reset - now
+end
+local bonus
+allowed, retry, bonus = draw_bonus(ARGV[5], allowed, retry, cost)
+return {allowed, limit - count, reset, retry, bonus}
+`)
+
+// slidingLog keeps accepted request timestamps in a sorted set, one member
+// per cost unit. Peeks neither add members nor prune expired ones, so
+// entries are only counted within the window.
+var slidingLog = goredis.NewScript(drawBonus + `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[5])
+local force = ARGV[6] == '1'
+local peek = ARGV[6] == '2'
+local refund = ARGV[6] == '3'
+
+local live = '(' .. (now - window)
+if not peek then
+  redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+end
+if refund then
+  -- drop the newest entries
+  redis.call('ZREMRANGEBYRANK', KEYS[1], -cost, -1)
+  cost = 0
+end
+local n = redis.call('ZCOUNT', KEYS[1], live, '+inf')
+local allowed = 0
+local retry = 0
+if force or n + cost <= limit then
+  if not peek then
+    for i = 1, cost do
+      redis.call('ZADD', KEYS[1], now, ARGV[4] .. ':' .. i)
+    end
+  end
+  n = n + cost
+  allowed = 1
+else
+  -- wait until enough of the oldest entries have left the window; if
+  -- fewer are logged than need to leave, no wait is enough
+  local over = n + cost - limit
+  retry = -1
+  local oldest = redis.call('ZRANGEBYSCORE', KEYS[1], live, '+inf', 'WITHSCORES', 'LIMIT', over - 1, 1)
+  if oldest[2] then
+    retry = tonumber(oldest[2]) + window - now
+  end
+end
+if not peek then
+  redis.call('PEXPIRE', KEYS[1], window)
+end
+
+local reset = now
+local newest = redis.call('ZREVRANGEBYSCORE', KEYS[1], '+inf', live, 'WITHSCORES', 'LIMIT', 0, 1)
+if newest[2] then
+  reset = tonumber(newest[2]) + window
+end
+local bonus
+allowed, retry, bonus = draw_bonus(ARGV[6], allowed, retry, cost)
+return {allowed, limit - n, reset, retry, bonus}
+`)
+
+// slidingCounter weights the previous window (KEYS[2]) by its overlap with
+// the rolling window and adds the current one (KEYS[1]).
+var slidingCounter = goredis.NewScript(drawBonus + `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local start = tonumber(ARGV[4])
+local cost = tonumber(ARGV[5])
+local force = ARGV[6] == '1'
+local peek = ARGV[6] == '2'
+local refund = ARGV[6] == '3'
+
+local curr = tonumber(redis.call('GET', KEYS[1]) or '0')
+local prev = tonumber(redis.call('GET', KEYS[2]) or '0')
+if refund then
+  if curr > 0 then
+    curr = redis.call('DECRBY', KEYS[1], math.min(cost, curr))
+  end
+  cost = 0
+end
+local used = prev * (1 - (now - start) / window) + curr
+
+local allowed = 0
+local retry = 0
+if force or used + cost <= limit then
+  if not peek then
+    redis.call('INCRBY', KEYS[1], cost)
+    redis.call('PEXPIRE', KEYS[1], window * 2 + 1000)
+  end
+  used = used + cost
+  allowed = 1
+else
+  -- solve prev * weight(t) + curr + cost <= limit, in this window or the next
+  local at = start + window
+  if limit - curr - cost >= 0 and prev > 0 then
+    at = start + window * (1 - (limit - curr - cost) / prev)
+  elseif limit - cost >= 0 and curr > 0 then
+    at = at + window * math.max(1 - (limit - cost) / curr, 0)
+  end
+  retry = math.ceil(at - now)
+end
+local bonus
+allowed, retry, bonus = draw_bonus(ARGV[6], allowed, retry, cost)
+return {allowed, math.max(limit - math.ceil(used), 0), start + 2 * window, retry, bonus}
+`)
+
+// refundBonus gives cost units back to a bonus (KEYS[1]) that has not
+// expired meanwhile.
+var refundBonus = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+  redis.call('INCRBY', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// script modes, see above
+const (
+	modeAllow  = 0
+	modeForce  = 1
+	modePeek   = 2
+	modeRefund = 3
+)
+
+type Options struct {
+	Addr         string // with Cluster, any node; the rest are discovered
+	Cluster      bool   // Redis Cluster instead of a single server
+	Username     string
+	Password     string
+	DB           int
+	PoolSize     int           // max connections; 0 uses the go-redis default
+	MinIdleConns int           // warm connections kept in the pool
+	DialTimeout  time.Duration // 0 uses the go-redis default
+	Timeout      time.Duration // per-command read/write timeout
+	KeyPrefix    string        // defaults to "gatelite:rl:"
+}
+
+// Limiter keeps buckets in Redis so every gateway replica shares them.
+type Limiter struct {
+	client goredis.UniversalClient
+	prefix string
+	seq    atomic.Uint64 // makes sliding-log members unique
+}
+
+func New(o Options) *Limiter {
+	prefix := o.KeyPrefix
+	if prefix == "" {
+		prefix = "gatelite:rl:"
+	}
+	var client goredis.UniversalClient
+	if o.Cluster {
+		client = goredis.NewClusterClient(&goredis.ClusterOptions{
+			Addrs:        []string{o.Addr},
+			Username:     o.Username,
+			Password:     o.Password,
+			PoolSize:     o.PoolSize,
+			MinIdleConns: o.MinIdleConns,
+			DialTimeout:  o.DialTimeout,
+			ReadTimeout:  o.Timeout,
+			WriteTimeout: o.Timeout,
+		})
+	} else {
+		client = goredis.NewClient(&goredis.Options{
+			Addr:         o.Addr,
+			Username:     o.Username,
+			Password:     o.Password,
+			DB:           o.DB,
+			PoolSize:     o.PoolSize,
+			MinIdleConns: o.MinIdleConns,
+			DialTimeout:  o.DialTimeout,
+			ReadTimeout:  o.Timeout,
+			WriteTimeout: o.Timeout,
+		})
+	}
+	return &Limiter{client: client, prefix: prefix}
+}
+
+// Ping checks connectivity, e.g. at startup.
+func (l *Limiter) Ping(ctx context.Context) error {
+	return l.client.Ping(ctx).Err()
+}
+
+func (l *Limiter) Close() error { return l.client.Close() }
+
+func (l *Limiter) Allow(ctx context.Context, key string, p ratelimit.Policy, cost int, now time.Time) (ratelimit.Decision, error) {
+	if ratelimit.Unlimited(p) {
+		return ratelimit.Decision{Allowed: true, Limit: 60, Remaining: 60, ResetUnixSec: 0}, nil
+	}
+
+	cost = max(cost, 1)
+	if cost > ratelimit.Capacity(p) {
+		return ratelimit.Decision{}, ratelimit.ErrCostExceedsCapacity
+	}
+	return l.decide(ctx, key, p, cost, modeAllow, now)
+}
+
+func (l *Limiter) Charge(ctx context.Context, key string, p ratelimit.Policy, cost int, now time.Time) error {
+	if ratelimit.Unlimited(p) || cost <= 0 {
+		return nil
+	}
+	return l.run(ctx, key, p, cost, modeForce, now).Err()
+}
+
+func (l *Limiter) Refund(ctx context.Context, key string, p ratelimit.Policy, cost int, d ratelimit.Decision, now time.Time) error {
+	if ratelimit.Unlimited(p) || !d.Allowed {
+		return nil
+	}
+	cost = max(cost, 1)
+	if d.FromBonus {
+		return refundBonus.Run(ctx, l.client, []string{l.key(key) + ":bonus"}, cost).Err()
+	}
+	return l.run(ctx, key, p, cost, modeRefund, now).Err()
+}
+
+func (l *Limiter) Inspect(ctx context.Context, key string, p ratelimit.Policy, now time.Time) (ratelimit.Decision, error) {
+	if ratelimit.Unlimited(p) {
+		return ratelimit.Decision{Allowed: true, Limit: 60, Remaining: 60, ResetUnixSec: 0}, nil
+	}
+
+	d, err := l.decide(ctx, key, p, 0, modePeek, now)
+	if err != nil {
+		return d, err
+	}
+	n, err := l.client.Get(ctx, l.key(key)+":bonus").Int()
+	if err != nil && err != goredis.Nil {
+		return ratelimit.Decision{}, err
+	}
+	d.Bonus = n
+	return d, nil
+}
+
+// Reset deletes every Redis key of key: its state, window counters and bonus.
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	k := l.key(key)
+	var keys []string
+	err := l.scan(ctx, escapeGlob(k)+"*", func(rk string) { keys = append(keys, rk) })
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	// keys share k's hash tag, so one DEL works under Cluster too
+	return l.client.Del(ctx, keys...).Err()
+}
+
+func (l *Limiter) Keys(ctx context.Context, pattern string) ([]string, error) {
+	// pattern is matched here rather than by SCAN MATCH: keys are stored
+	// escaped, which a pattern cannot always be rewritten to follow, and
+	// MATCH only filters what SCAN walks anyway
+	seen := map[string]struct{}{}
+	err := l.scan(ctx, escapeGlob(l.prefix)+"{*", func(rk string) {
+		k := strings.TrimPrefix(rk, l.prefix+"{")
+		if i := strings.IndexByte(k, '}'); i >= 0 {
+			if k = tagUnescaper.Replace(k[:i]); ratelimit.MatchKey(pattern, k) {
+				seen[k] = struct{}{}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// scan calls fn with every Redis key matching match. SCAN only covers the
+// node it runs on, so under Cluster it runs on every master; fn calls are
+// serialized.
+func (l *Limiter) scan(ctx context.Context, match string, fn func(string)) error {
+	scanNode := func(ctx context.Context, c *goredis.Client, fn func(string)) error {
+		iter := c.Scan(ctx, 0, match, 100).Iterator()
+		for iter.Next(ctx) {
+			fn(iter.Val())
+		}
+		return iter.Err()
+	}
+
+	switch c := l.client.(type) {
+	case *goredis.ClusterClient:
+		var mu sync.Mutex
+		return c.ForEachMaster(ctx, func(ctx context.Context, node *goredis.Client) error {
+			return scanNode(ctx, node, func(k string) {
+				mu.Lock()
+				defer mu.Unlock()
+				fn(k)
+			})
+		})
+	case *goredis.Client:
+		return scanNode(ctx, c, fn)
+	}
+	return fmt.Errorf("unsupported redis client %T", l.client)
+}
+
+func (l *Limiter) Grant(ctx context.Context, key string, n int, ttl time.Duration, _ time.Time) error {
+	k := l.key(key) + ":bonus"
+	_, err := l.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.IncrBy(ctx, k, int64(n))
+		pipe.PExpire(ctx, k, ttl)
+		return nil
+	})
+	return err
+}
+
+func (l *Limiter) decide(ctx context.Context, key string, p ratelimit.Policy, cost, mode int, now time.Time) (ratelimit.Decision, error) {
+	res, err := l.run(ctx, key, p, cost, mode, now).Int64Slice()
+	if err != nil {
+		return ratelimit.Decision{}, err
+	}
+	if res[3] < 0 {
+		return ratelimit.Decision{}, ratelimit.ErrCostExceedsCapacity
+	}
+
+	return ratelimit.Decision{
+		Allowed:      res[0] == 1,
+		Limit:        p.RPM,
+		Remaining:    int(res[1]),
+		ResetUnixSec: time.UnixMilli(res[2]).Unix(),
+		RetryAfter:   time.Duration(res[3]) * time.Millisecond,
+		Bonus:        int(max(res[4], 0)),
+		FromBonus:    res[4] >= 0,
+	}, nil
+}
+
+// key returns the Redis key for a limiter key. The hash tag keeps every key
+// of one limiter key in the same cluster slot; braces in key are escaped so
+// it cannot end the tag early.
+func (l *Limiter) key(key string) string {
+	return l.prefix + "{" + tagEscaper.Replace(key) + "}"
+}
+
+var (
+	tagEscaper   = strings.NewReplacer("%", "%25", "{", "%7B", "}", "%7D")
+	tagUnescaper = strings.NewReplacer("%25", "%", "%7B", "{", "%7D", "}")
+)
+
+// escapeGlob quotes Redis glob metacharacters in s.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// run executes the script for p's algorithm.
+func (l *Limiter) run(ctx context.Context, key string, p ratelimit.Policy, cost, mode int, now time.Time) *goredis.Cmd {
+	k := l.key(key)
+	bonusKey := k + ":bonus"
+	nowMs := now.UnixMilli()
+	windowMs := ratelimit.Window.Milliseconds()
+	start := now.Truncate(ratelimit.Window).UnixMilli()
+
+	switch p.Algorithm {
+	case ratelimit.GCRA:
+		interval := float64(windowMs) / float64(p.RPM)
+		return gcra.Run(ctx, l.client, []string{k, bonusKey}, interval, interval*float64(p.Burst), nowMs, cost, mode)
+	case ratelimit.FixedWindow:
+		return fixedWindow.Run(ctx, l.client, []string{k + ":" + strconv.FormatInt(start, 10), bonusKey},
+			p.RPM, start+windowMs, nowMs, cost, mode)
+	case ratelimit.SlidingWindowLog:
+		member := strconv.FormatInt(now.UnixNano(), 36) + "-" + strconv.FormatUint(l.seq.Add(1), 36)
+		return slidingLog.Run(ctx, l.client, []string{k, bonusKey}, p.RPM, windowMs, nowMs, member, cost, mode)
+	case ratelimit.SlidingWindowCounter:
+		return slidingCounter.Run(ctx, l.client, []string{
+			k + ":" + strconv.FormatInt(start, 10),
+			k + ":" + strconv.FormatInt(start-windowMs, 10),
+			bonusKey,
+		}, p.RPM, windowMs, nowMs, start, cost, mode)
+	default:
+		return tokenBucket.Run(ctx, l.client, []string{k, bonusKey}, float64(p.RPM)/60, p.Burst, nowMs, cost, mode)
+	}
+}
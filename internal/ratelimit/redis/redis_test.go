@@ -0,0 +1,194 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+	"github.com/AlexKimmel/GateLite/internal/ratelimit/ratelimittest"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// The decisions themselves are covered by the conformance suite; the tests
+// here are about how they are kept in Redis.
+
+func TestConformance(t *testing.T) {
+	ratelimittest.Run(t, func(t *testing.T) ratelimit.Limiter {
+		l, _ := newLimiter(t)
+		return l
+	})
+}
+
+func newLimiter(t *testing.T) (*Limiter, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	l := New(Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = l.Close() })
+	return l, mr
+}
+
+// The sliding log reports no retry when fewer entries are logged than
+// would have to expire; the limiter turns that into an error.
+func TestSlidingLogUnreachable(t *testing.T) {
+	l, _ := newLimiter(t)
+	p := ratelimit.Policy{RPM: 5, Burst: 5, Algorithm: ratelimit.SlidingWindowLog}
+
+	_, err := l.decide(context.Background(), "k", p, 6, modeAllow, time.Now())
+	if !errors.Is(err, ratelimit.ErrCostExceedsCapacity) {
+		t.Fatalf("err = %v, want ErrCostExceedsCapacity", err)
+	}
+}
+
+func TestGrantExpires(t *testing.T) {
+	l, mr := newLimiter(t)
+	ctx := context.Background()
+	p := ratelimit.Policy{RPM: 60, Burst: 1}
+	now := time.Now()
+
+	if _, err := l.Allow(ctx, "k", p, 1, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Grant(ctx, "k", 5, time.Second, now); err != nil {
+		t.Fatal(err)
+	}
+	// the drained bucket outlives the grant
+	mr.FastForward(time.Second)
+	if d, err := l.Allow(ctx, "k", p, 1, now); err != nil || d.Allowed {
+		t.Fatalf("expired bonus: %+v, %v; want denied", d, err)
+	}
+	if keys := mr.Keys(); len(keys) != 1 || strings.HasSuffix(keys[0], ":bonus") {
+		t.Fatalf("Redis keys %v, want only the bucket", keys)
+	}
+}
+
+// The bonus is drawn by the limiter script itself: concurrent requests over
+// the limit spend exactly the bonus.
+func TestBonusDrawIsAtomic(t *testing.T) {
+	l, _ := newLimiter(t)
+	ctx := context.Background()
+	p := ratelimit.Policy{RPM: 60, Burst: 1}
+	now := time.Now()
+
+	if _, err := l.Allow(ctx, "k", p, 1, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Grant(ctx, "k", 3, time.Minute, now); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu      sync.Mutex
+		allowed int
+		wg      sync.WaitGroup
+	)
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := l.Allow(ctx, "k", p, 1, now)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if d.Allowed {
+				if !d.FromBonus {
+					t.Errorf("allowed without the bonus: %+v", d)
+				}
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 3 {
+		t.Fatalf("%d requests allowed on a bonus of 3", allowed)
+	}
+}
+
+// Reset deletes every Redis key of a limiter key, whatever the algorithm
+// keeps, and nothing of any other key.
+func TestResetDeletesKeys(t *testing.T) {
+	for _, alg := range ratelimittest.Algorithms {
+		t.Run(string(alg), func(t *testing.T) {
+			l, mr := newLimiter(t)
+			ctx := context.Background()
+			p := ratelimit.Policy{RPM: 60, Burst: 5, Algorithm: alg}
+			now := time.Now()
+
+			for _, k := range []string{"k", "k2"} {
+				if _, err := l.Allow(ctx, k, p, 1, now); err != nil {
+					t.Fatal(err)
+				}
+				// the previous window too
+				if _, err := l.Allow(ctx, k, p, 1, now.Add(-ratelimit.Window)); err != nil {
+					t.Fatal(err)
+				}
+				if err := l.Grant(ctx, k, 1, time.Minute, now); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := l.Reset(ctx, "k"); err != nil {
+				t.Fatal(err)
+			}
+			left := mr.Keys()
+			for _, k := range left {
+				if !strings.HasPrefix(k, l.key("k2")) {
+					t.Fatalf("key %q left after reset", k)
+				}
+			}
+			if len(left) == 0 {
+				t.Fatal("reset deleted the other key's state")
+			}
+		})
+	}
+}
+
+func TestKeys(t *testing.T) {
+	l, _ := newLimiter(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	// braces must not break out of the hash tag, nor let one key's reset
+	// match another's
+	keys := []string{"r:a", "r:a}:x", "r:{b}", "g:a", "r:%7D"}
+	for i, k := range keys {
+		alg := ratelimittest.Algorithms[i%len(ratelimittest.Algorithms)]
+		if _, err := l.Allow(ctx, k, ratelimit.Policy{RPM: 60, Burst: 5, Algorithm: alg}, 1, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Grant(ctx, "bonus-only", 1, time.Minute, now); err != nil {
+		t.Fatal(err)
+	}
+
+	for pattern, want := range map[string]string{
+		"*":    "[bonus-only g:a r:%7D r:a r:a}:x r:{b}]",
+		"r:*":  "[r:%7D r:a r:a}:x r:{b}]",
+		"r:a*": "[r:a r:a}:x]",
+		"g:a":  "[g:a]",
+		"none": "[]",
+	} {
+		got, err := l.Keys(ctx, pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != want {
+			t.Errorf("Keys(%q) = %v, want %s", pattern, got, want)
+		}
+	}
+
+	if err := l.Reset(ctx, "r:a"); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := l.Keys(ctx, "r:a*")
+	if fmt.Sprint(got) != "[r:a}:x]" {
+		t.Fatalf("after Reset(r:a): Keys = %v, want [r:a}:x]", got)
+	}
+}
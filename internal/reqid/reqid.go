@@ -0,0 +1,88 @@
+// Package reqid carries the request ID. It is a leaf package so that auth,
+// gateway, proxy and obs can all use it without import cycles.
+package reqid
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/rs/xid"
+)
+
+const DefaultHeader = "X-Request-ID"
+
+type ctxKey struct{}
+
+func With(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+func From(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(ctxKey{}).(string)
+	return id, ok && id != ""
+}
+
+// Valid reports whether an inbound ID is safe to reuse: 1-128 characters
+// from [A-Za-z0-9._:/+=@-], so it can be echoed in headers, logs and JSON
+// without escaping.
+func Valid(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '/', c == '+', c == '=', c == '@':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware takes the request ID from header when valid and generates one
+// otherwise. The ID is stored in the context, forwarded upstream in the
+// same header and returned to the client, replacing any upstream value.
+func Middleware(header string) func(http.Handler) http.Handler {
+	if header == "" {
+		header = DefaultHeader
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(header)
+			if !Valid(id) {
+				id = xid.New().String()
+			}
+			r.Header.Set(header, id)
+			w.Header().Set(header, id)
+			next.ServeHTTP(&writer{ResponseWriter: w, header: header, id: id}, r.WithContext(With(r.Context(), id)))
+		})
+	}
+}
+
+// writer restores the ID header right before the response is sent, since
+// the proxy copies the upstream's headers over ours.
+type writer struct {
+	http.ResponseWriter
+	header, id string
+	wrote      bool
+}
+
+func (w *writer) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		w.Header().Set(w.header, w.id)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Flush/Hijack on the original.
+func (w *writer) Unwrap() http.ResponseWriter { return w.ResponseWriter }
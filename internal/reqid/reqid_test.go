@@ -0,0 +1,177 @@
+package reqid_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/gateway"
+	"github.com/AlexKimmel/GateLite/internal/proxy"
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
+	"github.com/AlexKimmel/GateLite/internal/ratelimit/memory"
+	"github.com/AlexKimmel/GateLite/internal/reqid"
+	"github.com/AlexKimmel/GateLite/internal/routing"
+	"github.com/rs/xid"
+)
+
+func TestValid(t *testing.T) {
+	for id, want := range map[string]bool{
+		"req-1":                  true,
+		"a.b_c:d/e+f=g@h":        true,
+		strings.Repeat("a", 128): true,
+		"":                       false,
+		strings.Repeat("a", 129): false,
+		"a b":                    false,
+		"a\r\nX-Injected: 1":     false,
+		`a"b`:                    false,
+		"a<script>":              false,
+		"a,b":                    false,
+		"a;b":                    false,
+		"café":                   false,
+		"a\x00b":                 false,
+		"{{.}}":                  false,
+	} {
+		if got := reqid.Valid(id); got != want {
+			t.Errorf("Valid(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+// gatewayTo serves the request ID, routing, rate limit and proxy layers in
+// front of upstream, allowing one request per key.
+func gatewayTo(t *testing.T, upstream string) http.Handler {
+	t.Helper()
+	up, _ := url.Parse(upstream)
+	rr := routing.New()
+	rr.Add(&routing.Route{
+		ID:           "echo",
+		Methods:      map[string]struct{}{"GET": {}},
+		Prefix:       "/x",
+		UpUrl:        up,
+		Timeout:      5 * time.Second,
+		LimitDefault: ratelimit.Policy{RPM: 60, Burst: 1},
+	})
+	lim := memory.New(memory.Options{JanitorInterval: -1})
+	t.Cleanup(func() { _ = lim.Close() })
+	return gateway.Chain(
+		proxy.Handler(proxy.NewHTTPTransport(), nil),
+		reqid.Middleware(""),
+		gateway.RouteMatcher(rr),
+		gateway.RateLimit(lim, gateway.Policies{}, nil, nil, nil),
+	)
+}
+
+func serve(h http.Handler, inbound string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/x", nil)
+	if inbound != "" {
+		r.Header.Set(reqid.DefaultHeader, inbound)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func bodyID(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error struct {
+			RequestID string `json:"request_id"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v in %s", err, rec.Body)
+	}
+	return body.Error.RequestID
+}
+
+// dead returns the URL of a port nothing listens on.
+func dead(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return "http://" + addr
+}
+
+func TestMiddleware(t *testing.T) {
+	for _, tc := range []struct {
+		name, inbound string
+		keep          bool
+	}{
+		{"valid", "req-1", true},
+		{"missing", "", false},
+		{"oversized", strings.Repeat("a", 129), false},
+		{"header injection", "a\r\nX-Injected: 1", false},
+		{"json injection", `a","code":"x`, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			seen := make(chan string, 1)
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen <- r.Header.Get(reqid.DefaultHeader)
+				w.Header().Set(reqid.DefaultHeader, "from-upstream")
+			}))
+			defer upstream.Close()
+			h := gatewayTo(t, upstream.URL)
+
+			rec := serve(h, tc.inbound)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			id := rec.Header().Get(reqid.DefaultHeader)
+			if tc.keep && id != tc.inbound {
+				t.Fatalf("response ID %q, want the inbound %q", id, tc.inbound)
+			}
+			if !tc.keep {
+				if _, err := xid.FromString(id); err != nil {
+					t.Fatalf("response ID %q is not a new xid: %v", id, err)
+				}
+			}
+			if got := <-seen; got != id {
+				t.Fatalf("upstream got ID %q, client %q", got, id)
+			}
+
+			// the second request is rate limited
+			rec = serve(h, tc.inbound)
+			id = rec.Header().Get(reqid.DefaultHeader)
+			if rec.Code != http.StatusTooManyRequests || bodyID(t, rec) != id {
+				t.Fatalf("429: status %d, body ID %q, header %q", rec.Code, bodyID(t, rec), id)
+			}
+		})
+	}
+}
+
+func TestMiddlewareUpstreamError(t *testing.T) {
+	for _, inbound := range []string{"req-502", "bad id"} {
+		rec := serve(gatewayTo(t, dead(t)), inbound)
+		id := rec.Header().Get(reqid.DefaultHeader)
+		if rec.Code != http.StatusBadGateway || id == "" || bodyID(t, rec) != id {
+			t.Fatalf("inbound %q: status %d, body ID %q, header %q", inbound, rec.Code, bodyID(t, rec), id)
+		}
+		if (id == inbound) != reqid.Valid(inbound) {
+			t.Fatalf("inbound %q answered with %q", inbound, id)
+		}
+	}
+}
+
+func TestMiddlewareHeader(t *testing.T) {
+	var got string
+	h := reqid.Middleware("X-Correlation-ID")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = reqid.From(r.Context())
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Correlation-ID", "corr-1")
+	r.Header.Set(reqid.DefaultHeader, "ignored")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if got != "corr-1" || rec.Header().Get("X-Correlation-ID") != "corr-1" || rec.Header().Get(reqid.DefaultHeader) != "" {
+		t.Fatalf("context ID %q, headers %v; want corr-1 in X-Correlation-ID only", got, rec.Header())
+	}
+}
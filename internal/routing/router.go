@@ -2,11 +2,12 @@ package routing
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
+
+	"github.com/AlexKimmel/GateLite/internal/ratelimit"
 )
 
 type Route struct {
@@ -15,10 +16,38 @@ type Route struct {
 	Prefix  string
 	UpUrl   *url.URL
 	Timeout time.Duration
+	Tags    []string
+
+	LimitDefault   ratelimit.Policy            // zero means fall back to plan/global
+	LimitOverrides map[string]ratelimit.Policy // by key ID
+	LimitKeyBy     ratelimit.KeyBy             // bucket key for the default/override limit
+	Limits         []Limit                     // extra limits, evaluated in addition
+
+	// in-flight limits (0 disables each); see gateway.Concurrency
+	MaxInFlight         int // per route
+	MaxInFlightPerKey   int // per key on this route
+	MaxInFlightUpstream int // per upstream host, shared by routes using it
+	QueueSize           int // requests allowed to wait for a slot
+	QueueTimeout        time.Duration
+
+	Cost Cost // rate-limit tokens a request consumes
+}
+
+// Cost is how many rate-limit tokens a request on a route consumes.
+type Cost struct {
+	Default        int            // 0 means 1
+	Methods        map[string]int // by upper-case method
+	Header         string         // request header carrying a cost
+	Query          string         // query parameter carrying a cost
+	Max            int            // cap for header/query/response costs; 0 is uncapped
+	ResponseHeader string         // upstream response header with the final cost
+}
 
-	LimitDefaultRPM int
-	LimitDefaultBurst int
-	LimitOverrides map[string]struct{RPM, Burst int}
+// Limit is an additional per-route limit with its own bucket key.
+type Limit struct {
+	ID     string
+	KeyBy  ratelimit.KeyBy
+	Policy ratelimit.Policy
 }
 
 type Router struct {
@@ -36,8 +65,7 @@ func (r *Router) Add(rt *Route) {
 func (r *Router) Routes() []*Route {
 	return r.routes
 }
-func (r *Router) Match( method string, path string) (*Route, bool) {
-	log.Printf("Router.Match called method=%s path=%q routes=%d", method, path, len(r.routes))
+func (r *Router) Match(method string, path string) (*Route, bool) {
 	m := strings.ToUpper(method)
 	for _, rt := range r.routes {
 		if _, ok := rt.Methods[m]; !ok {
@@ -0,0 +1,250 @@
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment passed to a child started by Upgrade.
+const (
+	envListeners = "GATELITE_LISTENERS" // names of inherited listeners, in fd order from 3
+	envReadyFD   = "GATELITE_READY_FD"  // pipe to close once the child serves
+)
+
+// Listeners opens named listeners, reusing sockets inherited from a parent
+// process (see Upgrade) or from systemd socket activation (LISTEN_FDS)
+// before creating new ones, and can hand them all to a new process.
+type Listeners struct {
+	mu        sync.Mutex
+	inherited map[string]net.Listener
+	names     []string
+	lns       map[string]net.Listener
+	upgrading bool
+}
+
+// New picks up inherited listeners from the environment.
+func New() (*Listeners, error) {
+	ls := &Listeners{inherited: map[string]net.Listener{}, lns: map[string]net.Listener{}}
+	files, err := inheritedFiles()
+	if err != nil {
+		return nil, err
+	}
+	for name, f := range files {
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener %q: %w", name, err)
+		}
+		ls.inherited[name] = ln
+	}
+	return ls, nil
+}
+
+// Listen returns the inherited listener called name, or listens on addr.
+// A stale unix socket file at addr is removed first.
+func (ls *Listeners) Listen(name, network, addr string) (net.Listener, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	ln, ok := ls.inherited[name]
+	if ok {
+		delete(ls.inherited, name)
+	} else {
+		if network == "unix" {
+			if err := os.Remove(addr); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+		var err error
+		if ln, err = net.Listen(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	ls.names = append(ls.names, name)
+	ls.lns[name] = ln
+	return ln, nil
+}
+
+// Upgrade starts the current executable (typically just replaced on disk)
+// with every listener passed by file descriptor, and waits up to timeout for
+// it to call Ready. On success the caller should stop accepting and drain;
+// on error the child has been killed and the caller keeps serving.
+//
+// release, if set, runs right before the child starts to give up resources
+// only one process may hold (e.g. file locks); the function it returns
+// restores them if the upgrade fails.
+func (ls *Listeners) Upgrade(timeout time.Duration, release func() (restore func())) error {
+	ls.mu.Lock()
+	if ls.upgrading {
+		ls.mu.Unlock()
+		return errors.New("upgrade already in progress")
+	}
+	ls.upgrading = true
+	ls.mu.Unlock()
+	defer func() {
+		ls.mu.Lock()
+		ls.upgrading = false
+		ls.mu.Unlock()
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	ls.mu.Lock()
+	names := append([]string(nil), ls.names...)
+	for _, name := range names {
+		f, err := listenerFile(ls.lns[name])
+		if err != nil {
+			ls.mu.Unlock()
+			return fmt.Errorf("listener %q: %w", name, err)
+		}
+		files = append(files, f)
+	}
+	ls.mu.Unlock()
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ready.Close() }()
+	files = append(files, readyW)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(childEnv(),
+		envListeners+"="+strings.Join(names, ","),
+		envReadyFD+"="+strconv.Itoa(3+len(files)-1),
+	)
+	restore := func() {}
+	if release != nil {
+		restore = release()
+	}
+	if err := cmd.Start(); err != nil {
+		restore()
+		return err
+	}
+	// only the child may hold the write end, so a crash reads as EOF
+	_ = readyW.Close()
+	files = files[:len(files)-1]
+
+	done := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := ready.Read(b[:])
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("child not ready after %s", timeout)
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		restore()
+		return fmt.Errorf("upgrade: %w", err)
+	}
+	// reap the child if it exits while we are still around
+	go func() { _ = cmd.Wait() }()
+	return nil
+}
+
+// Ready tells the parent that started this process through Upgrade that it
+// is serving. It is a no-op otherwise.
+func Ready() error {
+	v := os.Getenv(envReadyFD)
+	if v == "" {
+		return nil
+	}
+	_ = os.Unsetenv(envReadyFD)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", envReadyFD, err)
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer func() { _ = f.Close() }()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+func listenerFile(ln net.Listener) (*os.File, error) {
+	switch l := ln.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		// the socket path now belongs to the child as well
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	}
+	return nil, fmt.Errorf("cannot hand off %T", ln)
+}
+
+// inheritedFiles maps listener names to descriptors passed by a parent
+// (GATELITE_LISTENERS) or by systemd (LISTEN_FDS, named by LISTEN_FDNAMES or
+// else taken in the order "public", "admin").
+func inheritedFiles() (map[string]*os.File, error) {
+	files := map[string]*os.File{}
+	if v := os.Getenv(envListeners); v != "" {
+		_ = os.Unsetenv(envListeners)
+		for i, name := range strings.Split(v, ",") {
+			files[name] = os.NewFile(uintptr(3+i), name)
+		}
+		return files, nil
+	}
+
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return files, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_FDS: %w", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	defaults := []string{"public", "admin"}
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if name == "" || name == "unknown" {
+			if i >= len(defaults) {
+				continue
+			}
+			name = defaults[i]
+		}
+		files[name] = os.NewFile(uintptr(3+i), name)
+	}
+	for _, k := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(k)
+	}
+	return files, nil
+}
+
+// childEnv is the environment minus our handoff and systemd variables.
+func childEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch k, _, _ := strings.Cut(kv, "="); k {
+		case envListeners, envReadyFD, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES":
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
@@ -0,0 +1,259 @@
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The tests run this binary as the child process; envChild selects what
+// it does instead of running the tests.
+const (
+	envChild   = "UPGRADE_TEST_CHILD"
+	envAddrs   = "UPGRADE_TEST_ADDRS"    // "name=addr,..." the child must inherit
+	envPIDFile = "UPGRADE_TEST_PID_FILE" // where a hanging child writes its pid
+)
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(envChild); mode != "" {
+		if err := child(mode); err != nil {
+			fmt.Fprintln(os.Stderr, "child:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func child(mode string) error {
+	switch mode {
+	case "systemd":
+		// systemd sets this between fork and exec
+		_ = os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		fallthrough
+	case "list":
+		ls, err := New()
+		if err != nil {
+			return err
+		}
+		// whatever it consumed is gone from the environment
+		for _, k := range []string{envListeners, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			if os.Getenv(k) != "" && (mode == "systemd" || k == envListeners) {
+				return fmt.Errorf("%s left in the environment", k)
+			}
+		}
+		var names []string
+		for name := range ls.inherited {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			fmt.Printf("%s=%s\n", name, ls.inherited[name].Addr())
+		}
+	case "ready":
+		ls, err := New()
+		if err != nil {
+			return err
+		}
+		for _, kv := range strings.Split(os.Getenv(envAddrs), ",") {
+			name, want, _ := strings.Cut(kv, "=")
+			ln, err := ls.Listen(name, "tcp", "127.0.0.1:0")
+			if err != nil {
+				return err
+			}
+			if got := ln.Addr().String(); got != want {
+				return fmt.Errorf("listener %s on %s, want %s", name, got, want)
+			}
+		}
+		return Ready()
+	case "hang":
+		if err := os.WriteFile(os.Getenv(envPIDFile), []byte(strconv.Itoa(os.Getpid())), 0o600); err != nil {
+			return err
+		}
+		select {}
+	case "exit":
+		return errors.New("exiting before ready")
+	}
+	return nil
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	return ln
+}
+
+// runChild starts the child in mode with lns as fds 3.. and returns what
+// it prints.
+func runChild(t *testing.T, mode string, env []string, lns ...net.Listener) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(childEnv(), append(env, envChild+"="+mode)...)
+	cmd.Stderr = os.Stderr
+	for _, ln := range lns {
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = f.Close() }()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("child %s: %v", mode, err)
+	}
+	return string(out)
+}
+
+func TestInheritedFiles(t *testing.T) {
+	a, b, c := listen(t), listen(t), listen(t)
+	addr := func(ln net.Listener) string { return ln.Addr().String() }
+
+	for _, tc := range []struct {
+		name string
+		mode string
+		env  []string
+		lns  []net.Listener
+		want []string // name=addr, sorted by name
+	}{
+		{"parent order", "list", []string{envListeners + "=public,admin"}, []net.Listener{a, b},
+			[]string{"admin=" + addr(b), "public=" + addr(a)}},
+		{"parent names", "list", []string{envListeners + "=admin,public,extra"}, []net.Listener{a, b, c},
+			[]string{"admin=" + addr(a), "extra=" + addr(c), "public=" + addr(b)}},
+		{"systemd names", "systemd", []string{"LISTEN_FDS=2", "LISTEN_FDNAMES=admin:public"}, []net.Listener{a, b},
+			[]string{"admin=" + addr(a), "public=" + addr(b)}},
+		{"systemd defaults", "systemd", []string{"LISTEN_FDS=2"}, []net.Listener{a, b},
+			[]string{"admin=" + addr(b), "public=" + addr(a)}},
+		// unnamed fds take the default for their position; extras are dropped
+		{"systemd unknown", "systemd", []string{"LISTEN_FDS=3", "LISTEN_FDNAMES=unknown:admin:"}, []net.Listener{a, b, c},
+			[]string{"admin=" + addr(b), "public=" + addr(a)}},
+		{"systemd other pid", "list", []string{"LISTEN_PID=1", "LISTEN_FDS=2"}, []net.Listener{a, b}, nil},
+		{"nothing", "list", nil, nil, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := strings.Fields(runChild(t, tc.mode, tc.env, tc.lns...))
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("inherited %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestChildEnv(t *testing.T) {
+	for _, k := range []string{envListeners, envReadyFD, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		t.Setenv(k, "x")
+	}
+	t.Setenv("GATELITE_CONFIG", "/etc/gatelite.yaml")
+	env := childEnv()
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		if k == envListeners || k == envReadyFD || strings.HasPrefix(k, "LISTEN_") {
+			t.Fatalf("child environment keeps %s", kv)
+		}
+	}
+	if !slices.Contains(env, "GATELITE_CONFIG=/etc/gatelite.yaml") {
+		t.Fatal("child environment lost GATELITE_CONFIG")
+	}
+}
+
+// listeners returns a Listeners holding public and admin, and the
+// envAddrs value describing them.
+func listeners(t *testing.T) (*Listeners, string) {
+	t.Helper()
+	ls, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, name := range []string{"public", "admin"} {
+		ln, err := ls.Listen(name, "tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = ln.Close() })
+		addrs = append(addrs, name+"="+ln.Addr().String())
+	}
+	return ls, strings.Join(addrs, ",")
+}
+
+// releaser counts release and restore calls.
+type releaser struct{ released, restored int }
+
+func (r *releaser) release() func() {
+	r.released++
+	return func() { r.restored++ }
+}
+
+func TestUpgrade(t *testing.T) {
+	ls, addrs := listeners(t)
+	t.Setenv(envChild, "ready")
+	t.Setenv(envAddrs, addrs)
+	var r releaser
+	if err := ls.Upgrade(10*time.Second, r.release); err != nil {
+		t.Fatal(err)
+	}
+	if r.released != 1 || r.restored != 0 {
+		t.Fatalf("released %d, restored %d; want 1, 0", r.released, r.restored)
+	}
+}
+
+func TestUpgradeChildExits(t *testing.T) {
+	ls, _ := listeners(t)
+	t.Setenv(envChild, "exit")
+	var r releaser
+	start := time.Now()
+	err := ls.Upgrade(10*time.Second, r.release)
+	if err == nil {
+		t.Fatal("upgrade succeeded with a child that exited")
+	}
+	// the closed pipe fails the upgrade without waiting for the timeout
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("took %v to notice the child exited", took)
+	}
+	if r.released != 1 || r.restored != 1 {
+		t.Fatalf("released %d, restored %d; want 1, 1", r.released, r.restored)
+	}
+}
+
+func TestUpgradeTimeout(t *testing.T) {
+	ls, _ := listeners(t)
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	t.Setenv(envChild, "hang")
+	t.Setenv(envPIDFile, pidFile)
+	var r releaser
+	err := ls.Upgrade(time.Second, r.release)
+	if err == nil || !strings.Contains(err.Error(), "not ready after 1s") {
+		t.Fatalf("error %v, want a readiness timeout", err)
+	}
+	if r.released != 1 || r.restored != 1 {
+		t.Fatalf("released %d, restored %d; want 1, 1", r.released, r.restored)
+	}
+
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("child never started: %v", err)
+	}
+	pid, _ := strconv.Atoi(string(b))
+	if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+		t.Fatalf("child %d still exists after the timeout: %v", pid, err)
+	}
+
+	// the parent keeps its listeners and can try again
+	t.Setenv(envChild, "exit")
+	if err := ls.Upgrade(10*time.Second, nil); err == nil || strings.Contains(err.Error(), "in progress") {
+		t.Fatalf("second upgrade: %v, want the child's failure", err)
+	}
+}